@@ -3,10 +3,13 @@ package main
 import (
 	"log"
 	"os"
+	"runtime"
 
 	"github.com/Flack74/realm-backend/internal/api/handlers"
 	"github.com/Flack74/realm-backend/internal/api/middleware"
 	"github.com/Flack74/realm-backend/internal/infrastructure/database"
+	"github.com/Flack74/realm-backend/internal/infrastructure/media"
+	"github.com/Flack74/realm-backend/internal/infrastructure/storage"
 	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	
 	"github.com/gofiber/fiber/v2"
@@ -32,12 +35,47 @@ func main() {
 	// }
 
 	hub := websocket.NewHub()
-	go hub.Run()
+	var presenceStore websocket.PresenceStore = websocket.NewMemoryPresenceStore()
 
-	wsHandler := handlers.NewWebSocketHandler(hub)
-	realmHandler := handlers.NewRealmHandler(realmDB.DB)
+	redisClient, err := database.NewRedisClient()
+	if err != nil {
+		log.Fatal("Failed to connect to redis:", err)
+	}
+	if redisClient != nil {
+		backplane := websocket.NewRedisBackplane(redisClient, "")
+		if err := hub.UseBackplane(backplane); err != nil {
+			log.Fatal("Failed to subscribe to hub backplane:", err)
+		}
+		defer backplane.Close()
+		presenceStore = websocket.NewRedisPresenceStore(redisClient, "")
+		log.Printf("Hub node %s using redis backplane", hub.NodeID())
+	}
+
+	perms := handlers.NewPermissionResolver(realmDB.DB)
+	wsHandler := handlers.NewWebSocketHandler(hub, realmDB.DB, perms)
+	presenceHandler := handlers.NewPresenceHandler(realmDB.DB, hub, presenceStore)
+
+	blobStore, err := storage.NewBlobStoreFromEnv()
+	if err != nil {
+		log.Fatal("Failed to initialise blob storage:", err)
+	}
+	uploads := handlers.NewUploader(blobStore)
+
+	imagePool := media.NewPool(runtime.NumCPU(), 256)
+	defer imagePool.Close()
+	images := handlers.NewImageProcessor(realmDB.DB, hub, uploads, imagePool)
+	realmHandler := handlers.NewRealmHandler(realmDB.DB, hub, uploads, images)
+	hub.SetPresenceListener(presenceHandler)
+	hub.SetChannelAuthorizer(perms)
+
+	go hub.Run()
 
 	app := fiber.New(fiber.Config{
+		// Bodies past BodyLimit are streamed rather than buffered, so
+		// middleware.BodyLimit can reject them before they are read.
+		BodyLimit:                    handlers.MaxRequestBodySize,
+		StreamRequestBody:            true,
+		DisablePreParseMultipartForm: true,
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
 			code := fiber.StatusInternalServerError
 			if e, ok := err.(*fiber.Error); ok {
@@ -48,10 +86,12 @@ func main() {
 	})
 
 	app.Use(logger.New())
+	app.Use(middleware.BodyLimit(handlers.MaxRequestBodySize, handlers.MaxUploadSize, "/api/v1/protected/"))
 	app.Use(cors.New(cors.Config{
 		AllowOrigins:     "http://localhost:3000,http://localhost:5173",
-		AllowMethods:     "GET,POST,PUT,DELETE,OPTIONS",
+		AllowMethods:     "GET,POST,PUT,PATCH,DELETE,OPTIONS",
 		AllowHeaders:     "Origin,Content-Type,Accept,Authorization",
+		ExposeHeaders:    handlers.HeaderCursorBefore + "," + handlers.HeaderCursorAfter,
 		AllowCredentials: true,
 	}))
 
@@ -87,18 +127,43 @@ func main() {
 	api.Post("/auth/register", authHandler.Register)
 	api.Post("/auth/login", authHandler.Login)
 
+	roleRealm := handlers.RoleRealm("roleId")
+	realmParam := handlers.RealmParam("id")
+	categoryRealm := handlers.CategoryRealm("id")
+
 	friendsHandler := handlers.NewFriendsHandler(realmDB.DB)
-	messagesHandler := handlers.NewMessagesHandler(realmDB.DB)
-	channelsHandler := handlers.NewChannelsHandler(realmDB.DB)
-	voiceHandler := handlers.NewVoiceHandler(realmDB.DB)
-	rolesHandler := handlers.NewRolesHandler(realmDB.DB)
-	moderationHandler := handlers.NewModerationHandler(realmDB.DB)
-	notificationsHandler := handlers.NewNotificationsHandler(realmDB.DB)
-	dmHandler := handlers.NewDMHandler(realmDB.DB)
+	notificationsHandler := handlers.NewNotificationsHandler(realmDB.DB, hub)
+	messagesHandler := handlers.NewMessagesHandler(realmDB.DB, hub, perms, uploads, images, notificationsHandler)
+	channelsHandler := handlers.NewChannelsHandler(realmDB.DB, hub, perms)
+	categoriesHandler := handlers.NewCategoriesHandler(realmDB.DB, hub, perms)
+	voiceHandler := handlers.NewVoiceHandler(realmDB.DB, perms)
+	rolesHandler := handlers.NewRolesHandler(realmDB.DB, hub, perms)
+	membersHandler := handlers.NewMembersHandler(realmDB.DB, hub, perms, uploads, images)
+	moderationHandler := handlers.NewModerationHandler(realmDB.DB, hub, perms)
+	dmHandler := handlers.NewDMHandler(realmDB.DB, uploads, images)
+	searchHandler := handlers.NewSearchHandler(realmDB.DB, perms, uploads)
+	mediaHandler := handlers.NewMediaHandler(realmDB.DB, uploads, images)
+	threadsHandler := handlers.NewThreadsHandler(realmDB.DB, hub, uploads)
+	pinsHandler := handlers.NewPinsHandler(realmDB.DB, hub, uploads)
+	mentionsHandler := handlers.NewMentionsHandler(realmDB.DB, perms, uploads)
+	readStatesHandler := handlers.NewReadStatesHandler(realmDB.DB, hub)
+	purgeHandler := handlers.NewPurgeHandler(realmDB.DB, hub)
+	invitesHandler := handlers.NewInvitesHandler(realmDB.DB, hub, perms)
+	announcementsHandler := handlers.NewAnnouncementsHandler(realmDB.DB, hub, perms, uploads)
+
+	go threadsHandler.RunArchiver(handlers.ThreadArchiveInterval)
+	go moderationHandler.RunExpiry(handlers.SanctionExpiryInterval)
+	go announcementsHandler.RunDelivery(handlers.CrosspostDeliveryInterval)
 
 	protected.Get("/profile", authHandler.GetProfile)
 	protected.Put("/profile", authHandler.UpdateProfile)
-	protected.Put("/status", authHandler.UpdateStatus)
+	protected.Post("/profile/age-acknowledgement", authHandler.AcknowledgeAge)
+	protected.Put("/status", presenceHandler.UpdateStatus)
+	protected.Put("/profile/avatar", mediaHandler.UploadAvatar)
+	protected.Put("/profile/banner", mediaHandler.UploadBanner)
+
+	api.Get("/files/*", mediaHandler.ServeFile)
+	api.Get("/media/*", mediaHandler.GetMedia)
 
 	protected.Post("/friends/request", friendsHandler.SendFriendRequest)
 	protected.Post("/friends/:id/accept", friendsHandler.AcceptFriendRequest)
@@ -108,50 +173,103 @@ func main() {
 	protected.Post("/realms", realmHandler.CreateRealm)
 	protected.Get("/realms", realmHandler.GetUserRealms)
 	protected.Get("/realms/:id", realmHandler.GetRealm)
-	protected.Post("/realms/:code/join", realmHandler.JoinRealm)
+	protected.Patch("/realms/:id", perms.RequirePermission(handlers.PermissionManageRealm, realmParam), realmHandler.UpdateRealm)
+	protected.Delete("/realms/:id", perms.RequirePermission(handlers.PermissionViewChannels, realmParam), realmHandler.DeleteRealm)
+	protected.Post("/realms/:id/transfer", perms.RequirePermission(handlers.PermissionViewChannels, realmParam), realmHandler.TransferRealm)
+	protected.Get("/realms/:id/members", perms.RequirePermission(handlers.PermissionViewChannels, realmParam), realmHandler.GetRealmMembers)
+	protected.Post("/realms/:code/join", invitesHandler.AcceptInvite)
 	protected.Delete("/realms/:id/leave", realmHandler.LeaveRealm)
 
-	protected.Post("/realms/:realmId/channels", channelsHandler.CreateChannel)
-	protected.Get("/realms/:realmId/channels", channelsHandler.GetRealmChannels)
-	protected.Get("/channels/:id", channelsHandler.GetChannel)
-	protected.Put("/channels/:id", channelsHandler.UpdateChannel)
-	protected.Delete("/channels/:id", channelsHandler.DeleteChannel)
+	protected.Post("/realms/:realmId/invites", perms.RequirePermission(handlers.PermissionCreateInvite), invitesHandler.CreateInvite)
+	protected.Get("/realms/:realmId/invites", perms.RequirePermission(handlers.PermissionManageChannels), invitesHandler.GetRealmInvites)
+	protected.Get("/realms/:realmId/vanity", perms.RequirePermission(handlers.PermissionViewChannels), invitesHandler.GetVanity)
+	protected.Put("/realms/:realmId/vanity", perms.RequirePermission(handlers.PermissionViewChannels), invitesHandler.SetVanity)
+	protected.Get("/invites/:code", invitesHandler.GetInvite)
+	protected.Post("/invites/:code", invitesHandler.AcceptInvite)
+	protected.Delete("/invites/:code", invitesHandler.DeleteInvite)
+
+	protected.Post("/realms/:realmId/channels", perms.RequirePermission(handlers.PermissionManageChannels), channelsHandler.CreateChannel)
+	protected.Get("/realms/:realmId/channels", perms.RequirePermission(handlers.PermissionViewChannels), channelsHandler.GetRealmChannels)
+	protected.Patch("/realms/:realmId/channels/positions", perms.RequirePermission(handlers.PermissionManageChannels), channelsHandler.UpdatePositions)
+	protected.Post("/realms/:realmId/categories", perms.RequirePermission(handlers.PermissionManageChannels), categoriesHandler.CreateCategory)
+	protected.Get("/realms/:realmId/categories", perms.RequirePermission(handlers.PermissionViewChannels), categoriesHandler.GetCategories)
+	protected.Patch("/categories/:id", perms.RequirePermission(handlers.PermissionManageChannels, categoryRealm), categoriesHandler.UpdateCategory)
+	protected.Delete("/categories/:id", perms.RequirePermission(handlers.PermissionManageChannels, categoryRealm), categoriesHandler.DeleteCategory)
+	protected.Get("/categories/:id/permissions", perms.RequirePermission(handlers.PermissionManageRoles, categoryRealm), categoriesHandler.GetPermissionOverwrites)
+	protected.Put("/categories/:id/permissions/:targetId", perms.RequirePermission(handlers.PermissionManageRoles, categoryRealm), categoriesHandler.SetPermissionOverwrite)
+	protected.Delete("/categories/:id/permissions/:targetId", perms.RequirePermission(handlers.PermissionManageRoles, categoryRealm), categoriesHandler.DeletePermissionOverwrite)
+	protected.Put("/realms/:realmId/icon", perms.RequirePermission(handlers.PermissionManageRealm), mediaHandler.UploadRealmIcon)
+	protected.Get("/realms/:realmId/messages/search", perms.RequirePermission(handlers.PermissionViewChannels), searchHandler.SearchRealmMessages)
+	protected.Get("/channels/:id", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ChannelParam("id")), channelsHandler.GetChannel)
+	protected.Put("/channels/:id", perms.RequireChannelPermission(handlers.PermissionManageChannels, handlers.ChannelParam("id")), channelsHandler.UpdateChannel)
+	protected.Delete("/channels/:id", perms.RequireChannelPermission(handlers.PermissionManageChannels, handlers.ChannelParam("id")), channelsHandler.DeleteChannel)
+	protected.Get("/channels/:id/permissions", perms.RequireChannelPermission(handlers.PermissionManageRoles, handlers.ChannelParam("id")), channelsHandler.GetPermissionOverwrites)
+	protected.Put("/channels/:id/permissions/:targetId", perms.RequireChannelPermission(handlers.PermissionManageRoles, handlers.ChannelParam("id")), channelsHandler.SetPermissionOverwrite)
+	protected.Delete("/channels/:id/permissions/:targetId", perms.RequireChannelPermission(handlers.PermissionManageRoles, handlers.ChannelParam("id")), channelsHandler.DeletePermissionOverwrite)
+	protected.Post("/channels/:id/permissions/sync", perms.RequireChannelPermission(handlers.PermissionManageRoles, handlers.ChannelParam("id")), channelsHandler.SyncPermissions)
+
+	protected.Post("/channels/:id/messages", perms.RequireChannelPermission(handlers.PermissionSendMessages, handlers.ChannelParam("id")), messagesHandler.SendMessage)
+	protected.Get("/channels/:id/messages", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ChannelParam("id")), messagesHandler.GetMessages)
+	protected.Post("/channels/:id/messages/bulk-delete", perms.RequireChannelPermission(handlers.PermissionManageMessages, handlers.ChannelParam("id")), purgeHandler.BulkDelete)
+	protected.Post("/channels/:id/messages/purge", perms.RequireChannelPermission(handlers.PermissionManageMessages, handlers.ChannelParam("id")), purgeHandler.Purge)
+	protected.Post("/channels/:id/ack", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ChannelParam("id")), readStatesHandler.AckChannel)
+	protected.Get("/channels/:id/pins", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ChannelParam("id")), pinsHandler.GetPins)
+	protected.Put("/channels/:channelId/pins/:messageId", perms.RequireChannelPermission(handlers.PermissionManageMessages, handlers.ChannelParam("channelId")), pinsHandler.PinMessage)
+	protected.Delete("/channels/:channelId/pins/:messageId", perms.RequireChannelPermission(handlers.PermissionManageMessages, handlers.ChannelParam("channelId")), pinsHandler.UnpinMessage)
+	protected.Post("/channels/:channelId/messages/:messageId/publish", perms.RequireChannelPermission(handlers.PermissionSendMessages, handlers.ChannelParam("channelId")), announcementsHandler.PublishMessage)
+	protected.Post("/channels/:id/followers", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ChannelParam("id")), announcementsHandler.FollowChannel)
+	protected.Get("/channels/:id/followers", perms.RequireChannelPermission(handlers.PermissionManageChannels, handlers.ChannelParam("id")), announcementsHandler.GetFollowers)
+	protected.Get("/channels/:id/follows", perms.RequireChannelPermission(handlers.PermissionManageChannels, handlers.ChannelParam("id")), announcementsHandler.GetFollows)
+	protected.Delete("/channel-follows/:id", announcementsHandler.Unfollow)
+	protected.Put("/messages/:id", perms.RequireChannelPermission(handlers.PermissionSendMessages, handlers.MessageChannel("id")), messagesHandler.EditMessage)
+	protected.Delete("/messages/:id", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.MessageChannel("id")), messagesHandler.DeleteMessage)
+	protected.Get("/messages/:id/history", messagesHandler.GetMessageHistory)
+	protected.Post("/messages/:id/reactions", perms.RequireChannelPermission(handlers.PermissionSendMessages, handlers.MessageChannel("id")), messagesHandler.AddReaction)
+	protected.Delete("/messages/:messageId/reactions/:emoji", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.MessageChannel("messageId")), messagesHandler.RemoveReaction)
 
-	protected.Post("/channels/:id/messages", messagesHandler.SendMessage)
-	protected.Get("/channels/:id/messages", messagesHandler.GetMessages)
-	protected.Put("/messages/:id", messagesHandler.EditMessage)
-	protected.Delete("/messages/:id", messagesHandler.DeleteMessage)
-	protected.Post("/messages/:id/reactions", messagesHandler.AddReaction)
-	protected.Delete("/messages/:messageId/reactions/:emoji", messagesHandler.RemoveReaction)
+	protected.Post("/messages/:id/threads", perms.RequireChannelPermission(handlers.PermissionSendMessages, handlers.MessageChannel("id")), threadsHandler.CreateThread)
+	protected.Get("/channels/:id/threads", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ChannelParam("id")), threadsHandler.GetChannelThreads)
+	protected.Get("/threads/:id", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ThreadChannel("id")), threadsHandler.GetThread)
+	protected.Put("/threads/:id", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ThreadChannel("id")), threadsHandler.UpdateThread)
+	protected.Get("/threads/:id/messages", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ThreadChannel("id")), threadsHandler.GetThreadMessages)
+	protected.Get("/threads/:id/members", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ThreadChannel("id")), threadsHandler.GetThreadMembers)
+	protected.Post("/threads/:id/join", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ThreadChannel("id")), threadsHandler.JoinThread)
+	protected.Delete("/threads/:id/leave", perms.RequireChannelPermission(handlers.PermissionViewChannels, handlers.ThreadChannel("id")), threadsHandler.LeaveThread)
 
 	protected.Post("/voice/join", voiceHandler.JoinVoice)
 	protected.Post("/voice/leave", voiceHandler.LeaveVoice)
 	protected.Put("/voice/state", voiceHandler.UpdateVoiceState)
 	protected.Get("/voice/channels/:channelId/users", voiceHandler.GetVoiceUsers)
 
-	protected.Post("/realms/:realmId/roles", rolesHandler.CreateRole)
-	protected.Get("/realms/:realmId/roles", rolesHandler.GetRealmRoles)
-	protected.Put("/roles/:roleId", rolesHandler.UpdateRole)
-	protected.Delete("/roles/:roleId", rolesHandler.DeleteRole)
-	protected.Post("/realms/:realmId/members/:userId/roles/:roleId", rolesHandler.AssignRole)
-	protected.Delete("/members/:userId/roles/:roleId", rolesHandler.RemoveRole)
+	protected.Post("/realms/:realmId/roles", perms.RequirePermission(handlers.PermissionManageRoles), rolesHandler.CreateRole)
+	protected.Get("/realms/:realmId/roles", perms.RequirePermission(handlers.PermissionViewChannels), rolesHandler.GetRealmRoles)
+	protected.Put("/roles/:roleId", perms.RequirePermission(handlers.PermissionManageRoles, roleRealm), rolesHandler.UpdateRole)
+	protected.Delete("/roles/:roleId", perms.RequirePermission(handlers.PermissionManageRoles, roleRealm), rolesHandler.DeleteRole)
+	protected.Post("/realms/:realmId/members/:userId/roles/:roleId", perms.RequirePermission(handlers.PermissionManageRoles), rolesHandler.AssignRole)
+	protected.Delete("/members/:userId/roles/:roleId", perms.RequirePermission(handlers.PermissionManageRoles, roleRealm), rolesHandler.RemoveRole)
 
-	protected.Post("/realms/:realmId/members/:userId/kick", moderationHandler.KickMember)
-	protected.Post("/realms/:realmId/members/:userId/ban", moderationHandler.BanMember)
-	protected.Post("/realms/:realmId/members/:userId/timeout", moderationHandler.TimeoutMember)
-	protected.Delete("/realms/:realmId/members/:userId/ban", moderationHandler.UnbanMember)
-	protected.Get("/realms/:realmId/moderation", moderationHandler.GetModerationLog)
+	protected.Patch("/realms/:realmId/members/@me", perms.RequirePermission(handlers.PermissionViewChannels), membersHandler.UpdateSelf)
+	protected.Patch("/realms/:realmId/members/:userId", perms.RequirePermission(handlers.PermissionManageNicknames), membersHandler.UpdateMember)
+	protected.Post("/realms/:realmId/members/:userId/kick", perms.RequirePermission(handlers.PermissionKickMembers), moderationHandler.KickMember)
+	protected.Post("/realms/:realmId/members/:userId/ban", perms.RequirePermission(handlers.PermissionBanMembers), moderationHandler.BanMember)
+	protected.Post("/realms/:realmId/members/:userId/timeout", perms.RequirePermission(handlers.PermissionKickMembers), moderationHandler.TimeoutMember)
+	protected.Delete("/realms/:realmId/members/:userId/ban", perms.RequirePermission(handlers.PermissionBanMembers), moderationHandler.UnbanMember)
+	protected.Get("/realms/:realmId/moderation", perms.RequirePermission(handlers.PermissionKickMembers), moderationHandler.GetModerationLog)
 
 	protected.Get("/notifications", notificationsHandler.GetNotifications)
 	protected.Put("/notifications/:id/read", notificationsHandler.MarkAsRead)
 	protected.Put("/notifications/read-all", notificationsHandler.MarkAllAsRead)
 	protected.Get("/notifications/unread-count", notificationsHandler.GetUnreadCount)
+	protected.Get("/mentions", mentionsHandler.GetMentions)
 
+	protected.Get("/dm/search", searchHandler.SearchDirectMessages)
 	protected.Post("/dm/:userId", dmHandler.SendDirectMessage)
 	protected.Get("/dm/:userId", dmHandler.GetConversation)
 	protected.Get("/conversations", dmHandler.GetConversations)
+	protected.Post("/conversations/:id/ack", readStatesHandler.AckConversation)
 	protected.Put("/dm/:messageId", dmHandler.EditDirectMessage)
 	protected.Delete("/dm/:messageId", dmHandler.DeleteDirectMessage)
+	protected.Get("/dm/:messageId/history", dmHandler.GetDirectMessageHistory)
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -0,0 +1,472 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxPublishesPerHour caps how many messages an announcement channel
+	// may publish in any hour.
+	MaxPublishesPerHour = 10
+	// CrosspostDeliveryInterval is how often pending crossposts are retried.
+	CrosspostDeliveryInterval = 5 * time.Second
+
+	// maxDeliveryAttempts is how often a crosspost is attempted before it
+	// is dropped.
+	maxDeliveryAttempts = 5
+	deliveryBatchSize   = 50
+)
+
+var errPublishLimit = errors.New("publish limit reached")
+
+// AnnouncementsHandler lets channels in other realms follow announcement
+// channels. Published messages are queued as deliveries, one per follower,
+// and posted by RunDelivery on whichever node claims them.
+type AnnouncementsHandler struct {
+	db      *gorm.DB
+	hub     *websocket.Hub
+	perms   *PermissionResolver
+	uploads *Uploader
+	wake    chan struct{}
+}
+
+// ChannelFollow delivers what an announcement channel publishes into a
+// channel of another realm.
+type ChannelFollow struct {
+	ID              uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	SourceChannelID uuid.UUID `json:"source_channel_id" gorm:"type:uuid;not null"`
+	TargetChannelID uuid.UUID `json:"target_channel_id" gorm:"type:uuid;not null"`
+	CreatorID       uuid.UUID `json:"creator_id" gorm:"type:uuid;not null"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// CrosspostDelivery is a published message still to be posted into a
+// following channel.
+type CrosspostDelivery struct {
+	ID              uuid.UUID `gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	MessageID       uuid.UUID `gorm:"type:uuid;not null"`
+	TargetChannelID uuid.UUID `gorm:"type:uuid;not null"`
+	Attempts        int       `gorm:"default:0"`
+	NextAttemptAt   time.Time `gorm:"default:now()"`
+	LastError       string
+	CreatedAt       time.Time
+}
+
+// Crosspost attributes a crossposted message to the realm, channel and
+// message it was published from, as they were at the time.
+type Crosspost struct {
+	RealmID     uuid.UUID `json:"realm_id"`
+	RealmName   string    `json:"realm_name"`
+	RealmIcon   string    `json:"realm_icon,omitempty"`
+	ChannelID   uuid.UUID `json:"channel_id"`
+	ChannelName string    `json:"channel_name"`
+	MessageID   uuid.UUID `json:"message_id"`
+}
+
+type FollowChannelRequest struct {
+	TargetChannelID uuid.UUID `json:"target_channel_id"`
+}
+
+func NewAnnouncementsHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver, uploads *Uploader) *AnnouncementsHandler {
+	return &AnnouncementsHandler{db: db, hub: hub, perms: perms, uploads: uploads, wake: make(chan struct{}, 1)}
+}
+
+// FollowChannel makes a channel of another realm receive what the
+// announcement channel publishes. The caller needs PermissionManageChannels
+// in the target channel, and NSFW channels can only be followed into NSFW
+// channels.
+func (h *AnnouncementsHandler) FollowChannel(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	source := c.Locals("channel").(*Channel)
+	if source.Type != ChannelTypeAnnouncement {
+		return c.Status(400).JSON(fiber.Map{"error": "Not an announcement channel"})
+	}
+
+	var req FollowChannelRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	target, err := findChannel(h.db, req.TargetChannelID)
+	if err != nil {
+		return err
+	}
+	if target.Type != ChannelTypeText && target.Type != ChannelTypeAnnouncement {
+		return c.Status(400).JSON(fiber.Map{"error": "Target must be a text channel"})
+	}
+	if target.RealmID == source.RealmID {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot follow a channel of the same realm"})
+	}
+	if source.NSFW && !target.NSFW {
+		return c.Status(400).JSON(fiber.Map{"error": "NSFW channels can only be followed into NSFW channels"})
+	}
+
+	member, err := h.perms.ResolveChannel(target, userID)
+	if err != nil || !member.Has(PermissionViewChannels) {
+		return c.Status(404).JSON(fiber.Map{"error": "Channel not found"})
+	}
+	if !member.Has(PermissionManageChannels) {
+		return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+	}
+
+	follow := ChannelFollow{
+		SourceChannelID: source.ID,
+		TargetChannelID: target.ID,
+		CreatorID:       userID,
+	}
+	result := h.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "source_channel_id"}, {Name: "target_channel_id"}},
+		DoNothing: true,
+	}).Create(&follow)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to follow channel"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Channel already followed"})
+	}
+
+	return c.JSON(follow)
+}
+
+// GetFollowers lists the channels following an announcement channel.
+func (h *AnnouncementsHandler) GetFollowers(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+
+	var follows []ChannelFollow
+	if err := h.db.Where("source_channel_id = ?", channel.ID).Order("created_at ASC").Find(&follows).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch followers"})
+	}
+
+	return c.JSON(follows)
+}
+
+// GetFollows lists the announcement channels a channel follows.
+func (h *AnnouncementsHandler) GetFollows(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+
+	var follows []ChannelFollow
+	if err := h.db.Where("target_channel_id = ?", channel.ID).Order("created_at ASC").Find(&follows).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch follows"})
+	}
+
+	return c.JSON(follows)
+}
+
+// Unfollow removes a follow. Members with PermissionManageChannels in either
+// the announcement channel or the following channel may remove it.
+func (h *AnnouncementsHandler) Unfollow(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	var follow ChannelFollow
+	if err := h.db.Where("id = ?", c.Params("id")).First(&follow).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Follow not found"})
+	}
+
+	allowed := false
+	for _, channelID := range []uuid.UUID{follow.TargetChannelID, follow.SourceChannelID} {
+		channel, err := findChannel(h.db, channelID)
+		if err != nil {
+			continue
+		}
+		if member, err := h.perms.ResolveChannel(channel, userID); err == nil && member.Has(PermissionManageChannels) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return c.Status(404).JSON(fiber.Map{"error": "Follow not found"})
+	}
+
+	if err := h.db.Delete(&follow).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to unfollow channel"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Channel unfollowed"})
+}
+
+// PublishMessage crossposts a message of an announcement channel into every
+// channel following it. Only the author or members with
+// PermissionManageMessages may publish, at most MaxPublishesPerHour times per
+// channel per hour.
+func (h *AnnouncementsHandler) PublishMessage(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	channel := c.Locals("channel").(*Channel)
+	messageID := c.Params("messageId")
+	if channel.Type != ChannelTypeAnnouncement {
+		return c.Status(400).JSON(fiber.Map{"error": "Not an announcement channel"})
+	}
+
+	var message Message
+	if err := h.db.Where("id = ? AND channel_id = ? AND thread_id IS NULL AND type = ?", messageID, channel.ID, MessageTypeText).
+		First(&message).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if message.UserID != userID && !currentMember(c).Has(PermissionManageMessages) {
+		return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+	}
+	if message.PublishedAt != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Message already published"})
+	}
+
+	var retryAfter int
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the channel so concurrent publishes cannot exceed the limit.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Channel{}, "id = ?", channel.ID).Error; err != nil {
+			return err
+		}
+
+		var recent struct {
+			Count      int
+			RetryAfter int
+		}
+		if err := tx.Unscoped().Model(&Message{}).
+			Where("channel_id = ? AND published_at > NOW() - INTERVAL '1 hour'", channel.ID).
+			Select("COUNT(*) AS count, COALESCE(CEIL(EXTRACT(EPOCH FROM MIN(published_at) + INTERVAL '1 hour' - NOW())), 0)::int AS retry_after").
+			Scan(&recent).Error; err != nil {
+			return err
+		}
+		if recent.Count >= MaxPublishesPerHour {
+			retryAfter = max(recent.RetryAfter, 1)
+			return errPublishLimit
+		}
+
+		result := tx.Model(&message).Where("published_at IS NULL").Update("published_at", time.Now())
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return fiber.NewError(400, "Message already published")
+		}
+
+		return tx.Exec(`
+			INSERT INTO crosspost_deliveries (message_id, target_channel_id)
+			SELECT ?, target_channel_id FROM channel_follows WHERE source_channel_id = ?`,
+			message.ID, channel.ID,
+		).Error
+	})
+	if errors.Is(err, errPublishLimit) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+		return c.Status(429).JSON(fiber.Map{"error": "Publish limit reached", "retry_after": retryAfter})
+	}
+	if err != nil {
+		if fe, ok := err.(*fiber.Error); ok {
+			return fe
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to publish message"})
+	}
+
+	h.db.Preload("User").Preload("Attachments").First(&message, "id = ?", message.ID)
+	signAttachments(c.Context(), h.uploads, message.Attachments)
+	attachMembers(h.db, &message)
+	h.hub.BroadcastToChannel(channel.ID, websocket.WSMessage{
+		Type:      websocket.EventMessageUpdate,
+		Data:      message,
+		ChannelID: &channel.ID,
+	})
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+
+	return c.JSON(message)
+}
+
+// RunDelivery posts pending crossposts every interval, or as soon as a
+// message is published on this node. It never returns.
+func (h *AnnouncementsHandler) RunDelivery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-h.wake:
+		}
+		for {
+			delivered, err := h.DeliverCrossposts()
+			if err != nil {
+				log.Printf("Failed to deliver crossposts: %v", err)
+			}
+			if err != nil || delivered < deliveryBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// DeliverCrossposts claims a batch of due deliveries and posts them,
+// returning how many it claimed. Failed deliveries are retried with backoff
+// until maxDeliveryAttempts; deliveries whose message was deleted or whose
+// follow was removed are dropped.
+func (h *AnnouncementsHandler) DeliverCrossposts() (int, error) {
+	var deliveries []CrosspostDelivery
+	var posted []Message
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE", Options: "SKIP LOCKED"}).
+			Where("next_attempt_at <= NOW()").
+			Order("created_at ASC").
+			Limit(deliveryBatchSize).
+			Find(&deliveries).Error; err != nil {
+			return err
+		}
+
+		for _, delivery := range deliveries {
+			var message *Message
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				var err error
+				message, err = crosspost(tx, delivery)
+				return err
+			})
+			if err != nil {
+				if err := h.retry(tx, delivery, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := tx.Delete(&delivery).Error; err != nil {
+				return err
+			}
+			if message != nil {
+				posted = append(posted, *message)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range posted {
+		message := &posted[i]
+		h.db.Preload("User").Preload("Attachments").First(message, "id = ?", message.ID)
+		signAttachments(context.Background(), h.uploads, message.Attachments)
+		attachMembers(h.db, message)
+		h.hub.BroadcastToChannel(message.ChannelID, websocket.WSMessage{
+			Type:      websocket.EventMessageCreate,
+			Data:      message,
+			ChannelID: &message.ChannelID,
+		})
+	}
+	return len(deliveries), nil
+}
+
+// retry schedules another attempt of a failed delivery, backing off
+// exponentially, or drops it after maxDeliveryAttempts.
+func (h *AnnouncementsHandler) retry(tx *gorm.DB, delivery CrosspostDelivery, cause error) error {
+	attempts := delivery.Attempts + 1
+	if attempts >= maxDeliveryAttempts {
+		log.Printf("Dropping crosspost of %s to %s after %d attempts: %v", delivery.MessageID, delivery.TargetChannelID, attempts, cause)
+		return tx.Delete(&delivery).Error
+	}
+
+	backoff := int(CrosspostDeliveryInterval.Seconds()) << attempts
+	return tx.Model(&delivery).Updates(map[string]interface{}{
+		"attempts":        attempts,
+		"next_attempt_at": gorm.Expr("NOW() + make_interval(secs => ?)", backoff),
+		"last_error":      cause.Error(),
+	}).Error
+}
+
+// crosspost posts a copy of a published message and its attachments into a
+// following channel, attributed to its source. The copies share the storage
+// keys of the original attachments. It returns nil without posting if the
+// message was deleted, the follow removed, the copy already posted or the
+// source is NSFW while the following channel is not.
+func crosspost(tx *gorm.DB, delivery CrosspostDelivery) (*Message, error) {
+	var source Message
+	if err := tx.Preload("Attachments").Where("id = ?", delivery.MessageID).First(&source).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var follows int64
+	if err := tx.Model(&ChannelFollow{}).
+		Where("source_channel_id = ? AND target_channel_id = ?", source.ChannelID, delivery.TargetChannelID).
+		Count(&follows).Error; err != nil {
+		return nil, err
+	}
+	if follows == 0 {
+		return nil, nil
+	}
+
+	var channel Channel
+	if err := tx.Where("id = ?", source.ChannelID).First(&channel).Error; err != nil {
+		return nil, err
+	}
+	var target Channel
+	if err := tx.Where("id = ?", delivery.TargetChannelID).First(&target).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	// Either channel may have changed its NSFW flag since the follow.
+	if channel.NSFW && !target.NSFW {
+		log.Printf("Skipping crosspost of NSFW message %s to channel %s", source.ID, target.ID)
+		return nil, nil
+	}
+
+	var realm Realm
+	if err := tx.Where("id = ?", channel.RealmID).First(&realm).Error; err != nil {
+		return nil, err
+	}
+
+	message := Message{
+		ChannelID:       delivery.TargetChannelID,
+		UserID:          source.UserID,
+		Content:         source.Content,
+		Type:            MessageTypeCrosspost,
+		SourceMessageID: &source.ID,
+		Crosspost: &Crosspost{
+			RealmID:     realm.ID,
+			RealmName:   realm.Name,
+			RealmIcon:   realm.IconURL,
+			ChannelID:   channel.ID,
+			ChannelName: channel.Name,
+			MessageID:   source.ID,
+		},
+	}
+	result := tx.Clauses(clause.OnConflict{
+		Columns:     []clause.Column{{Name: "channel_id"}, {Name: "source_message_id"}},
+		TargetWhere: clause.Where{Exprs: []clause.Expression{clause.Expr{SQL: "source_message_id IS NOT NULL"}}},
+		DoNothing:   true,
+	}).Create(&message)
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, nil
+	}
+
+	if len(source.Attachments) > 0 {
+		copies := make([]Attachment, len(source.Attachments))
+		for i, a := range source.Attachments {
+			copies[i] = Attachment{
+				MessageID:    message.ID,
+				Filename:     a.Filename,
+				Key:          a.Key,
+				Size:         a.Size,
+				MimeType:     a.MimeType,
+				Width:        a.Width,
+				Height:       a.Height,
+				BlurHash:     a.BlurHash,
+				ThumbnailKey: a.ThumbnailKey,
+			}
+		}
+		if err := tx.Create(&copies).Error; err != nil {
+			return nil, err
+		}
+	}
+	return &message, nil
+}
@@ -23,9 +23,14 @@ type User struct {
 	Avatar       string    `json:"avatar"`
 	Banner       string    `json:"banner"`
 	AboutMe      string    `json:"about_me"`
-	Status       string    `json:"status" gorm:"default:online"`
+	Status       string    `json:"status" gorm:"default:offline"`
+	PreferredStatus string `json:"preferred_status" gorm:"default:online"`
 	CustomStatus string    `json:"custom_status"`
 	Activity     string    `json:"activity"`
+	LastSeen     *time.Time `json:"last_seen"`
+	// AgeAcknowledgedAt is when the user confirmed they may view NSFW
+	// channels.
+	AgeAcknowledgedAt *time.Time `json:"-"`
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 }
@@ -47,11 +52,6 @@ type UpdateProfileRequest struct {
 	CustomStatus string `json:"custom_status"`
 }
 
-type UpdateStatusRequest struct {
-	Status   string `json:"status"`
-	Activity string `json:"activity"`
-}
-
 func NewAuthHandler(db *gorm.DB) *AuthHandler {
 	return &AuthHandler{db: db}
 }
@@ -131,34 +131,18 @@ func (h *AuthHandler) UpdateProfile(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"message": "Profile updated successfully"})
 }
 
-func (h *AuthHandler) UpdateStatus(c *fiber.Ctx) error {
+// AcknowledgeAge records that the user confirmed they are old enough to
+// view NSFW channels.
+func (h *AuthHandler) AcknowledgeAge(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(uuid.UUID)
 
-	var req UpdateStatusRequest
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
-	}
-
-	validStatuses := map[string]bool{
-		"online": true, "idle": true, "dnd": true, "invisible": true,
-	}
-
-	if !validStatuses[req.Status] {
-		return c.Status(400).JSON(fiber.Map{"error": "Invalid status"})
-	}
-
-	updates := map[string]interface{}{
-		"status": req.Status,
-	}
-	if req.Activity != "" {
-		updates["activity"] = req.Activity
-	}
-
-	if err := h.db.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to update status"})
+	now := time.Now()
+	if err := h.db.Model(&User{}).Where("id = ? AND age_acknowledged_at IS NULL", userID).
+		Update("age_acknowledged_at", now).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update profile"})
 	}
 
-	return c.JSON(fiber.Map{"message": "Status updated successfully"})
+	return c.JSON(fiber.Map{"message": "Age acknowledged"})
 }
 
 func (h *AuthHandler) Login(c *fiber.Ctx) error {
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxCategoryNameLength bounds category names.
+const MaxCategoryNameLength = 50
+
+type CategoriesHandler struct {
+	db    *gorm.DB
+	hub   *websocket.Hub
+	perms *PermissionResolver
+}
+
+// ChannelCategory groups the channels of a realm. Channels whose
+// permissions are synced follow the overwrites of their category.
+type ChannelCategory struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	RealmID   uuid.UUID `json:"realm_id" gorm:"type:uuid;not null"`
+	Name      string    `json:"name" gorm:"not null"`
+	Position  int       `json:"position" gorm:"default:0"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// CategoryOverwrite is a permission overwrite set on a category, copied to
+// its synced channels.
+type CategoryOverwrite struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	CategoryID uuid.UUID `json:"category_id" gorm:"type:uuid;not null"`
+	TargetID   uuid.UUID `json:"target_id" gorm:"type:uuid;not null"`
+	TargetType string    `json:"target_type" gorm:"not null"`
+	Allow      int64     `json:"allow" gorm:"default:0"`
+	Deny       int64     `json:"deny" gorm:"default:0"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type CategoryRequest struct {
+	Name string `json:"name"`
+}
+
+func NewCategoriesHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver) *CategoriesHandler {
+	return &CategoriesHandler{db: db, hub: hub, perms: perms}
+}
+
+// CreateCategory adds a category after the existing ones.
+func (h *CategoriesHandler) CreateCategory(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+
+	var req CategoryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	name, err := categoryName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	category := ChannelCategory{RealmID: realmID, Name: name}
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&ChannelCategory{}).Where("realm_id = ?", realmID).
+			Select("COALESCE(MAX(position) + 1, 0)").Scan(&category.Position).Error; err != nil {
+			return err
+		}
+		return tx.Create(&category).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create category"})
+	}
+
+	h.broadcast(realmID, websocket.EventCategoryCreate, category)
+
+	return c.JSON(category)
+}
+
+func (h *CategoriesHandler) GetCategories(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+
+	var categories []ChannelCategory
+	if err := h.db.Where("realm_id = ?", realmID).Order("position ASC, created_at ASC").Find(&categories).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch categories"})
+	}
+
+	return c.JSON(categories)
+}
+
+func (h *CategoriesHandler) UpdateCategory(c *fiber.Ctx) error {
+	category := c.Locals("category").(*ChannelCategory)
+
+	var req CategoryRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	name, err := categoryName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	if err := h.db.Model(category).Update("name", name).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update category"})
+	}
+
+	h.broadcast(category.RealmID, websocket.EventCategoryUpdate, category)
+
+	return c.JSON(category)
+}
+
+// DeleteCategory deletes a category; its channels move to the top level
+// and keep their current overwrites.
+func (h *CategoriesHandler) DeleteCategory(c *fiber.Ctx) error {
+	category := c.Locals("category").(*ChannelCategory)
+
+	var channels []Channel
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&channels).Clauses(clause.Returning{}).
+			Where("category_id = ?", category.ID).
+			Updates(map[string]interface{}{"category_id": nil, "permissions_synced": false}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("category_id = ?", category.ID).Delete(&CategoryOverwrite{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(category).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete category"})
+	}
+
+	h.broadcast(category.RealmID, websocket.EventCategoryDelete, fiber.Map{"id": category.ID})
+	for i := range channels {
+		announceChannel(h.hub, h.perms, &channels[i])
+	}
+
+	return c.JSON(fiber.Map{"message": "Category deleted successfully"})
+}
+
+func (h *CategoriesHandler) GetPermissionOverwrites(c *fiber.Ctx) error {
+	category := c.Locals("category").(*ChannelCategory)
+
+	var overwrites []CategoryOverwrite
+	if err := h.db.Where("category_id = ?", category.ID).Order("created_at ASC").Find(&overwrites).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch permission overwrites"})
+	}
+
+	return c.JSON(overwrites)
+}
+
+// SetPermissionOverwrite sets an overwrite on a category and copies the
+// category's overwrites to its synced channels.
+func (h *CategoriesHandler) SetPermissionOverwrite(c *fiber.Ctx) error {
+	category := c.Locals("category").(*ChannelCategory)
+
+	targetID, err := uuid.Parse(c.Params("targetId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid target ID"})
+	}
+
+	var req OverwriteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if err := checkOverwrite(h.db, currentMember(c), category.RealmID, targetID, req); err != nil {
+		return err
+	}
+
+	overwrite := CategoryOverwrite{
+		CategoryID: category.ID,
+		TargetID:   targetID,
+		TargetType: req.Type,
+	}
+	var synced []Channel
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("category_id = ? AND target_id = ?", category.ID, targetID).
+			Assign(map[string]interface{}{"target_type": req.Type, "allow": req.Allow, "deny": req.Deny}).
+			FirstOrCreate(&overwrite).Error; err != nil {
+			return err
+		}
+		synced, err = syncCategory(tx, category.ID)
+		return err
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save permission overwrite"})
+	}
+
+	for i := range synced {
+		h.hub.RevalidateChannel(synced[i].ID)
+		announceChannel(h.hub, h.perms, &synced[i])
+	}
+
+	return c.JSON(overwrite)
+}
+
+func (h *CategoriesHandler) DeletePermissionOverwrite(c *fiber.Ctx) error {
+	category := c.Locals("category").(*ChannelCategory)
+	targetID := c.Params("targetId")
+
+	var synced []Channel
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("category_id = ? AND target_id = ?", category.ID, targetID).Delete(&CategoryOverwrite{}).Error; err != nil {
+			return err
+		}
+		var err error
+		synced, err = syncCategory(tx, category.ID)
+		return err
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete permission overwrite"})
+	}
+
+	for i := range synced {
+		h.hub.RevalidateChannel(synced[i].ID)
+		announceChannel(h.hub, h.perms, &synced[i])
+	}
+
+	return c.JSON(fiber.Map{"message": "Permission overwrite deleted successfully"})
+}
+
+func (h *CategoriesHandler) broadcast(realmID uuid.UUID, eventType string, data interface{}) {
+	h.hub.BroadcastToRealm(realmID, websocket.WSMessage{
+		Type:    eventType,
+		Data:    data,
+		RealmID: &realmID,
+	})
+}
+
+// syncCategory copies the overwrites of a category to every channel in it
+// that is synced, returning those channels.
+func syncCategory(tx *gorm.DB, categoryID uuid.UUID) ([]Channel, error) {
+	var channels []Channel
+	if err := tx.Where("category_id = ? AND permissions_synced", categoryID).Find(&channels).Error; err != nil {
+		return nil, err
+	}
+	for i := range channels {
+		if err := syncChannel(tx, &channels[i], categoryID); err != nil {
+			return nil, err
+		}
+	}
+	return channels, nil
+}
+
+// syncChannel replaces the overwrites of a channel with those of a category
+// and marks the channel as synced.
+func syncChannel(tx *gorm.DB, channel *Channel, categoryID uuid.UUID) error {
+	if err := tx.Where("channel_id = ?", channel.ID).Delete(&ChannelOverwrite{}).Error; err != nil {
+		return err
+	}
+
+	var overwrites []CategoryOverwrite
+	if err := tx.Where("category_id = ?", categoryID).Find(&overwrites).Error; err != nil {
+		return err
+	}
+	if len(overwrites) > 0 {
+		copies := make([]ChannelOverwrite, len(overwrites))
+		for i, ow := range overwrites {
+			copies[i] = ChannelOverwrite{
+				ChannelID:  channel.ID,
+				TargetID:   ow.TargetID,
+				TargetType: ow.TargetType,
+				Allow:      ow.Allow,
+				Deny:       ow.Deny,
+			}
+		}
+		if err := tx.Create(&copies).Error; err != nil {
+			return err
+		}
+	}
+
+	return tx.Model(channel).Update("permissions_synced", true).Error
+}
+
+// categoryName validates a category name. Errors are returned as
+// *fiber.Error.
+func categoryName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fiber.NewError(fiber.StatusBadRequest, "Category name required")
+	}
+	if utf8.RuneCountInString(name) > MaxCategoryNameLength {
+		return "", fiber.NewError(fiber.StatusBadRequest, "Category name too long")
+	}
+	return name, nil
+}
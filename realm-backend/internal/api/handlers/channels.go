@@ -1,14 +1,39 @@
 package handlers
 
 import (
+	"encoding/json"
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"log"
 	"time"
 )
 
+const (
+	// MaxPositionUpdates caps the entries of a single reorder request.
+	MaxPositionUpdates = 500
+
+	// MaxSlowMode is the longest slow mode cooldown, in seconds.
+	MaxSlowMode = 6 * 60 * 60
+	// MaxUserLimit caps the user limit of voice channels; 0 means unlimited.
+	MaxUserLimit = 99
+	MinBitrate   = 8000
+	MaxBitrate   = 96000
+)
+
+const (
+	ChannelTypeText  = "text"
+	ChannelTypeVoice = "voice"
+	// ChannelTypeAnnouncement channels are text channels whose messages can
+	// be published to the channels following them in other realms.
+	ChannelTypeAnnouncement = "announcement"
+)
+
 type ChannelsHandler struct {
-	db *gorm.DB
+	db    *gorm.DB
+	hub   *websocket.Hub
+	perms *PermissionResolver
 }
 
 type Channel struct {
@@ -19,8 +44,35 @@ type Channel struct {
 	Topic       string    `json:"topic"`
 	Position    int       `json:"position" gorm:"default:0"`
 	CategoryID  *uuid.UUID `json:"category_id" gorm:"type:uuid"`
+	// PermissionsSynced channels follow the overwrites of their category.
+	PermissionsSynced bool `json:"permissions_synced" gorm:"default:false"`
+	// NSFW channels are only open to users who acknowledged their age.
+	NSFW bool `json:"nsfw" gorm:"column:nsfw;default:false"`
+	// SlowMode is how many seconds members must wait between messages.
+	SlowMode  int `json:"slow_mode" gorm:"default:0"`
+	UserLimit int `json:"user_limit" gorm:"default:0"`
+	Bitrate   int `json:"bitrate" gorm:"default:64000"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	ReadState   *ReadStateSummary `json:"read_state,omitempty" gorm:"-"`
+}
+
+const (
+	OverwriteTypeRole   = "role"
+	OverwriteTypeMember = "member"
+)
+
+// ChannelOverwrite allows or denies permissions in a single channel for a role
+// or member. A role overwrite whose target is the realm ID applies to everyone.
+type ChannelOverwrite struct {
+	ID         uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ChannelID  uuid.UUID `json:"channel_id" gorm:"type:uuid;not null"`
+	TargetID   uuid.UUID `json:"target_id" gorm:"type:uuid;not null"`
+	TargetType string    `json:"target_type" gorm:"not null"`
+	Allow      int64     `json:"allow" gorm:"default:0"`
+	Deny       int64     `json:"deny" gorm:"default:0"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
 }
 
 type CreateChannelRequest struct {
@@ -30,8 +82,60 @@ type CreateChannelRequest struct {
 	CategoryID *uuid.UUID `json:"category_id"`
 }
 
-func NewChannelsHandler(db *gorm.DB) *ChannelsHandler {
-	return &ChannelsHandler{db: db}
+// UpdateChannelRequest changes the fields present in it. Moving a channel
+// into a category with LockPermissions syncs it with the category.
+type UpdateChannelRequest struct {
+	Name            string     `json:"name"`
+	Topic           string     `json:"topic"`
+	Position        *int       `json:"position"`
+	CategoryID      OptionalID `json:"category_id"`
+	LockPermissions bool       `json:"lock_permissions"`
+	NSFW            *bool      `json:"nsfw"`
+	SlowMode        *int       `json:"slow_mode"`
+	UserLimit       *int       `json:"user_limit"`
+	Bitrate         *int       `json:"bitrate"`
+}
+
+// ChannelPositionsRequest reorders the categories and channels of a realm.
+// Only the entries present are changed.
+type ChannelPositionsRequest struct {
+	Categories []CategoryPosition `json:"categories"`
+	Channels   []ChannelPosition  `json:"channels"`
+}
+
+type CategoryPosition struct {
+	ID       uuid.UUID `json:"id"`
+	Position int       `json:"position"`
+}
+
+// ChannelPosition places a channel. A null CategoryID moves it to the top
+// level; leaving it out keeps the current category.
+type ChannelPosition struct {
+	ID              uuid.UUID  `json:"id"`
+	Position        int        `json:"position"`
+	CategoryID      OptionalID `json:"category_id"`
+	LockPermissions bool       `json:"lock_permissions"`
+}
+
+// OptionalID tells an ID set to null apart from one left out of a request.
+type OptionalID struct {
+	Set bool
+	ID  *uuid.UUID
+}
+
+func (o *OptionalID) UnmarshalJSON(data []byte) error {
+	o.Set = true
+	return json.Unmarshal(data, &o.ID)
+}
+
+type OverwriteRequest struct {
+	Type  string `json:"type"`
+	Allow int64  `json:"allow"`
+	Deny  int64  `json:"deny"`
+}
+
+func NewChannelsHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver) *ChannelsHandler {
+	return &ChannelsHandler{db: db, hub: hub, perms: perms}
 }
 
 func (h *ChannelsHandler) CreateChannel(c *fiber.Ctx) error {
@@ -47,8 +151,12 @@ func (h *ChannelsHandler) CreateChannel(c *fiber.Ctx) error {
 	}
 
 	channelType := req.Type
-	if channelType == "" {
-		channelType = "text"
+	switch channelType {
+	case "":
+		channelType = ChannelTypeText
+	case ChannelTypeText, ChannelTypeVoice, ChannelTypeAnnouncement:
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid channel type"})
 	}
 
 	channel := Channel{
@@ -58,8 +166,23 @@ func (h *ChannelsHandler) CreateChannel(c *fiber.Ctx) error {
 		Topic:      req.Topic,
 		CategoryID: req.CategoryID,
 	}
+	if req.CategoryID != nil {
+		if _, err := realmCategory(h.db, channel.RealmID, *req.CategoryID); err != nil {
+			return err
+		}
+	}
 
-	if err := h.db.Create(&channel).Error; err != nil {
+	// Channels created in a category start out synced with it.
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&channel).Error; err != nil {
+			return err
+		}
+		if channel.CategoryID != nil {
+			return syncChannel(tx, &channel, *channel.CategoryID)
+		}
+		return nil
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create channel"})
 	}
 
@@ -67,12 +190,23 @@ func (h *ChannelsHandler) CreateChannel(c *fiber.Ctx) error {
 }
 
 func (h *ChannelsHandler) GetRealmChannels(c *fiber.Ctx) error {
-	realmID := c.Params("realmId")
+	member := currentMember(c)
+	channels, err := h.perms.VisibleChannels(member)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch channels"})
+	}
 
-	var channels []Channel
-	if err := h.db.Where("realm_id = ?", realmID).Order("position ASC, created_at ASC").Find(&channels).Error; err != nil {
+	channelIDs := make([]uuid.UUID, len(channels))
+	for i, channel := range channels {
+		channelIDs[i] = channel.ID
+	}
+	readStates, err := channelReadStates(h.db, member.UserID, member.RealmID, channelIDs)
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch channels"})
 	}
+	for i := range channels {
+		channels[i].ReadState = readStates[channels[i].ID]
+	}
 
 	return c.JSON(channels)
 }
@@ -89,9 +223,9 @@ func (h *ChannelsHandler) GetChannel(c *fiber.Ctx) error {
 }
 
 func (h *ChannelsHandler) UpdateChannel(c *fiber.Ctx) error {
-	channelID := c.Params("id")
+	channel := c.Locals("channel").(*Channel)
 
-	var req CreateChannelRequest
+	var req UpdateChannelRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
@@ -103,14 +237,148 @@ func (h *ChannelsHandler) UpdateChannel(c *fiber.Ctx) error {
 	if req.Topic != "" {
 		updates["topic"] = req.Topic
 	}
+	if req.NSFW != nil {
+		updates["nsfw"] = *req.NSFW
+	}
+	if req.SlowMode != nil {
+		if *req.SlowMode < 0 || *req.SlowMode > MaxSlowMode {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid slow mode"})
+		}
+		updates["slow_mode"] = *req.SlowMode
+	}
+	if req.UserLimit != nil {
+		if *req.UserLimit < 0 || *req.UserLimit > MaxUserLimit {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid user limit"})
+		}
+		updates["user_limit"] = *req.UserLimit
+	}
+	if req.Bitrate != nil {
+		if *req.Bitrate < MinBitrate || *req.Bitrate > MaxBitrate {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid bitrate"})
+		}
+		updates["bitrate"] = *req.Bitrate
+	}
 
-	if err := h.db.Model(&Channel{}).Where("id = ?", channelID).Updates(updates).Error; err != nil {
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if len(updates) > 0 {
+			if err := tx.Model(channel).Updates(updates).Error; err != nil {
+				return err
+			}
+		}
+		return placeChannel(tx, channel, ChannelPosition{
+			ID:              channel.ID,
+			Position:        derefOr(req.Position, channel.Position),
+			CategoryID:      req.CategoryID,
+			LockPermissions: req.LockPermissions,
+		})
+	})
+	if err != nil {
+		if fe, ok := err.(*fiber.Error); ok {
+			return fe
+		}
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to update channel"})
 	}
 
+	// Syncing with a category or turning on NSFW may lock subscribers out.
+	h.hub.RevalidateChannel(channel.ID)
+	announceChannel(h.hub, h.perms, channel)
+
 	return c.JSON(fiber.Map{"message": "Channel updated successfully"})
 }
 
+// UpdatePositions reorders categories and channels and moves channels
+// between categories in one transaction.
+func (h *ChannelsHandler) UpdatePositions(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+
+	var req ChannelPositionsRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if len(req.Categories)+len(req.Channels) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Positions required"})
+	}
+	if len(req.Categories)+len(req.Channels) > MaxPositionUpdates {
+		return c.Status(400).JSON(fiber.Map{"error": "Too many positions"})
+	}
+
+	seen := make(map[uuid.UUID]bool)
+	categoryIDs := make([]uuid.UUID, 0, len(req.Categories))
+	for _, entry := range req.Categories {
+		if seen[entry.ID] {
+			return c.Status(400).JSON(fiber.Map{"error": "Duplicate ID in positions"})
+		}
+		seen[entry.ID] = true
+		categoryIDs = append(categoryIDs, entry.ID)
+	}
+	channelIDs := make([]uuid.UUID, 0, len(req.Channels))
+	for _, entry := range req.Channels {
+		if seen[entry.ID] {
+			return c.Status(400).JSON(fiber.Map{"error": "Duplicate ID in positions"})
+		}
+		seen[entry.ID] = true
+		channelIDs = append(channelIDs, entry.ID)
+	}
+
+	var channels []Channel
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		if err := tx.Model(&ChannelCategory{}).Where("realm_id = ? AND id IN ?", realmID, categoryIDs).Count(&count).Error; err != nil {
+			return err
+		}
+		if int(count) != len(categoryIDs) {
+			return fiber.NewError(404, "Category not found")
+		}
+		for _, entry := range req.Categories {
+			if err := tx.Model(&ChannelCategory{}).Where("id = ?", entry.ID).Update("position", entry.Position).Error; err != nil {
+				return err
+			}
+		}
+
+		if err := tx.Where("realm_id = ? AND id IN ?", realmID, channelIDs).Find(&channels).Error; err != nil {
+			return err
+		}
+		if len(channels) != len(channelIDs) {
+			return fiber.NewError(404, "Channel not found")
+		}
+		byID := make(map[uuid.UUID]*Channel, len(channels))
+		for i := range channels {
+			byID[channels[i].ID] = &channels[i]
+		}
+		for _, entry := range req.Channels {
+			if err := placeChannel(tx, byID[entry.ID], entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		if fe, ok := err.(*fiber.Error); ok {
+			return fe
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update positions"})
+	}
+
+	if len(req.Categories) > 0 {
+		var categories []ChannelCategory
+		if err := h.db.Where("id IN ?", categoryIDs).Find(&categories).Error; err == nil {
+			for _, category := range categories {
+				h.hub.BroadcastToRealm(realmID, websocket.WSMessage{
+					Type:    websocket.EventCategoryUpdate,
+					Data:    category,
+					RealmID: &realmID,
+				})
+			}
+		}
+	}
+	for i := range channels {
+		h.hub.RevalidateChannel(channels[i].ID)
+		announceChannel(h.hub, h.perms, &channels[i])
+	}
+
+	return c.JSON(fiber.Map{"message": "Positions updated successfully"})
+}
+
 func (h *ChannelsHandler) DeleteChannel(c *fiber.Ctx) error {
 	channelID := c.Params("id")
 
@@ -119,4 +387,230 @@ func (h *ChannelsHandler) DeleteChannel(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(fiber.Map{"message": "Channel deleted successfully"})
+}
+
+func (h *ChannelsHandler) GetPermissionOverwrites(c *fiber.Ctx) error {
+	channelID := c.Params("id")
+
+	var overwrites []ChannelOverwrite
+	if err := h.db.Where("channel_id = ?", channelID).Order("created_at ASC").Find(&overwrites).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch permission overwrites"})
+	}
+
+	return c.JSON(overwrites)
+}
+
+func (h *ChannelsHandler) SetPermissionOverwrite(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+	member := currentMember(c)
+
+	targetID, err := uuid.Parse(c.Params("targetId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid target ID"})
+	}
+
+	var req OverwriteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	if err := checkOverwrite(h.db, member, channel.RealmID, targetID, req); err != nil {
+		return err
+	}
+
+	overwrite := ChannelOverwrite{
+		ChannelID:  channel.ID,
+		TargetID:   targetID,
+		TargetType: req.Type,
+	}
+	// Editing a channel's own overwrites detaches it from its category.
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("channel_id = ? AND target_id = ?", channel.ID, targetID).
+			Assign(map[string]interface{}{"target_type": req.Type, "allow": req.Allow, "deny": req.Deny}).
+			FirstOrCreate(&overwrite).Error; err != nil {
+			return err
+		}
+		return tx.Model(channel).Update("permissions_synced", false).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to save permission overwrite"})
+	}
+
+	h.hub.RevalidateChannel(channel.ID)
+
+	return c.JSON(overwrite)
+}
+
+func (h *ChannelsHandler) DeletePermissionOverwrite(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+	targetID := c.Params("targetId")
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("channel_id = ? AND target_id = ?", channel.ID, targetID).Delete(&ChannelOverwrite{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(channel).Update("permissions_synced", false).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete permission overwrite"})
+	}
+
+	h.hub.RevalidateChannel(channel.ID)
+
+	return c.JSON(fiber.Map{"message": "Permission overwrite deleted successfully"})
+}
+
+// SyncPermissions replaces the overwrites of a channel with those of its
+// category.
+func (h *ChannelsHandler) SyncPermissions(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+	if channel.CategoryID == nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Channel is not in a category"})
+	}
+
+	if err := h.db.Transaction(func(tx *gorm.DB) error {
+		return syncChannel(tx, channel, *channel.CategoryID)
+	}); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to sync permissions"})
+	}
+
+	h.hub.RevalidateChannel(channel.ID)
+	announceChannel(h.hub, h.perms, channel)
+
+	return c.JSON(channel)
+}
+
+// placeChannel moves a channel to a position and, if entry sets one, a
+// category. Errors for unknown categories are returned as *fiber.Error.
+func placeChannel(tx *gorm.DB, channel *Channel, entry ChannelPosition) error {
+	updates := map[string]interface{}{"position": entry.Position}
+
+	categoryID := channel.CategoryID
+	if entry.CategoryID.Set {
+		categoryID = entry.CategoryID.ID
+		if categoryID != nil {
+			if _, err := realmCategory(tx, channel.RealmID, *categoryID); err != nil {
+				return err
+			}
+		}
+		if !sameID(categoryID, channel.CategoryID) {
+			updates["category_id"] = categoryID
+			updates["permissions_synced"] = false
+		}
+	}
+
+	if err := tx.Model(channel).Updates(updates).Error; err != nil {
+		return err
+	}
+	if entry.LockPermissions && categoryID != nil {
+		return syncChannel(tx, channel, *categoryID)
+	}
+	return nil
+}
+
+// realmCategory loads a category of a realm.
+func realmCategory(db *gorm.DB, realmID, categoryID uuid.UUID) (*ChannelCategory, error) {
+	var category ChannelCategory
+	if err := db.Where("id = ? AND realm_id = ?", categoryID, realmID).First(&category).Error; err != nil {
+		return nil, fiber.NewError(404, "Category not found")
+	}
+	return &category, nil
+}
+
+// checkOverwrite validates an overwrite for a target in a realm. Errors are
+// returned as *fiber.Error.
+func checkOverwrite(db *gorm.DB, member *MemberPermissions, realmID, targetID uuid.UUID, req OverwriteRequest) error {
+	if req.Allow&req.Deny != 0 {
+		return fiber.NewError(400, "A permission cannot be both allowed and denied")
+	}
+	if err := checkGrant(member, req.Allow|req.Deny); err != nil {
+		return err
+	}
+
+	switch req.Type {
+	case OverwriteTypeRole:
+		if targetID != realmID {
+			var role Role
+			if err := db.Where("id = ? AND realm_id = ?", targetID, realmID).First(&role).Error; err != nil {
+				return fiber.NewError(404, "Role not found")
+			}
+		}
+	case OverwriteTypeMember:
+		var target RealmMember
+		if err := db.Where("realm_id = ? AND user_id = ?", realmID, targetID).First(&target).Error; err != nil {
+			return fiber.NewError(404, "Member not found")
+		}
+	default:
+		return fiber.NewError(400, "Overwrite type must be role or member")
+	}
+	return nil
+}
+
+// announceChannel sends a channel_update to the members able to view the
+// channel.
+func announceChannel(hub *websocket.Hub, perms *PermissionResolver, channel *Channel) {
+	audience, err := perms.ChannelAudience(channel, nil)
+	if err != nil {
+		log.Printf("Failed to resolve audience of channel %s: %v", channel.ID, err)
+		return
+	}
+	for _, userID := range audience {
+		hub.BroadcastToUser(userID, websocket.WSMessage{
+			Type:      websocket.EventChannelUpdate,
+			Data:      channel,
+			ChannelID: &channel.ID,
+		})
+	}
+}
+
+// checkNSFW returns a 403 *fiber.Error if channel is NSFW and the user has
+// not acknowledged their age.
+func checkNSFW(db *gorm.DB, channel *Channel, userID uuid.UUID) error {
+	if !channel.NSFW {
+		return nil
+	}
+	acknowledged, err := ageAcknowledged(db, userID)
+	if err != nil {
+		return fiber.NewError(500, "Failed to resolve permissions")
+	}
+	if !acknowledged {
+		return fiber.NewError(403, "Age acknowledgement required for NSFW channels")
+	}
+	return nil
+}
+
+func ageAcknowledged(db *gorm.DB, userID uuid.UUID) (bool, error) {
+	var user User
+	if err := db.Select("age_acknowledged_at").Where("id = ?", userID).First(&user).Error; err != nil {
+		return false, err
+	}
+	return user.AgeAcknowledgedAt != nil, nil
+}
+
+// slowModeWait returns how many seconds a user must wait before sending
+// another message to a channel in slow mode. Deleted messages still count.
+func slowModeWait(db *gorm.DB, channel *Channel, userID uuid.UUID) (int, error) {
+	if channel.SlowMode <= 0 {
+		return 0, nil
+	}
+	var wait int
+	err := db.Unscoped().Model(&Message{}).
+		Where("channel_id = ? AND user_id = ?", channel.ID, userID).
+		Select("COALESCE(CEIL(EXTRACT(EPOCH FROM MAX(created_at) + make_interval(secs => ?) - NOW())), 0)::int", channel.SlowMode).
+		Scan(&wait).Error
+	return max(wait, 0), err
+}
+
+func sameID(a, b *uuid.UUID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func derefOr(value *int, fallback int) int {
+	if value == nil {
+		return fallback
+	}
+	return *value
 }
\ No newline at end of file
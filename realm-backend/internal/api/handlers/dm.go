@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -8,7 +10,9 @@ import (
 )
 
 type DMHandler struct {
-	db *gorm.DB
+	db      *gorm.DB
+	uploads *Uploader
+	images  *ImageProcessor
 }
 
 type DirectMessage struct {
@@ -20,8 +24,30 @@ type DirectMessage struct {
 	EditedAt    *time.Time `json:"edited_at"`
 	CreatedAt   time.Time `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	DeletedAt   gorm.DeletedAt `json:"-" gorm:"index"`
 	Sender      User      `json:"sender" gorm:"foreignKey:SenderID"`
 	Recipient   User      `json:"recipient" gorm:"foreignKey:RecipientID"`
+	Attachments []DMAttachment `json:"attachments" gorm:"foreignKey:MessageID"`
+}
+
+func (m DirectMessage) cursor() Cursor {
+	return Cursor{CreatedAt: m.CreatedAt, ID: m.ID}
+}
+
+type DMAttachment struct {
+	ID           uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	MessageID    uuid.UUID `json:"message_id" gorm:"type:uuid;not null"`
+	Filename     string    `json:"filename" gorm:"not null"`
+	Key          string    `json:"-" gorm:"column:storage_key;not null"`
+	URL          string    `json:"url" gorm:"-"`
+	Size         int64     `json:"size"`
+	MimeType     string    `json:"mime_type"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	BlurHash     string    `json:"blurhash,omitempty" gorm:"column:blurhash"`
+	ThumbnailKey string    `json:"-"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty" gorm:"-"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
 type DMConversation struct {
@@ -33,14 +59,15 @@ type DMConversation struct {
 	CreatedAt    time.Time `json:"created_at"`
 	User1        User      `json:"user1" gorm:"foreignKey:User1ID"`
 	User2        User      `json:"user2" gorm:"foreignKey:User2ID"`
+	ReadState    *ReadStateSummary `json:"read_state,omitempty" gorm:"-"`
 }
 
 type SendDMRequest struct {
-	Content string `json:"content"`
+	Content string `json:"content" form:"content"`
 }
 
-func NewDMHandler(db *gorm.DB) *DMHandler {
-	return &DMHandler{db: db}
+func NewDMHandler(db *gorm.DB, uploads *Uploader, images *ImageProcessor) *DMHandler {
+	return &DMHandler{db: db, uploads: uploads, images: images}
 }
 
 func (h *DMHandler) SendDirectMessage(c *fiber.Ctx) error {
@@ -52,25 +79,50 @@ func (h *DMHandler) SendDirectMessage(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	if req.Content == "" {
+	files, err := attachmentFiles(c)
+	if err != nil {
+		return err
+	}
+
+	if req.Content == "" && len(files) == 0 {
 		return c.Status(400).JSON(fiber.Map{"error": "Message content required"})
 	}
 
+	stored, err := h.uploads.SaveAll(c.Context(), "dm-attachments/"+senderID.String(), files, AttachmentPolicy)
+	if err != nil {
+		return err
+	}
+
 	dm := DirectMessage{
 		SenderID:    senderID,
 		RecipientID: uuid.MustParse(receiverID),
 		Content:     req.Content,
 	}
+	for _, file := range stored {
+		dm.Attachments = append(dm.Attachments, DMAttachment{
+			Filename: file.Filename,
+			Key:      file.Key,
+			Size:     file.Size,
+			MimeType: file.MimeType,
+		})
+	}
 
 	if err := h.db.Create(&dm).Error; err != nil {
+		h.uploads.DeleteAll(c.Context(), stored)
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to send message"})
 	}
 
 	// Update or create conversation
-	h.updateConversation(senderID, uuid.MustParse(receiverID), req.Content)
+	lastMessage := req.Content
+	if lastMessage == "" {
+		lastMessage = stored[0].Filename
+	}
+	h.updateConversation(senderID, uuid.MustParse(receiverID), lastMessage)
 
 	// Load sender data
-	h.db.Preload("Sender").Preload("Recipient").First(&dm, dm.ID)
+	h.db.Preload("Sender").Preload("Recipient").Preload("Attachments").First(&dm, dm.ID)
+	signDMAttachments(c.Context(), h.uploads, dm.Attachments)
+	h.images.ProcessDirectMessage(c.Context(), &dm)
 
 	return c.JSON(dm)
 }
@@ -78,24 +130,29 @@ func (h *DMHandler) SendDirectMessage(c *fiber.Ctx) error {
 func (h *DMHandler) GetConversation(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(uuid.UUID)
 	otherUserID := c.Params("userId")
-	limit := c.QueryInt("limit", 50)
 
-	var messages []DirectMessage
-	if err := h.db.Where("(sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?)",
-		userID, otherUserID, otherUserID, userID).
-		Preload("Sender").
-		Preload("Recipient").
-		Order("created_at DESC").
-		Limit(limit).
-		Find(&messages).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch messages"})
+	page, err := parsePage(c)
+	if err != nil {
+		return err
 	}
 
-	// Reverse to show oldest first
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	messages, info, err := fetchPage[DirectMessage](h.db, func(db *gorm.DB) *gorm.DB {
+		return db.Where("((sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?))",
+			userID, otherUserID, otherUserID, userID).
+			Preload("Sender").
+			Preload("Recipient").
+			Preload("Attachments")
+	}, page)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch messages"})
 	}
 
+	signDirectMessages(c.Context(), h.uploads, messages)
+
+	setPageHeaders(c, info)
 	return c.JSON(messages)
 }
 
@@ -111,6 +168,18 @@ func (h *DMHandler) GetConversations(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch conversations"})
 	}
 
+	conversationIDs := make([]uuid.UUID, len(conversations))
+	for i, conversation := range conversations {
+		conversationIDs[i] = conversation.ID
+	}
+	readStates, err := conversationReadStates(h.db, userID, conversationIDs)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch conversations"})
+	}
+	for i := range conversations {
+		conversations[i].ReadState = readStates[conversations[i].ID]
+	}
+
 	return c.JSON(conversations)
 }
 
@@ -128,12 +197,18 @@ func (h *DMHandler) EditDirectMessage(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
 	}
 
-	updates := map[string]interface{}{
-		"content": req.Content,
-		"edited":  true,
-	}
-
-	if err := h.db.Model(&dm).Updates(updates).Error; err != nil {
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if req.Content != dm.Content {
+			if err := recordRevision(tx, dm.ID, dm.Content); err != nil {
+				return err
+			}
+		}
+		return tx.Model(&dm).Updates(map[string]interface{}{
+			"content":   req.Content,
+			"edited_at": time.Now(),
+		}).Error
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to edit message"})
 	}
 
@@ -149,6 +224,8 @@ func (h *DMHandler) DeleteDirectMessage(c *fiber.Ctx) error {
 		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
 	}
 
+	// Soft-deleted: the message and its attachments are kept but no longer
+	// listed.
 	if err := h.db.Delete(&dm).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete message"})
 	}
@@ -156,6 +233,29 @@ func (h *DMHandler) DeleteDirectMessage(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"message": "Message deleted successfully"})
 }
 
+// GetDirectMessageHistory returns a direct message with its earlier
+// versions to either participant.
+func (h *DMHandler) GetDirectMessageHistory(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	messageID := c.Params("messageId")
+
+	var dm DirectMessage
+	if err := h.db.Where("id = ? AND (sender_id = ? OR recipient_id = ?)", messageID, userID, userID).
+		Preload("Sender").
+		Preload("Attachments").
+		First(&dm).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+
+	revisions, err := messageRevisions(h.db, dm.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch message history"})
+	}
+	signDMAttachments(c.Context(), h.uploads, dm.Attachments)
+
+	return c.JSON(MessageHistory{Message: dm, Revisions: revisions})
+}
+
 func (h *DMHandler) updateConversation(user1ID, user2ID uuid.UUID, lastMessage string) {
 	// Ensure consistent ordering
 	if user1ID.String() > user2ID.String() {
@@ -179,4 +279,19 @@ func (h *DMHandler) updateConversation(user1ID, user2ID uuid.UUID, lastMessage s
 			"last_activity": time.Now(),
 		})
 	}
-}
\ No newline at end of file
+}
+
+func signDMAttachments(ctx context.Context, u *Uploader, attachments []DMAttachment) {
+	for i := range attachments {
+		attachments[i].URL = u.URL(ctx, attachments[i].Key, attachments[i].MimeType)
+		if attachments[i].ThumbnailKey != "" {
+			attachments[i].ThumbnailURL = u.ImageURL(ctx, attachments[i].ThumbnailKey)
+		}
+	}
+}
+
+func signDirectMessages(ctx context.Context, u *Uploader, messages []DirectMessage) {
+	for i := range messages {
+		signDMAttachments(ctx, u, messages[i].Attachments)
+	}
+}
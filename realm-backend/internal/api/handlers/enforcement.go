@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ActionBan     = "ban"
+	ActionTimeout = "timeout"
+
+	// SanctionExpiryInterval is how often expired bans and timeouts are
+	// lifted.
+	SanctionExpiryInterval = time.Minute
+
+	// timeoutPermissions is all a timed out member keeps: they can read but
+	// not send, react, type or connect to voice.
+	timeoutPermissions = PermissionViewChannels
+)
+
+// activeSanction returns the ban or timeout of a user in a realm that is in
+// force, the longest lasting one if there are several, or nil.
+func activeSanction(db *gorm.DB, realmID, userID uuid.UUID, action string) (*ModerationAction, error) {
+	var sanction ModerationAction
+	err := db.Where("realm_id = ? AND user_id = ? AND action = ? AND lifted_at IS NULL", realmID, userID, action).
+		Where("expires_at IS NULL OR expires_at > NOW()").
+		Order("expires_at DESC NULLS FIRST").
+		First(&sanction).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sanction, nil
+}
+
+// applyTimeout restricts the permissions of a member timed out until the
+// given time. The realm owner cannot be timed out.
+func (m *MemberPermissions) applyTimeout(until *time.Time) {
+	if until == nil || m.Owner {
+		return
+	}
+	m.TimedOutUntil = until
+	m.Permissions &= timeoutPermissions
+}
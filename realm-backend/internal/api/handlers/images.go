@@ -0,0 +1,309 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/media"
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	ThumbnailWidth  = 400
+	ThumbnailHeight = 300
+	BannerWidth     = 960
+	BannerHeight    = 384
+
+	// imageJobTimeout bounds the storage round-trips of one job.
+	imageJobTimeout = 2 * time.Minute
+	// imageQueueTimeout bounds how long a request waits for room in a full
+	// queue before the job is dropped.
+	imageQueueTimeout = 2 * time.Second
+)
+
+// AvatarSizes are the square variants generated for avatars and realm icons.
+// The stored URL points at the largest; clients swap the file name for a
+// smaller size.
+var AvatarSizes = []int{64, 128, 256}
+
+// ImageProcessor derives thumbnails, avatar variants and banner crops from
+// uploaded images on a background worker pool. Metadata is already stripped
+// from the originals by the Uploader.
+type ImageProcessor struct {
+	db      *gorm.DB
+	hub     *websocket.Hub
+	uploads *Uploader
+	pool    *media.Pool
+}
+
+// imageInfo is what processing learns about an attachment.
+type imageInfo struct {
+	Width        int
+	Height       int
+	BlurHash     string
+	ThumbnailKey string
+}
+
+func NewImageProcessor(db *gorm.DB, hub *websocket.Hub, uploads *Uploader, pool *media.Pool) *ImageProcessor {
+	return &ImageProcessor{db: db, hub: hub, uploads: uploads, pool: pool}
+}
+
+// ProcessMessage queues the image attachments of a channel message. Once
+// they are processed a message_update event carries the new metadata.
+func (p *ImageProcessor) ProcessMessage(ctx context.Context, message *Message) {
+	var images []Attachment
+	for _, a := range message.Attachments {
+		if isImage(a.MimeType) {
+			images = append(images, a)
+		}
+	}
+	if len(images) == 0 {
+		return
+	}
+
+	messageID := message.ID
+	p.submit(ctx, func(ctx context.Context) {
+		for _, a := range images {
+			info, err := p.processAttachment(ctx, a.Key)
+			if err != nil {
+				log.Printf("Failed to process attachment %s: %v", a.ID, err)
+				continue
+			}
+			p.db.Model(&Attachment{}).Where("id = ?", a.ID).Updates(info.columns())
+		}
+
+		var updated Message
+		if err := p.db.Preload("User").Preload("Attachments").First(&updated, "id = ?", messageID).Error; err != nil {
+			return
+		}
+		signAttachments(ctx, p.uploads, updated.Attachments)
+		attachMembers(p.db, &updated)
+
+		p.hub.BroadcastToChannel(updated.ChannelID, websocket.WSMessage{
+			Type:      websocket.EventMessageUpdate,
+			Data:      updated,
+			ChannelID: &updated.ChannelID,
+		})
+	})
+}
+
+// ProcessDirectMessage queues the image attachments of a direct message.
+func (p *ImageProcessor) ProcessDirectMessage(ctx context.Context, dm *DirectMessage) {
+	var images []DMAttachment
+	for _, a := range dm.Attachments {
+		if isImage(a.MimeType) {
+			images = append(images, a)
+		}
+	}
+	if len(images) == 0 {
+		return
+	}
+
+	p.submit(ctx, func(ctx context.Context) {
+		for _, a := range images {
+			info, err := p.processAttachment(ctx, a.Key)
+			if err != nil {
+				log.Printf("Failed to process attachment %s: %v", a.ID, err)
+				continue
+			}
+			p.db.Model(&DMAttachment{}).Where("id = ?", a.ID).Updates(info.columns())
+		}
+	})
+}
+
+// ProcessAvatar replaces an uploaded avatar with its square variants.
+func (p *ImageProcessor) ProcessAvatar(ctx context.Context, userID uuid.UUID, key string) {
+	p.processVariants(ctx, &User{}, userID, "avatar", key)
+}
+
+// ProcessRealmIcon replaces an uploaded realm icon with its square variants.
+func (p *ImageProcessor) ProcessRealmIcon(ctx context.Context, realmID uuid.UUID, key string) {
+	p.processVariants(ctx, &Realm{}, realmID, "icon_url", key)
+}
+
+// ProcessMemberAvatar replaces an uploaded realm avatar with its square
+// variants.
+func (p *ImageProcessor) ProcessMemberAvatar(ctx context.Context, memberID uuid.UUID, key string) {
+	p.processVariants(ctx, &RealmMember{}, memberID, "avatar", key)
+}
+
+// ProcessBanner replaces an uploaded profile banner with a cropped version.
+func (p *ImageProcessor) ProcessBanner(ctx context.Context, userID uuid.UUID, key string) {
+	p.submit(ctx, func(ctx context.Context) {
+		img, err := p.load(ctx, key)
+		if err != nil {
+			log.Printf("Failed to process banner %s: %v", key, err)
+			return
+		}
+
+		data, mimeType, ext, err := media.Encode(media.Cover(img, BannerWidth, BannerHeight))
+		if err != nil {
+			log.Printf("Failed to encode banner %s: %v", key, err)
+			return
+		}
+		bannerKey := path.Join(path.Dir(key), "banner"+ext)
+		if err := p.put(ctx, bannerKey, data, mimeType); err != nil {
+			log.Printf("Failed to store banner %s: %v", bannerKey, err)
+			return
+		}
+
+		p.swap(ctx, &User{}, userID, "banner", key, bannerKey)
+	})
+}
+
+// processVariants generates AvatarSizes from key and points column at the
+// largest variant.
+func (p *ImageProcessor) processVariants(ctx context.Context, model interface{}, id uuid.UUID, column, key string) {
+	p.submit(ctx, func(ctx context.Context) {
+		img, err := p.load(ctx, key)
+		if err != nil {
+			log.Printf("Failed to process image %s: %v", key, err)
+			return
+		}
+
+		var largest string
+		for _, size := range AvatarSizes {
+			data, err := media.EncodePNG(media.Cover(img, size, size))
+			if err != nil {
+				log.Printf("Failed to encode variant of %s: %v", key, err)
+				return
+			}
+			largest = variantKey(key, size)
+			if err := p.put(ctx, largest, data, "image/png"); err != nil {
+				log.Printf("Failed to store variant %s: %v", largest, err)
+				return
+			}
+		}
+
+		p.swap(ctx, model, id, column, key, largest)
+	})
+}
+
+// swap points column at the processed image, unless another upload replaced
+// the original in the meantime, and removes the original.
+func (p *ImageProcessor) swap(ctx context.Context, model interface{}, id uuid.UUID, column, original, processed string) {
+	result := p.db.Model(model).
+		Where("id = ? AND "+column+" = ?", id, p.uploads.MediaURL(original)).
+		Update(column, p.uploads.MediaURL(processed))
+	if result.Error != nil {
+		log.Printf("Failed to update %s: %v", column, result.Error)
+		return
+	}
+
+	p.uploads.Delete(ctx, original)
+	if result.RowsAffected == 0 {
+		// Superseded by a newer upload; drop what was generated.
+		for _, key := range derivedKeys(processed) {
+			p.uploads.Delete(ctx, key)
+		}
+	}
+}
+
+// processAttachment stores a thumbnail next to an image attachment.
+func (p *ImageProcessor) processAttachment(ctx context.Context, key string) (*imageInfo, error) {
+	img, err := p.load(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	b := img.Bounds()
+	info := &imageInfo{Width: b.Dx(), Height: b.Dy()}
+
+	thumb := media.Fit(img, ThumbnailWidth, ThumbnailHeight)
+	if info.BlurHash, err = media.BlurHash(thumb); err != nil {
+		return nil, err
+	}
+
+	thumbData, thumbType, ext, err := media.Encode(thumb)
+	if err != nil {
+		return nil, err
+	}
+	info.ThumbnailKey = path.Join(path.Dir(key), "thumbnail"+ext)
+	if err := p.put(ctx, info.ThumbnailKey, thumbData, thumbType); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// load reads and decodes a stored image. The decoded image is already
+// oriented upright.
+func (p *ImageProcessor) load(ctx context.Context, key string) (image.Image, error) {
+	r, err := p.uploads.store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(io.LimitReader(r, MaxAttachmentSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > MaxAttachmentSize {
+		return nil, fmt.Errorf("image %s exceeds the attachment size limit", key)
+	}
+
+	img, _, err := media.Decode(data)
+	return img, err
+}
+
+func (p *ImageProcessor) put(ctx context.Context, key string, data []byte, mimeType string) error {
+	return p.uploads.store.Put(ctx, key, bytes.NewReader(data), int64(len(data)), mimeType)
+}
+
+// submit runs job on the pool with its own deadline; the request that queued
+// it may finish long before the job runs. Request contexts are not cancelled
+// when the client goes away, so waiting for a full queue is bounded here.
+func (p *ImageProcessor) submit(ctx context.Context, job func(ctx context.Context)) {
+	ctx, cancel := context.WithTimeout(ctx, imageQueueTimeout)
+	defer cancel()
+
+	err := p.pool.Submit(ctx, func() {
+		ctx, cancel := context.WithTimeout(context.Background(), imageJobTimeout)
+		defer cancel()
+		job(ctx)
+	})
+	if err != nil {
+		log.Printf("Failed to queue image processing: %v", err)
+	}
+}
+
+func (i *imageInfo) columns() map[string]interface{} {
+	return map[string]interface{}{
+		"width":         i.Width,
+		"height":        i.Height,
+		"blurhash":      i.BlurHash,
+		"thumbnail_key": i.ThumbnailKey,
+	}
+}
+
+func isImage(mimeType string) bool {
+	return strings.HasPrefix(mimeType, "image/")
+}
+
+// variantKey names the variant of size next to the original at key.
+func variantKey(key string, size int) string {
+	return path.Join(path.Dir(key), fmt.Sprintf("%d.png", size))
+}
+
+// derivedKeys lists every object belonging to a stored avatar, icon or
+// banner: all the variants when key is the largest one, otherwise just key.
+func derivedKeys(key string) []string {
+	if key != variantKey(key, AvatarSizes[len(AvatarSizes)-1]) {
+		return []string{key}
+	}
+	keys := make([]string, 0, len(AvatarSizes))
+	for _, size := range AvatarSizes {
+		keys = append(keys, variantKey(key, size))
+	}
+	return keys
+}
@@ -0,0 +1,397 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"math/big"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxInviteAge caps how long an expiring invite stays valid.
+	MaxInviteAge = 7 * 24 * time.Hour
+	// MaxInviteUses caps the max_uses of an invite; 0 means unlimited.
+	MaxInviteUses = 100
+
+	inviteCodeLength   = 8
+	inviteCodeAlphabet = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+var (
+	vanityCodePattern = regexp.MustCompile(`^[a-z0-9-]{3,32}$`)
+
+	errInviteInvalid = fiber.NewError(fiber.StatusNotFound, "Invalid invite code")
+	errInviteBanned  = fiber.NewError(fiber.StatusForbidden, "You are banned from this realm")
+	errAlreadyMember = fiber.NewError(fiber.StatusBadRequest, "Already a member")
+	errCodeTaken     = fiber.NewError(fiber.StatusConflict, "Invite code already taken")
+)
+
+type InvitesHandler struct {
+	db    *gorm.DB
+	hub   *websocket.Hub
+	perms *PermissionResolver
+}
+
+// Invite lets users join a realm. A vanity invite is the realm's single
+// custom code, set by its owner; it never expires.
+type Invite struct {
+	Code      string     `json:"code" gorm:"primaryKey"`
+	RealmID   uuid.UUID  `json:"realm_id" gorm:"type:uuid;not null"`
+	ChannelID *uuid.UUID `json:"channel_id" gorm:"type:uuid"`
+	CreatorID uuid.UUID  `json:"creator_id" gorm:"type:uuid;not null"`
+	// MaxUses is how many users may join with the invite, 0 for unlimited.
+	MaxUses   int        `json:"max_uses" gorm:"default:0"`
+	Uses      int        `json:"uses" gorm:"default:0"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	// Temporary members are removed when they go offline unless they were
+	// given a role in the meantime.
+	Temporary bool      `json:"temporary" gorm:"default:false"`
+	Vanity    bool      `json:"vanity" gorm:"default:false"`
+	CreatedAt time.Time `json:"created_at"`
+	Creator   *User     `json:"creator,omitempty" gorm:"foreignKey:CreatorID"`
+}
+
+// usable reports whether the invite can still be used to join.
+func (i *Invite) usable() bool {
+	if i.ExpiresAt != nil && !i.ExpiresAt.After(time.Now()) {
+		return false
+	}
+	return i.MaxUses == 0 || i.Uses < i.MaxUses
+}
+
+type CreateInviteRequest struct {
+	ChannelID *uuid.UUID `json:"channel_id"`
+	MaxUses   int        `json:"max_uses"`
+	// MaxAge is the lifetime in seconds, 0 for an invite that never expires.
+	MaxAge    int  `json:"max_age"`
+	Temporary bool `json:"temporary"`
+}
+
+type VanityRequest struct {
+	Code string `json:"code"`
+}
+
+// InvitePreview describes the realm an invite leads to.
+type InvitePreview struct {
+	Code        string     `json:"code"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	Realm       Realm      `json:"realm"`
+	Channel     *Channel   `json:"channel,omitempty"`
+	Inviter     *User      `json:"inviter,omitempty"`
+	MemberCount int64      `json:"member_count"`
+	OnlineCount int64      `json:"online_count"`
+}
+
+func NewInvitesHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver) *InvitesHandler {
+	return &InvitesHandler{db: db, hub: hub, perms: perms}
+}
+
+func (h *InvitesHandler) CreateInvite(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	member := currentMember(c)
+
+	var req CreateInviteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.MaxUses < 0 || req.MaxUses > MaxInviteUses {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid max_uses"})
+	}
+	maxAge := time.Duration(req.MaxAge) * time.Second
+	if maxAge < 0 || maxAge > MaxInviteAge {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid max_age"})
+	}
+
+	if req.ChannelID != nil {
+		channel, err := findChannel(h.db, *req.ChannelID)
+		if err != nil || channel.RealmID != member.RealmID {
+			return c.Status(404).JSON(fiber.Map{"error": "Channel not found"})
+		}
+		scoped, err := h.perms.ResolveChannel(channel, userID)
+		if err != nil || !scoped.Has(PermissionViewChannels) {
+			return c.Status(404).JSON(fiber.Map{"error": "Channel not found"})
+		}
+	}
+
+	invite := Invite{
+		RealmID:   member.RealmID,
+		ChannelID: req.ChannelID,
+		CreatorID: userID,
+		MaxUses:   req.MaxUses,
+		Temporary: req.Temporary,
+	}
+	if maxAge > 0 {
+		expiresAt := time.Now().Add(maxAge)
+		invite.ExpiresAt = &expiresAt
+	}
+
+	// Codes are random; retry the rare collision with an existing one.
+	for attempt := 0; ; attempt++ {
+		code, err := inviteCode()
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create invite"})
+		}
+		invite.Code = code
+
+		result := h.db.Clauses(clause.OnConflict{DoNothing: true}).Create(&invite)
+		if result.Error != nil || (result.RowsAffected == 0 && attempt == 2) {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to create invite"})
+		}
+		if result.RowsAffected > 0 {
+			break
+		}
+	}
+
+	return c.JSON(invite)
+}
+
+// GetRealmInvites lists the invites of a realm, including expired ones.
+func (h *InvitesHandler) GetRealmInvites(c *fiber.Ctx) error {
+	member := currentMember(c)
+
+	var invites []Invite
+	if err := h.db.Where("realm_id = ?", member.RealmID).
+		Preload("Creator").
+		Order("created_at DESC").
+		Find(&invites).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch invites"})
+	}
+
+	return c.JSON(invites)
+}
+
+// GetInvite previews the realm behind an invite without joining it.
+func (h *InvitesHandler) GetInvite(c *fiber.Ctx) error {
+	var invite Invite
+	if err := h.db.Scopes(inviteByCode(c.Params("code"))).Preload("Creator").First(&invite).Error; err != nil || !invite.usable() {
+		return errInviteInvalid
+	}
+
+	preview := InvitePreview{
+		Code:      invite.Code,
+		ExpiresAt: invite.ExpiresAt,
+		Inviter:   invite.Creator,
+	}
+	if err := h.db.Where("id = ?", invite.RealmID).First(&preview.Realm).Error; err != nil {
+		return errInviteInvalid
+	}
+	if invite.ChannelID != nil {
+		if channel, err := findChannel(h.db, *invite.ChannelID); err == nil {
+			preview.Channel = channel
+		}
+	}
+	if invite.Vanity {
+		preview.Inviter = nil
+	}
+
+	members := h.db.Model(&RealmMember{}).Where("realm_members.realm_id = ?", invite.RealmID)
+	if err := members.Session(&gorm.Session{}).Count(&preview.MemberCount).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch invite"})
+	}
+	if err := members.Session(&gorm.Session{}).
+		Joins("JOIN users ON users.id = realm_members.user_id").
+		Where("users.status <> ?", websocket.PresenceOffline).
+		Count(&preview.OnlineCount).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch invite"})
+	}
+
+	return c.JSON(preview)
+}
+
+// AcceptInvite joins the realm of an invite, counting the use.
+func (h *InvitesHandler) AcceptInvite(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	var invite Invite
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the invite so concurrent joins cannot exceed max_uses.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Scopes(inviteByCode(c.Params("code"))).First(&invite).Error; err != nil {
+			return errInviteInvalid
+		}
+		if !invite.usable() {
+			return errInviteInvalid
+		}
+
+		ban, err := activeSanction(tx, invite.RealmID, userID, ActionBan)
+		if err != nil {
+			return err
+		}
+		if ban != nil {
+			return errInviteBanned
+		}
+
+		var existing int64
+		if err := tx.Model(&RealmMember{}).Where("realm_id = ? AND user_id = ?", invite.RealmID, userID).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			return errAlreadyMember
+		}
+
+		member := RealmMember{
+			RealmID:   invite.RealmID,
+			UserID:    userID,
+			Temporary: invite.Temporary,
+		}
+		if err := tx.Create(&member).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(&invite).Update("uses", gorm.Expr("uses + 1")).Error
+	})
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return err
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to join realm"})
+	}
+
+	return c.JSON(fiber.Map{
+		"message":    "Successfully joined realm",
+		"realm_id":   invite.RealmID,
+		"channel_id": invite.ChannelID,
+	})
+}
+
+// DeleteInvite revokes an invite. Members may revoke their own invites;
+// others need PermissionManageChannels. Vanity codes are changed through
+// SetVanity instead.
+func (h *InvitesHandler) DeleteInvite(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	var invite Invite
+	if err := h.db.Where("code = ? AND vanity = ?", c.Params("code"), false).First(&invite).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Invite not found"})
+	}
+
+	if invite.CreatorID != userID {
+		member, err := h.perms.Resolve(invite.RealmID, userID)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Invite not found"})
+		}
+		if !member.Has(PermissionManageChannels) {
+			return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+		}
+	}
+
+	if err := h.db.Delete(&invite).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete invite"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Invite deleted successfully"})
+}
+
+func (h *InvitesHandler) GetVanity(c *fiber.Ctx) error {
+	member := currentMember(c)
+
+	var invite Invite
+	if err := h.db.Where("realm_id = ? AND vanity = ?", member.RealmID, true).First(&invite).Error; err != nil {
+		return c.JSON(fiber.Map{"code": nil, "uses": 0})
+	}
+
+	return c.JSON(fiber.Map{"code": invite.Code, "uses": invite.Uses})
+}
+
+// SetVanity replaces the realm's vanity code, or removes it when the code
+// is empty. Only the realm owner may change it.
+func (h *InvitesHandler) SetVanity(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	member := currentMember(c)
+	if !member.Owner {
+		return c.Status(403).JSON(fiber.Map{"error": "Only the realm owner can change the vanity code"})
+	}
+
+	var req VanityRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	code := strings.ToLower(strings.TrimSpace(req.Code))
+	if code != "" && !vanityCodePattern.MatchString(code) {
+		return c.Status(400).JSON(fiber.Map{"error": "Vanity codes are 3-32 lowercase letters, digits or dashes"})
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("realm_id = ? AND vanity = ?", member.RealmID, true).Delete(&Invite{}).Error; err != nil {
+			return err
+		}
+		if code == "" {
+			return nil
+		}
+
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&Invite{
+			Code:      code,
+			RealmID:   member.RealmID,
+			CreatorID: userID,
+			Vanity:    true,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return errCodeTaken
+		}
+		return nil
+	})
+	if errors.Is(err, errCodeTaken) {
+		return err
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update vanity code"})
+	}
+
+	return c.JSON(fiber.Map{"code": code})
+}
+
+// dropTemporaryMemberships removes a user who went offline from the realms
+// they joined through a temporary invite, unless they have since been given
+// a role there.
+func dropTemporaryMemberships(db *gorm.DB, hub *websocket.Hub, userID uuid.UUID) {
+	var dropped []RealmMember
+	err := db.Model(&dropped).Clauses(clause.Returning{}).
+		Where("user_id = ? AND temporary = ?", userID, true).
+		Where("NOT EXISTS (SELECT 1 FROM member_roles WHERE member_roles.realm_id = realm_members.realm_id AND member_roles.user_id = realm_members.user_id)").
+		Delete(&dropped).Error
+	if err != nil {
+		log.Printf("Failed to remove temporary memberships of %s: %v", userID, err)
+		return
+	}
+
+	for _, member := range dropped {
+		hub.EvictMembers(member.RealmID, userID)
+	}
+}
+
+// inviteByCode selects the invite with the given code. Random codes are case
+// sensitive, while vanity codes are stored lowercased and match in any case;
+// an exact match on a random code wins.
+func inviteByCode(code string) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		return db.Where("code = ? OR (vanity = ? AND code = ?)", code, true, strings.ToLower(code)).
+			Order("vanity ASC")
+	}
+}
+
+// inviteCode generates a random invite code.
+func inviteCode() (string, error) {
+	code := make([]byte, inviteCodeLength)
+	max := big.NewInt(int64(len(inviteCodeAlphabet)))
+	for i := range code {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		code[i] = inviteCodeAlphabet[n.Int64()]
+	}
+	return string(code), nil
+}
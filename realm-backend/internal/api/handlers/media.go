@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"mime/multipart"
+	"path"
+	"strings"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// mediaPrefixes are the key prefixes served publicly through MediaPath.
+var mediaPrefixes = []string{"avatars/", "banners/", "icons/"}
+
+type MediaHandler struct {
+	db      *gorm.DB
+	uploads *Uploader
+	images  *ImageProcessor
+}
+
+func NewMediaHandler(db *gorm.DB, uploads *Uploader, images *ImageProcessor) *MediaHandler {
+	return &MediaHandler{db: db, uploads: uploads, images: images}
+}
+
+func (h *MediaHandler) UploadAvatar(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "File required"})
+	}
+
+	var user User
+	if err := h.db.Select("id", "avatar").Where("id = ?", userID).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	stored, err := h.uploads.Save(c.Context(), "avatars/"+userID.String(), fh, ImagePolicy)
+	if err != nil {
+		return err
+	}
+
+	avatar := h.uploads.MediaURL(stored.Key)
+	if err := h.db.Model(&User{}).Where("id = ?", userID).Update("avatar", avatar).Error; err != nil {
+		h.uploads.Delete(c.Context(), stored.Key)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update avatar"})
+	}
+
+	deleteMedia(c.Context(), h.uploads, user.Avatar)
+	h.images.ProcessAvatar(c.Context(), userID, stored.Key)
+
+	return c.JSON(fiber.Map{"avatar": avatar})
+}
+
+// UploadBanner stores a profile banner. It is cropped to BannerWidth x
+// BannerHeight in the background; until then the original is served.
+func (h *MediaHandler) UploadBanner(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "File required"})
+	}
+
+	var user User
+	if err := h.db.Select("id", "banner").Where("id = ?", userID).First(&user).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	stored, err := h.uploads.Save(c.Context(), "banners/"+userID.String(), fh, ImagePolicy)
+	if err != nil {
+		return err
+	}
+
+	banner := h.uploads.MediaURL(stored.Key)
+	if err := h.db.Model(&User{}).Where("id = ?", userID).Update("banner", banner).Error; err != nil {
+		h.uploads.Delete(c.Context(), stored.Key)
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update banner"})
+	}
+
+	deleteMedia(c.Context(), h.uploads, user.Banner)
+	h.images.ProcessBanner(c.Context(), userID, stored.Key)
+
+	return c.JSON(fiber.Map{"banner": banner})
+}
+
+func (h *MediaHandler) UploadRealmIcon(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+
+	fh, err := c.FormFile("file")
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "File required"})
+	}
+
+	var realm Realm
+	if err := h.db.Where("id = ?", realmID).First(&realm).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Realm not found"})
+	}
+
+	icon, err := setRealmIcon(c.Context(), h.db, h.uploads, h.images, &realm, fh)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(fiber.Map{"icon_url": icon})
+}
+
+// setRealmIcon stores an uploaded icon for a realm and removes the one it
+// replaces. Errors are returned as *fiber.Error.
+func setRealmIcon(ctx context.Context, db *gorm.DB, u *Uploader, images *ImageProcessor, realm *Realm, fh *multipart.FileHeader) (string, error) {
+	stored, err := u.Save(ctx, "icons/"+realm.ID.String(), fh, ImagePolicy)
+	if err != nil {
+		return "", err
+	}
+
+	icon := u.MediaURL(stored.Key)
+	if err := db.Model(&Realm{}).Where("id = ?", realm.ID).Update("icon_url", icon).Error; err != nil {
+		u.Delete(ctx, stored.Key)
+		return "", fiber.NewError(fiber.StatusInternalServerError, "Failed to update icon")
+	}
+
+	deleteMedia(ctx, u, realm.IconURL)
+	images.ProcessRealmIcon(ctx, realm.ID, stored.Key)
+
+	realm.IconURL = icon
+	return icon, nil
+}
+
+// deleteMedia removes a replaced avatar, banner or icon, including the
+// variants generated from it.
+func deleteMedia(ctx context.Context, u *Uploader, url string) {
+	key := mediaKey(url)
+	if key == "" {
+		return
+	}
+	for _, k := range derivedKeys(key) {
+		u.Delete(ctx, k)
+	}
+}
+
+// GetMedia redirects a stable avatar or icon URL to a signed download URL.
+func (h *MediaHandler) GetMedia(c *fiber.Ctx) error {
+	key := c.Params("*")
+
+	public := false
+	for _, prefix := range mediaPrefixes {
+		public = public || strings.HasPrefix(key, prefix)
+	}
+	if !public {
+		return c.Status(404).JSON(fiber.Map{"error": "Not found"})
+	}
+
+	url := h.uploads.ImageURL(c.Context(), key)
+	if url == "" {
+		return c.Status(404).JSON(fiber.Map{"error": "Not found"})
+	}
+
+	c.Set(fiber.HeaderCacheControl, "public, max-age=3600")
+	return c.Redirect(url, fiber.StatusFound)
+}
+
+// ServeFile serves the targets of signed URLs issued by a local blob store.
+func (h *MediaHandler) ServeFile(c *fiber.Ctx) error {
+	local, ok := h.uploads.store.(*storage.LocalStore)
+	if !ok {
+		return c.Status(404).JSON(fiber.Map{"error": "Not found"})
+	}
+
+	key := c.Params("*")
+	inline := c.Query("inline") == "1"
+
+	f, err := local.Open(key, c.Query("expires"), c.Query("signature"), inline)
+	if errors.Is(err, storage.ErrInvalidSignature) {
+		return c.Status(403).JSON(fiber.Map{"error": "Invalid or expired link"})
+	}
+	if err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Not found"})
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to read file"})
+	}
+
+	// Re-sniff rather than trusting the key's extension.
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(f, head)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to read file"})
+	}
+
+	if mimeType := sniffContentType(head[:n]); inline && inlineTypes[mimeType] {
+		c.Set(fiber.HeaderContentType, mimeType)
+	} else {
+		c.Set(fiber.HeaderContentType, "application/octet-stream")
+		c.Set(fiber.HeaderContentDisposition, `attachment; filename="`+path.Base(key)+`"`)
+	}
+	c.Set(fiber.HeaderCacheControl, "private, max-age=3600")
+
+	return c.SendStream(f, int(info.Size()))
+}
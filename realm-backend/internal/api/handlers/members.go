@@ -0,0 +1,236 @@
+package handlers
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MaxNicknameLength bounds realm nicknames.
+const MaxNicknameLength = 32
+
+type MembersHandler struct {
+	db      *gorm.DB
+	hub     *websocket.Hub
+	perms   *PermissionResolver
+	uploads *Uploader
+	images  *ImageProcessor
+}
+
+// UpdateMemberRequest is sent as JSON, or as multipart form fields alongside
+// a new realm avatar in "avatar". An empty nickname or avatar clears it.
+type UpdateMemberRequest struct {
+	Nickname *string `json:"nickname" form:"nickname"`
+	Avatar   *string `json:"avatar" form:"avatar"`
+}
+
+// MemberProfile is how the author of a message appears in its realm.
+type MemberProfile struct {
+	Nickname string `json:"nickname,omitempty"`
+	Avatar   string `json:"avatar,omitempty"`
+	// Color is the colour of the author's highest hoisted role.
+	Color string `json:"color,omitempty"`
+}
+
+// memberProfileRow is one row of the member profile query.
+type memberProfileRow struct {
+	ChannelID uuid.UUID
+	UserID    uuid.UUID
+	Nickname  string
+	Avatar    string
+	Color     string
+}
+
+func NewMembersHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver, uploads *Uploader, images *ImageProcessor) *MembersHandler {
+	return &MembersHandler{db: db, hub: hub, perms: perms, uploads: uploads, images: images}
+}
+
+// UpdateSelf changes the nickname or realm avatar of the current user.
+func (h *MembersHandler) UpdateSelf(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+	userID := c.Locals("userID").(uuid.UUID)
+
+	var req UpdateMemberRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Avatar != nil && *req.Avatar != "" {
+		return c.Status(400).JSON(fiber.Map{"error": "Avatar must be uploaded as a file"})
+	}
+
+	updates, err := nicknameUpdate(req.Nickname)
+	if err != nil {
+		return err
+	}
+	if req.Avatar != nil {
+		updates["avatar"] = ""
+	}
+
+	var member RealmMember
+	if err := h.db.Where("realm_id = ? AND user_id = ?", realmID, userID).First(&member).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+	previous := member.Avatar
+
+	var stored *StoredFile
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		if fh, err := c.FormFile("avatar"); err == nil {
+			stored, err = h.uploads.Save(c.Context(), "avatars/"+realmID.String()+"/"+userID.String(), fh, ImagePolicy)
+			if err != nil {
+				return err
+			}
+			updates["avatar"] = h.uploads.MediaURL(stored.Key)
+		}
+	}
+
+	if err := h.save(&member, updates); err != nil {
+		if stored != nil {
+			h.uploads.Delete(c.Context(), stored.Key)
+		}
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update member"})
+	}
+
+	if _, ok := updates["avatar"]; ok {
+		deleteMedia(c.Context(), h.uploads, previous)
+	}
+	if stored != nil {
+		h.images.ProcessMemberAvatar(c.Context(), member.ID, stored.Key)
+	}
+
+	return c.JSON(member)
+}
+
+// UpdateMember changes the nickname of another member.
+func (h *MembersHandler) UpdateMember(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+
+	targetID, err := uuid.Parse(c.Params("userId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid user ID"})
+	}
+	if targetID != c.Locals("userID").(uuid.UUID) {
+		if err := h.perms.CheckTarget(currentMember(c), targetID); err != nil {
+			return err
+		}
+	}
+
+	var req UpdateMemberRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	updates, err := nicknameUpdate(req.Nickname)
+	if err != nil {
+		return err
+	}
+
+	var member RealmMember
+	if err := h.db.Where("realm_id = ? AND user_id = ?", realmID, targetID).First(&member).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
+	if err := h.save(&member, updates); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update member"})
+	}
+
+	return c.JSON(member)
+}
+
+// save applies updates to a member and announces the change to the realm.
+func (h *MembersHandler) save(member *RealmMember, updates map[string]interface{}) error {
+	if len(updates) > 0 {
+		if err := h.db.Model(member).Updates(updates).Error; err != nil {
+			return err
+		}
+	}
+
+	h.hub.BroadcastToRealm(member.RealmID, websocket.WSMessage{
+		Type:    websocket.EventMemberUpdate,
+		Data:    member,
+		RealmID: &member.RealmID,
+	})
+	return nil
+}
+
+// nicknameUpdate validates a requested nickname. Errors are returned as
+// *fiber.Error.
+func nicknameUpdate(nickname *string) (map[string]interface{}, error) {
+	updates := map[string]interface{}{}
+	if nickname == nil {
+		return updates, nil
+	}
+
+	name := strings.TrimSpace(*nickname)
+	if utf8.RuneCountInString(name) > MaxNicknameLength {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Nickname too long")
+	}
+	updates["nickname"] = name
+	return updates, nil
+}
+
+// attachMembers resolves how the authors of messages appear in the realms
+// of their channels. Authors who left the realm get no profile.
+func attachMembers(db *gorm.DB, messages ...*Message) {
+	if len(messages) == 0 {
+		return
+	}
+
+	channels := make(map[uuid.UUID]bool)
+	users := make(map[uuid.UUID]bool)
+	for _, message := range messages {
+		channels[message.ChannelID] = true
+		users[message.UserID] = true
+	}
+
+	var rows []memberProfileRow
+	if err := db.Raw(`
+		SELECT c.id AS channel_id, rm.user_id,
+			COALESCE(rm.nickname, '') AS nickname,
+			COALESCE(rm.avatar, '') AS avatar,
+			COALESCE((SELECT r.color FROM member_roles mr
+				JOIN roles r ON r.id = mr.role_id
+				WHERE mr.realm_id = rm.realm_id AND mr.user_id = rm.user_id AND r.hoisted
+				ORDER BY r.position DESC LIMIT 1), '') AS color
+		FROM channels c
+		JOIN realm_members rm ON rm.realm_id = c.realm_id
+		WHERE c.id IN ? AND rm.user_id IN ?`,
+		keys(channels), keys(users),
+	).Scan(&rows).Error; err != nil {
+		log.Printf("Failed to load member profiles: %v", err)
+		return
+	}
+
+	type author struct{ channelID, userID uuid.UUID }
+	profiles := make(map[author]*MemberProfile, len(rows))
+	for _, row := range rows {
+		profiles[author{row.ChannelID, row.UserID}] = &MemberProfile{
+			Nickname: row.Nickname,
+			Avatar:   row.Avatar,
+			Color:    row.Color,
+		}
+	}
+	for _, message := range messages {
+		message.Member = profiles[author{message.ChannelID, message.UserID}]
+	}
+}
+
+// attachMemberList is attachMembers for a slice of messages.
+func attachMemberList(db *gorm.DB, messages []Message) {
+	pointers := make([]*Message, len(messages))
+	for i := range messages {
+		pointers[i] = &messages[i]
+	}
+	attachMembers(db, pointers...)
+}
+
+func keys(set map[uuid.UUID]bool) []uuid.UUID {
+	ids := make([]uuid.UUID, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	return ids
+}
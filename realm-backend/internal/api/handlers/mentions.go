@@ -0,0 +1,283 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"slices"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	NotificationTypeMention = "mention"
+
+	// mentionPreviewLength bounds the message excerpt in notifications.
+	mentionPreviewLength = 200
+)
+
+var (
+	userMentionPattern     = regexp.MustCompile(`<@([0-9a-fA-F-]{36})>`)
+	roleMentionPattern     = regexp.MustCompile(`<@&([0-9a-fA-F-]{36})>`)
+	everyoneMentionPattern = regexp.MustCompile(`(?:^|[^\w<])@(everyone|here)\b`)
+	// codePattern matches code blocks and inline code, where mentions are
+	// shown literally.
+	codePattern = regexp.MustCompile("(?s)```.*?```|`[^`\n]*`")
+)
+
+type MentionsHandler struct {
+	db      *gorm.DB
+	perms   *PermissionResolver
+	uploads *Uploader
+}
+
+// MentionResult is an entry of the mentions inbox.
+type MentionResult struct {
+	Notification Notification `json:"notification"`
+	Message      Message      `json:"message"`
+}
+
+// mentionData is stored as the Data of mention notifications.
+type mentionData struct {
+	MessageID uuid.UUID `json:"message_id"`
+	ChannelID uuid.UUID `json:"channel_id"`
+	RealmID   uuid.UUID `json:"realm_id"`
+	AuthorID  uuid.UUID `json:"author_id"`
+}
+
+// mentionSet is what a message mentions once permissions are applied.
+type mentionSet struct {
+	Users    []uuid.UUID
+	Roles    []uuid.UUID
+	Everyone bool
+	Here     bool
+}
+
+func NewMentionsHandler(db *gorm.DB, perms *PermissionResolver, uploads *Uploader) *MentionsHandler {
+	return &MentionsHandler{db: db, perms: perms, uploads: uploads}
+}
+
+// GetMentions lists the messages that mentioned the caller, newest first,
+// in the channels they can still view.
+func (h *MentionsHandler) GetMentions(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+
+	notifications, info, err := fetchPage[Notification](h.db, func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id = ? AND type = ?", userID, NotificationTypeMention)
+	}, page)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Mention not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch mentions"})
+	}
+	// Listed newest first; the page cursors still lead to older (before) and
+	// newer (after) mentions.
+	slices.Reverse(notifications)
+
+	messageIDs := make([]uuid.UUID, 0, len(notifications))
+	var realmIDs []uuid.UUID
+	for _, n := range notifications {
+		var data mentionData
+		if json.Unmarshal([]byte(n.Data), &data) == nil {
+			messageIDs = append(messageIDs, data.MessageID)
+			if !slices.Contains(realmIDs, data.RealmID) {
+				realmIDs = append(realmIDs, data.RealmID)
+			}
+		}
+	}
+
+	channelIDs, err := h.visibleChannels(userID, realmIDs)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch mentions"})
+	}
+
+	var messages []Message
+	if len(messageIDs) > 0 && len(channelIDs) > 0 {
+		if err := h.db.Where("id IN ? AND channel_id IN ?", messageIDs, channelIDs).
+			Preload("User").Preload("Attachments").
+			Find(&messages).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch mentions"})
+		}
+	}
+	signMessages(c.Context(), h.uploads, messages)
+	attachMemberList(h.db, messages)
+
+	byID := make(map[uuid.UUID]Message, len(messages))
+	for _, m := range messages {
+		byID[m.ID] = m
+	}
+
+	// Mentions whose message was deleted or is no longer visible are skipped.
+	results := make([]MentionResult, 0, len(notifications))
+	for _, n := range notifications {
+		var data mentionData
+		if json.Unmarshal([]byte(n.Data), &data) != nil {
+			continue
+		}
+		if m, ok := byID[data.MessageID]; ok {
+			results = append(results, MentionResult{Notification: n, Message: m})
+		}
+	}
+
+	setPageHeaders(c, info)
+	return c.JSON(results)
+}
+
+// visibleChannels returns the channels of the given realms the user can view.
+// Realms they are no longer a member of are skipped, as are NSFW channels
+// until they have acknowledged their age.
+func (h *MentionsHandler) visibleChannels(userID uuid.UUID, realmIDs []uuid.UUID) ([]uuid.UUID, error) {
+	if len(realmIDs) == 0 {
+		return nil, nil
+	}
+
+	acknowledged, err := ageAcknowledged(h.db, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var channelIDs []uuid.UUID
+	for _, realmID := range realmIDs {
+		member, err := h.perms.Resolve(realmID, userID)
+		if errors.Is(err, ErrNotRealmMember) || errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		channels, err := h.perms.VisibleChannels(member)
+		if err != nil {
+			return nil, err
+		}
+		for _, channel := range channels {
+			if channel.NSFW && !acknowledged {
+				continue
+			}
+			channelIDs = append(channelIDs, channel.ID)
+		}
+	}
+	return channelIDs, nil
+}
+
+// parseMentions extracts the users, roles and @everyone/@here mentioned in
+// message content, ignoring code.
+func parseMentions(content string) mentionSet {
+	content = codePattern.ReplaceAllString(content, "")
+
+	var set mentionSet
+	for _, match := range userMentionPattern.FindAllStringSubmatch(content, -1) {
+		if id, err := uuid.Parse(match[1]); err == nil && !slices.Contains(set.Users, id) {
+			set.Users = append(set.Users, id)
+		}
+	}
+	for _, match := range roleMentionPattern.FindAllStringSubmatch(content, -1) {
+		if id, err := uuid.Parse(match[1]); err == nil && !slices.Contains(set.Roles, id) {
+			set.Roles = append(set.Roles, id)
+		}
+	}
+	for _, match := range everyoneMentionPattern.FindAllStringSubmatch(content, -1) {
+		switch match[1] {
+		case "everyone":
+			set.Everyone = true
+		case "here":
+			set.Here = true
+		}
+	}
+	return set
+}
+
+// resolveMentions parses content and keeps the mentions author may make in
+// channel: users who can see the channel, roles of the realm that are
+// mentionable, and @everyone/@here only with PermissionMentionEveryone, which
+// also allows mentioning any role.
+func resolveMentions(db *gorm.DB, perms *PermissionResolver, channel *Channel, author *MemberPermissions, content string) (*mentionSet, error) {
+	parsed := parseMentions(content)
+	set := &mentionSet{Users: []uuid.UUID{}, Roles: []uuid.UUID{}}
+
+	if len(parsed.Users) > 0 {
+		users, err := perms.ChannelAudience(channel, parsed.Users)
+		if err != nil {
+			return nil, err
+		}
+		set.Users = users
+	}
+
+	if len(parsed.Roles) > 0 {
+		query := db.Model(&Role{}).Where("realm_id = ? AND id IN ?", channel.RealmID, parsed.Roles)
+		if !author.Has(PermissionMentionEveryone) {
+			query = query.Where("mentionable = ?", true)
+		}
+		if err := query.Pluck("id", &set.Roles).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if author.Has(PermissionMentionEveryone) {
+		set.Everyone = parsed.Everyone
+		set.Here = parsed.Here
+	}
+
+	return set, nil
+}
+
+// recipients lists the users to notify about a message by author, each once:
+// mentioned users, members of mentioned roles, and for @everyone/@here the
+// whole channel audience or its online part.
+func (m *mentionSet) recipients(db *gorm.DB, perms *PermissionResolver, channel *Channel, authorID uuid.UUID) ([]uuid.UUID, error) {
+	var audience []uuid.UUID
+	if m.Everyone {
+		var err error
+		if audience, err = perms.ChannelAudience(channel, nil); err != nil {
+			return nil, err
+		}
+	} else {
+		candidates := slices.Clone(m.Users)
+
+		if len(m.Roles) > 0 {
+			var members []uuid.UUID
+			if err := db.Model(&MemberRole{}).
+				Where("realm_id = ? AND role_id IN ?", channel.RealmID, m.Roles).
+				Distinct().Pluck("user_id", &members).Error; err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, members...)
+		}
+
+		if m.Here {
+			var online []uuid.UUID
+			if err := db.Model(&RealmMember{}).
+				Joins("JOIN users ON users.id = realm_members.user_id").
+				Where("realm_members.realm_id = ? AND users.status <> ?", channel.RealmID, websocket.PresenceOffline).
+				Pluck("realm_members.user_id", &online).Error; err != nil {
+				return nil, err
+			}
+			candidates = append(candidates, online...)
+		}
+
+		var err error
+		if audience, err = perms.ChannelAudience(channel, candidates); err != nil {
+			return nil, err
+		}
+	}
+
+	return slices.DeleteFunc(audience, func(id uuid.UUID) bool { return id == authorID }), nil
+}
+
+// preview shortens content for a notification.
+func preview(content string) string {
+	runes := []rune(content)
+	if len(runes) <= mentionPreviewLength {
+		return content
+	}
+	return string(runes[:mentionPreviewLength-1]) + "…"
+}
@@ -1,29 +1,83 @@
 package handlers
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
+	"mime/multipart"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type MessagesHandler struct {
-	db *gorm.DB
+	db            *gorm.DB
+	hub           *websocket.Hub
+	perms         *PermissionResolver
+	uploads       *Uploader
+	images        *ImageProcessor
+	notifications *NotificationsHandler
 }
 
+const (
+	MessageTypeText = "text"
+	// MessageTypeSystem messages are generated by the server, e.g. to
+	// announce a pin, and cannot be edited.
+	MessageTypeSystem = "system"
+	// MessageTypeCrosspost messages are copies of a message published by a
+	// followed announcement channel and cannot be edited.
+	MessageTypeCrosspost = "crosspost"
+)
+
 type Message struct {
-	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	ChannelID uuid.UUID `json:"channel_id" gorm:"type:uuid;not null"`
-	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
-	Content   string    `json:"content"`
-	Type      string    `json:"type" gorm:"default:text"`
+	ID        uuid.UUID  `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ChannelID uuid.UUID  `json:"channel_id" gorm:"type:uuid;not null"`
+	UserID    uuid.UUID  `json:"user_id" gorm:"type:uuid;not null"`
+	Content   string     `json:"content"`
+	Type      string     `json:"type" gorm:"default:text"`
 	ReplyTo   *uuid.UUID `json:"reply_to" gorm:"type:uuid"`
 	ThreadID  *uuid.UUID `json:"thread_id" gorm:"type:uuid"`
-	Pinned    bool      `json:"pinned" gorm:"default:false"`
-	Edited    bool      `json:"edited" gorm:"default:false"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
-	User      User      `json:"user" gorm:"foreignKey:UserID"`
+	Pinned    bool       `json:"pinned" gorm:"default:false"`
+	PinnedAt  *time.Time `json:"pinned_at"`
+	PinnedBy  *uuid.UUID `json:"pinned_by" gorm:"type:uuid"`
+	Edited    bool       `json:"edited" gorm:"default:false"`
+	// Mentions are the users mentioned directly and MentionRoles the roles
+	// mentioned, both limited to what the author was allowed to mention.
+	Mentions        []uuid.UUID `json:"mentions" gorm:"serializer:json"`
+	MentionRoles    []uuid.UUID `json:"mention_roles" gorm:"serializer:json"`
+	MentionEveryone bool        `json:"mention_everyone" gorm:"default:false"`
+	CreatedAt       time.Time   `json:"created_at"`
+	UpdatedAt       time.Time   `json:"updated_at"`
+	// Deleted messages are kept as tombstones that only members with
+	// PermissionManageMessages can list.
+	DeletedAt   gorm.DeletedAt `json:"deleted_at" gorm:"index"`
+	DeletedBy   *uuid.UUID     `json:"deleted_by" gorm:"type:uuid"`
+	User        User           `json:"user" gorm:"foreignKey:UserID"`
+	Attachments []Attachment   `json:"attachments" gorm:"foreignKey:MessageID"`
+	// Pinner is the user who pinned the message; only loaded for pin lists.
+	Pinner *User `json:"pinner,omitempty" gorm:"foreignKey:PinnedBy"`
+	// Thread is the thread started from this message, if any.
+	Thread *Thread `json:"thread,omitempty" gorm:"foreignKey:MessageID"`
+	// Member is how the author appears in the channel's realm.
+	Member *MemberProfile `json:"member,omitempty" gorm:"-"`
+	// PublishedAt is set once a message of an announcement channel has been
+	// published to its followers.
+	PublishedAt *time.Time `json:"published_at,omitempty"`
+	// SourceMessageID and Crosspost attribute a crossposted message to the
+	// message it was published from.
+	SourceMessageID *uuid.UUID `json:"source_message_id,omitempty" gorm:"type:uuid"`
+	Crosspost       *Crosspost `json:"crosspost,omitempty" gorm:"serializer:json"`
+}
+
+func (m Message) cursor() Cursor {
+	return Cursor{CreatedAt: m.CreatedAt, ID: m.ID}
 }
 
 type MessageReaction struct {
@@ -35,19 +89,27 @@ type MessageReaction struct {
 }
 
 type Attachment struct {
-	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
-	MessageID uuid.UUID `json:"message_id" gorm:"type:uuid;not null"`
-	Filename  string    `json:"filename" gorm:"not null"`
-	URL       string    `json:"url" gorm:"not null"`
-	Size      int64     `json:"size"`
-	MimeType  string    `json:"mime_type"`
-	CreatedAt time.Time `json:"created_at"`
+	ID           uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	MessageID    uuid.UUID `json:"message_id" gorm:"type:uuid;not null"`
+	Filename     string    `json:"filename" gorm:"not null"`
+	Key          string    `json:"-" gorm:"column:storage_key;not null"`
+	URL          string    `json:"url" gorm:"-"`
+	Size         int64     `json:"size"`
+	MimeType     string    `json:"mime_type"`
+	Width        int       `json:"width,omitempty"`
+	Height       int       `json:"height,omitempty"`
+	BlurHash     string    `json:"blurhash,omitempty" gorm:"column:blurhash"`
+	ThumbnailKey string    `json:"-"`
+	ThumbnailURL string    `json:"thumbnail_url,omitempty" gorm:"-"`
+	CreatedAt    time.Time `json:"created_at"`
 }
 
+// SendMessageRequest is sent as JSON, or as multipart form fields alongside
+// attachments in "files".
 type SendMessageRequest struct {
-	Content  string     `json:"content"`
-	ReplyTo  *uuid.UUID `json:"reply_to"`
-	ThreadID *uuid.UUID `json:"thread_id"`
+	Content  string     `json:"content" form:"content"`
+	ReplyTo  *uuid.UUID `json:"reply_to" form:"reply_to"`
+	ThreadID *uuid.UUID `json:"thread_id" form:"thread_id"`
 }
 
 type EditMessageRequest struct {
@@ -58,12 +120,13 @@ type ReactionRequest struct {
 	Emoji string `json:"emoji"`
 }
 
-func NewMessagesHandler(db *gorm.DB) *MessagesHandler {
-	return &MessagesHandler{db: db}
+func NewMessagesHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver, uploads *Uploader, images *ImageProcessor, notifications *NotificationsHandler) *MessagesHandler {
+	return &MessagesHandler{db: db, hub: hub, perms: perms, uploads: uploads, images: images, notifications: notifications}
 }
 
 func (h *MessagesHandler) SendMessage(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(uuid.UUID)
+	channel := c.Locals("channel").(*Channel)
 	channelID := c.Params("id")
 
 	var req SendMessageRequest
@@ -71,97 +134,285 @@ func (h *MessagesHandler) SendMessage(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	if req.Content == "" {
+	files, err := attachmentFiles(c)
+	if err != nil {
+		return err
+	}
+
+	if req.Content == "" && len(files) == 0 {
 		return c.Status(400).JSON(fiber.Map{"error": "Message content required"})
 	}
 
+	// Slow mode is checked up front to skip the uploads, and again when the
+	// message is stored.
+	slowMode := channel.SlowMode > 0 && !currentMember(c).Has(PermissionManageMessages)
+	if slowMode {
+		wait, err := slowModeWait(h.db, channel, userID)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to send message"})
+		}
+		if wait > 0 {
+			return slowModeRejected(c, wait)
+		}
+	}
+
+	if req.ThreadID != nil {
+		var thread Thread
+		if err := h.db.Where("id = ? AND channel_id = ?", req.ThreadID, channelID).First(&thread).Error; err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Thread not found"})
+		}
+	}
+
+	mentions, err := resolveMentions(h.db, h.perms, channel, currentMember(c), req.Content)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve mentions"})
+	}
+
+	stored, err := h.uploads.SaveAll(c.Context(), "attachments/"+channelID, files, AttachmentPolicy)
+	if err != nil {
+		return err
+	}
+
 	message := Message{
-		ChannelID: uuid.MustParse(channelID),
-		UserID:    userID,
-		Content:   req.Content,
-		ReplyTo:   req.ReplyTo,
-		ThreadID:  req.ThreadID,
+		ChannelID:       uuid.MustParse(channelID),
+		UserID:          userID,
+		Content:         req.Content,
+		ReplyTo:         req.ReplyTo,
+		ThreadID:        req.ThreadID,
+		Mentions:        mentions.Users,
+		MentionRoles:    mentions.Roles,
+		MentionEveryone: mentions.Everyone || mentions.Here,
+	}
+	for _, file := range stored {
+		message.Attachments = append(message.Attachments, Attachment{
+			Filename: file.Filename,
+			Key:      file.Key,
+			Size:     file.Size,
+			MimeType: file.MimeType,
+		})
 	}
 
-	if err := h.db.Create(&message).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to send message"})
+	var wait int
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if slowMode {
+			// Lock the channel so concurrent sends cannot both pass the check.
+			var locked Channel
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&locked, "id = ?", channel.ID).Error; err != nil {
+				return err
+			}
+			var err error
+			if wait, err = slowModeWait(tx, &locked, userID); err != nil || wait > 0 {
+				return err
+			}
+		}
+		return tx.Create(&message).Error
+	})
+	if err != nil || wait > 0 {
+		h.uploads.DeleteAll(c.Context(), stored)
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to send message"})
+		}
+		return slowModeRejected(c, wait)
 	}
 
 	// Load user data
-	h.db.Preload("User").First(&message, message.ID)
+	h.db.Preload("User").Preload("Attachments").First(&message, message.ID)
+	signAttachments(c.Context(), h.uploads, message.Attachments)
+	attachMembers(h.db, &message)
+
+	h.broadcast(message.ChannelID, websocket.EventMessageCreate, message)
+	h.images.ProcessMessage(c.Context(), &message)
+
+	if message.ThreadID != nil {
+		h.updateThread(*message.ThreadID, &userID)
+	}
+	h.notifyMentions(&message, channel, mentions)
 
 	return c.JSON(message)
 }
 
+// slowModeRejected responds that the user must wait before sending again.
+func slowModeRejected(c *fiber.Ctx, wait int) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(wait))
+	return c.Status(429).JSON(fiber.Map{"error": "Slow mode is enabled", "retry_after": wait})
+}
+
 func (h *MessagesHandler) GetMessages(c *fiber.Ctx) error {
 	channelID := c.Params("id")
-	limit := c.QueryInt("limit", 50)
-	before := c.Query("before")
+	withDeleted := currentMember(c).Has(PermissionManageMessages)
 
-	query := h.db.Where("channel_id = ?", channelID).
-		Preload("User").
-		Order("created_at DESC").
-		Limit(limit)
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
 
-	if before != "" {
-		if beforeTime, err := time.Parse(time.RFC3339, before); err == nil {
-			query = query.Where("created_at < ?", beforeTime)
+	messages, info, err := fetchPage[Message](h.db, func(db *gorm.DB) *gorm.DB {
+		if withDeleted {
+			db = db.Unscoped()
 		}
+		return db.Where("channel_id = ? AND thread_id IS NULL", channelID).
+			Preload("User").Preload("Attachments").Preload("Thread")
+	}, page)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
 	}
-
-	var messages []Message
-	if err := query.Find(&messages).Error; err != nil {
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch messages"})
 	}
 
-	// Reverse to show oldest first
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
-	}
+	signMessages(c.Context(), h.uploads, messages)
+	attachMemberList(h.db, messages)
 
+	setPageHeaders(c, info)
 	return c.JSON(messages)
 }
 
 func (h *MessagesHandler) EditMessage(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(uuid.UUID)
-	messageID := c.Params("id")
+	message := c.Locals("message").(*Message)
+	channel := c.Locals("channel").(*Channel)
 
 	var req EditMessageRequest
 	if err := c.BodyParser(&req); err != nil {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	var message Message
-	if err := h.db.Where("id = ? AND user_id = ?", messageID, userID).First(&message).Error; err != nil {
+	if message.UserID != userID || message.Type == MessageTypeSystem || message.Type == MessageTypeCrosspost {
 		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
 	}
 
-	updates := map[string]interface{}{
-		"content": req.Content,
-		"edited":  true,
+	// Edits update who is mentioned but do not notify anyone again.
+	mentions, err := resolveMentions(h.db, h.perms, channel, currentMember(c), req.Content)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve mentions"})
+	}
+
+	// Updated as a struct so the mention lists go through their serializer;
+	// Select lets mention_everyone be cleared.
+	updates := Message{
+		Content:         req.Content,
+		Edited:          true,
+		Mentions:        mentions.Users,
+		MentionRoles:    mentions.Roles,
+		MentionEveryone: mentions.Everyone || mentions.Here,
 	}
 
-	if err := h.db.Model(&message).Updates(updates).Error; err != nil {
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if req.Content != message.Content {
+			if err := recordRevision(tx, message.ID, message.Content); err != nil {
+				return err
+			}
+		}
+		return tx.Model(message).
+			Select("content", "edited", "mentions", "mention_roles", "mention_everyone", "updated_at").
+			Updates(updates).Error
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to edit message"})
 	}
 
+	h.db.Preload("User").Preload("Attachments").First(message, message.ID)
+	signAttachments(c.Context(), h.uploads, message.Attachments)
+	attachMembers(h.db, message)
+	h.broadcast(message.ChannelID, websocket.EventMessageUpdate, message)
+
 	return c.JSON(fiber.Map{"message": "Message updated successfully"})
 }
 
+// DeleteMessage soft-deletes a message, keeping its content and attachments
+// for moderators. Members with PermissionManageMessages may delete messages
+// of others, which is recorded in the moderation log; the reason is taken
+// from the reason query parameter.
 func (h *MessagesHandler) DeleteMessage(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	message := c.Locals("message").(*Message)
+	channel := c.Locals("channel").(*Channel)
+
+	moderated := message.UserID != userID
+	if moderated && !currentMember(c).Has(PermissionManageMessages) {
+		return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+	}
+
+	// Deleted messages drop out of the pins.
+	pinned := message.Pinned
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(message).Updates(map[string]interface{}{
+			"deleted_at": time.Now(),
+			"deleted_by": userID,
+			"pinned":     false,
+			"pinned_at":  nil,
+			"pinned_by":  nil,
+		}).Error; err != nil {
+			return err
+		}
+		if !moderated {
+			return nil
+		}
+		return tx.Create(&ModerationAction{
+			RealmID:     channel.RealmID,
+			UserID:      &message.UserID,
+			ModeratorID: userID,
+			Action:      "message_delete",
+			Reason:      c.Query("reason"),
+			MessageID:   &message.ID,
+		}).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete message"})
+	}
+
+	h.broadcast(message.ChannelID, websocket.EventMessageDelete, fiber.Map{
+		"id":         message.ID,
+		"channel_id": message.ChannelID,
+		"thread_id":  message.ThreadID,
+	})
+
+	if pinned {
+		announcePins(h.db, h.hub, message.ChannelID, message.ID)
+	}
+	if message.ThreadID != nil {
+		h.updateThread(*message.ThreadID, nil)
+	}
+
+	return c.JSON(fiber.Map{"message": "Message deleted successfully"})
+}
+
+// GetMessageHistory returns a message with its earlier versions. Only the
+// author and members with PermissionManageMessages may see it, and only the
+// latter once the message is deleted.
+func (h *MessagesHandler) GetMessageHistory(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(uuid.UUID)
 	messageID := c.Params("id")
 
 	var message Message
-	if err := h.db.Where("id = ? AND user_id = ?", messageID, userID).First(&message).Error; err != nil {
+	if err := h.db.Unscoped().Where("id = ?", messageID).Preload("User").Preload("Attachments").First(&message).Error; err != nil {
 		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
 	}
 
-	if err := h.db.Delete(&message).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete message"})
+	channel, err := findChannel(h.db, message.ChannelID)
+	if err != nil {
+		return err
+	}
+	member, err := h.perms.ResolveChannel(channel, userID)
+	if err != nil || !member.Has(PermissionViewChannels) {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
 	}
 
-	return c.JSON(fiber.Map{"message": "Message deleted successfully"})
+	if !member.Has(PermissionManageMessages) && (message.UserID != userID || message.DeletedAt.Valid) {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if err := checkNSFW(h.db, channel, userID); err != nil {
+		return err
+	}
+
+	revisions, err := messageRevisions(h.db, message.ID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch message history"})
+	}
+	signAttachments(c.Context(), h.uploads, message.Attachments)
+	attachMembers(h.db, &message)
+
+	return c.JSON(MessageHistory{Message: message, Revisions: revisions})
 }
 
 func (h *MessagesHandler) AddReaction(c *fiber.Ctx) error {
@@ -173,6 +424,8 @@ func (h *MessagesHandler) AddReaction(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
+	message := c.Locals("message").(*Message)
+
 	// Check if reaction already exists
 	var existing MessageReaction
 	if err := h.db.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, req.Emoji).First(&existing).Error; err == nil {
@@ -189,6 +442,14 @@ func (h *MessagesHandler) AddReaction(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to add reaction"})
 	}
 
+	h.broadcast(message.ChannelID, websocket.EventReactionAdd, fiber.Map{
+		"id":         reaction.ID,
+		"message_id": message.ID,
+		"channel_id": message.ChannelID,
+		"user_id":    userID,
+		"emoji":      reaction.Emoji,
+	})
+
 	return c.JSON(fiber.Map{"message": "Reaction added successfully"})
 }
 
@@ -197,9 +458,107 @@ func (h *MessagesHandler) RemoveReaction(c *fiber.Ctx) error {
 	messageID := c.Params("messageId")
 	emoji := c.Params("emoji")
 
-	if err := h.db.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).Delete(&MessageReaction{}).Error; err != nil {
+	message := c.Locals("message").(*Message)
+
+	result := h.db.Where("message_id = ? AND user_id = ? AND emoji = ?", messageID, userID, emoji).Delete(&MessageReaction{})
+	if result.Error != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to remove reaction"})
 	}
 
+	if result.RowsAffected > 0 {
+		h.broadcast(message.ChannelID, websocket.EventReactionRemove, fiber.Map{
+			"message_id": message.ID,
+			"channel_id": message.ChannelID,
+			"user_id":    userID,
+			"emoji":      emoji,
+		})
+	}
+
 	return c.JSON(fiber.Map{"message": "Reaction removed successfully"})
-}
\ No newline at end of file
+}
+
+// broadcast pushes a message event to every client subscribed to the channel.
+func (h *MessagesHandler) broadcast(channelID uuid.UUID, eventType string, data interface{}) {
+	h.hub.BroadcastToChannel(channelID, websocket.WSMessage{
+		Type:      eventType,
+		Data:      data,
+		ChannelID: &channelID,
+	})
+}
+
+// notifyMentions creates a mention notification for everyone message
+// mentions.
+func (h *MessagesHandler) notifyMentions(message *Message, channel *Channel, mentions *mentionSet) {
+	recipients, err := mentions.recipients(h.db, h.perms, channel, message.UserID)
+	if err != nil {
+		log.Printf("Failed to resolve mentions of %s: %v", message.ID, err)
+		return
+	}
+	if len(recipients) == 0 {
+		return
+	}
+
+	data, _ := json.Marshal(mentionData{
+		MessageID: message.ID,
+		ChannelID: channel.ID,
+		RealmID:   channel.RealmID,
+		AuthorID:  message.UserID,
+	})
+	title := fmt.Sprintf("%s mentioned you in #%s", message.User.Username, channel.Name)
+
+	if err := h.notifications.CreateNotifications(recipients, NotificationTypeMention, title, preview(message.Content), string(data)); err != nil {
+		log.Printf("Failed to notify mentions of %s: %v", message.ID, err)
+	}
+}
+
+// updateThread refreshes the reply summary of a thread after one of its
+// replies was sent by author or, when author is nil, deleted.
+func (h *MessagesHandler) updateThread(threadID uuid.UUID, author *uuid.UUID) {
+	thread, err := refreshThread(h.db, threadID, author != nil)
+	if err != nil {
+		log.Printf("Failed to update thread %s: %v", threadID, err)
+		return
+	}
+
+	if author != nil {
+		if joined, err := joinThread(h.db, threadID, *author); err == nil && joined {
+			broadcastThreadMember(h.hub, thread, *author, true)
+		}
+	}
+
+	h.broadcast(thread.ChannelID, websocket.EventThreadUpdate, thread)
+}
+
+// attachmentFiles returns the files of a multipart request, if any.
+func attachmentFiles(c *fiber.Ctx) ([]*multipart.FileHeader, error) {
+	if !strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		return nil, nil
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid multipart form")
+	}
+
+	files := form.File["files"]
+	if len(files) > MaxAttachmentsPerMessage {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Too many attachments")
+	}
+	return files, nil
+}
+
+// signAttachments fills in the download URLs of loaded attachments.
+func signAttachments(ctx context.Context, u *Uploader, attachments []Attachment) {
+	for i := range attachments {
+		attachments[i].URL = u.URL(ctx, attachments[i].Key, attachments[i].MimeType)
+		if attachments[i].ThumbnailKey != "" {
+			attachments[i].ThumbnailURL = u.ImageURL(ctx, attachments[i].ThumbnailKey)
+		}
+	}
+}
+
+func signMessages(ctx context.Context, u *Uploader, messages []Message) {
+	for i := range messages {
+		signAttachments(ctx, u, messages[i].Attachments)
+	}
+}
@@ -1,26 +1,44 @@
 package handlers
 
 import (
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"log"
 	"time"
 )
 
+// MaxTimeoutMinutes caps the duration of a timeout at 28 days.
+const MaxTimeoutMinutes = 28 * 24 * 60
+
 type ModerationHandler struct {
-	db *gorm.DB
+	db    *gorm.DB
+	hub   *websocket.Hub
+	perms *PermissionResolver
 }
 
 type ModerationAction struct {
 	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	RealmID   uuid.UUID `json:"realm_id" gorm:"type:uuid;not null"`
-	UserID    uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
+	// UserID is the member acted on; it is empty for actions on many
+	// members at once, such as purges.
+	UserID    *uuid.UUID `json:"user_id" gorm:"type:uuid"`
 	ModeratorID uuid.UUID `json:"moderator_id" gorm:"type:uuid;not null"`
 	Action    string    `json:"action" gorm:"not null"`
 	Reason    string    `json:"reason"`
 	ExpiresAt *time.Time `json:"expires_at"`
+	// LiftedAt is set once a ban or timeout expired or was revoked.
+	LiftedAt  *time.Time `json:"lifted_at"`
+	// MessageID is the message a message_delete action removed.
+	MessageID *uuid.UUID `json:"message_id,omitempty" gorm:"type:uuid"`
+	// ChannelID and Count describe message_bulk_delete and message_purge
+	// actions.
+	ChannelID *uuid.UUID `json:"channel_id,omitempty" gorm:"type:uuid"`
+	Count     int        `json:"count,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
-	User      User      `json:"user" gorm:"foreignKey:UserID"`
+	User      *User     `json:"user,omitempty" gorm:"foreignKey:UserID"`
 	Moderator User      `json:"moderator" gorm:"foreignKey:ModeratorID"`
 }
 
@@ -38,8 +56,8 @@ type TimeoutRequest struct {
 	Duration int    `json:"duration"` // minutes
 }
 
-func NewModerationHandler(db *gorm.DB) *ModerationHandler {
-	return &ModerationHandler{db: db}
+func NewModerationHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver) *ModerationHandler {
+	return &ModerationHandler{db: db, hub: hub, perms: perms}
 }
 
 func (h *ModerationHandler) KickMember(c *fiber.Ctx) error {
@@ -52,18 +70,28 @@ func (h *ModerationHandler) KickMember(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	// Remove from realm members
-	if err := h.db.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&struct {
-		RealmID uuid.UUID `gorm:"column:realm_id"`
-		UserID  uuid.UUID `gorm:"column:user_id"`
-	}{}).Error; err != nil {
+	targetID, err := h.checkTarget(c, userID)
+	if err != nil {
+		return err
+	}
+
+	// Remove from realm members, along with the member's roles
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&MemberRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&RealmMember{}).Error
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to kick member"})
 	}
 
+	h.evict(uuid.MustParse(realmID), targetID)
+
 	// Log moderation action
 	action := ModerationAction{
 		RealmID:     uuid.MustParse(realmID),
-		UserID:      uuid.MustParse(userID),
+		UserID:      &targetID,
 		ModeratorID: moderatorID,
 		Action:      "kick",
 		Reason:      req.Reason,
@@ -84,32 +112,43 @@ func (h *ModerationHandler) BanMember(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
+	targetID, err := h.checkTarget(c, userID)
+	if err != nil {
+		return err
+	}
+
 	var expiresAt *time.Time
 	if req.Duration > 0 {
 		expiry := time.Now().Add(time.Duration(req.Duration) * time.Hour)
 		expiresAt = &expiry
 	}
 
-	// Remove from realm members
-	h.db.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&struct {
-		RealmID uuid.UUID `gorm:"column:realm_id"`
-		UserID  uuid.UUID `gorm:"column:user_id"`
-	}{})
-
 	// Log moderation action
 	action := ModerationAction{
 		RealmID:     uuid.MustParse(realmID),
-		UserID:      uuid.MustParse(userID),
+		UserID:      &targetID,
 		ModeratorID: moderatorID,
-		Action:      "ban",
+		Action:      ActionBan,
 		Reason:      req.Reason,
 		ExpiresAt:   expiresAt,
 	}
 
-	if err := h.db.Create(&action).Error; err != nil {
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&action).Error; err != nil {
+			return err
+		}
+		// Roles would otherwise come back if the user rejoins after the ban.
+		if err := tx.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&MemberRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&RealmMember{}).Error
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to ban member"})
 	}
 
+	h.evict(action.RealmID, targetID)
+
 	return c.JSON(fiber.Map{"message": "Member banned successfully"})
 }
 
@@ -123,13 +162,22 @@ func (h *ModerationHandler) TimeoutMember(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
+	targetID, err := h.checkTarget(c, userID)
+	if err != nil {
+		return err
+	}
+
+	if req.Duration <= 0 || req.Duration > MaxTimeoutMinutes {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid timeout duration"})
+	}
+
 	expiresAt := time.Now().Add(time.Duration(req.Duration) * time.Minute)
 
 	action := ModerationAction{
 		RealmID:     uuid.MustParse(realmID),
-		UserID:      uuid.MustParse(userID),
+		UserID:      &targetID,
 		ModeratorID: moderatorID,
-		Action:      "timeout",
+		Action:      ActionTimeout,
 		Reason:      req.Reason,
 		ExpiresAt:   &expiresAt,
 	}
@@ -138,6 +186,9 @@ func (h *ModerationHandler) TimeoutMember(c *fiber.Ctx) error {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to timeout member"})
 	}
 
+	h.disconnectVoice(action.RealmID, targetID)
+	h.broadcastTimeout(action.RealmID, targetID, &expiresAt)
+
 	return c.JSON(fiber.Map{"message": "Member timed out successfully"})
 }
 
@@ -146,15 +197,22 @@ func (h *ModerationHandler) UnbanMember(c *fiber.Ctx) error {
 	realmID := c.Params("realmId")
 	userID := c.Params("userId")
 
-	// Remove active ban
-	if err := h.db.Where("realm_id = ? AND user_id = ? AND action = ?", realmID, userID, "ban").Delete(&ModerationAction{}).Error; err != nil {
+	targetID, err := h.checkTarget(c, userID)
+	if err != nil {
+		return err
+	}
+
+	// Lift active bans, keeping them in the log
+	if err := h.db.Model(&ModerationAction{}).
+		Where("realm_id = ? AND user_id = ? AND action = ? AND lifted_at IS NULL", realmID, userID, ActionBan).
+		Update("lifted_at", time.Now()).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to unban member"})
 	}
 
 	// Log unban action
 	action := ModerationAction{
 		RealmID:     uuid.MustParse(realmID),
-		UserID:      uuid.MustParse(userID),
+		UserID:      &targetID,
 		ModeratorID: moderatorID,
 		Action:      "unban",
 	}
@@ -179,4 +237,83 @@ func (h *ModerationHandler) GetModerationLog(c *fiber.Ctx) error {
 	}
 
 	return c.JSON(actions)
+}
+
+// RunExpiry lifts expired bans and timeouts every interval. It never
+// returns.
+func (h *ModerationHandler) RunExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.ExpireSanctions(); err != nil {
+			log.Printf("Failed to expire sanctions: %v", err)
+		}
+	}
+}
+
+// ExpireSanctions marks bans and timeouts past their expiry as lifted and
+// announces the end of timeouts. Permissions already ignore expired
+// sanctions; this keeps the log accurate and clients informed. Only the
+// node whose update lifted a timeout announces it.
+func (h *ModerationHandler) ExpireSanctions() error {
+	var expired []ModerationAction
+	err := h.db.Model(&expired).Clauses(clause.Returning{}).
+		Where("action IN ? AND lifted_at IS NULL AND expires_at <= NOW()", []string{ActionBan, ActionTimeout}).
+		Update("lifted_at", gorm.Expr("NOW()")).Error
+	if err != nil {
+		return err
+	}
+
+	for _, action := range expired {
+		if action.Action != ActionTimeout || action.UserID == nil {
+			continue
+		}
+		// A longer timeout may still be running.
+		if timeout, err := activeSanction(h.db, action.RealmID, *action.UserID, ActionTimeout); err != nil || timeout != nil {
+			continue
+		}
+		h.broadcastTimeout(action.RealmID, *action.UserID, nil)
+	}
+	return nil
+}
+
+// evict drops a user removed from a realm from its hub subscriptions and
+// voice channels.
+func (h *ModerationHandler) evict(realmID, userID uuid.UUID) {
+	h.hub.EvictMembers(realmID, userID)
+	h.disconnectVoice(realmID, userID)
+}
+
+// disconnectVoice removes a user from the voice channels of a realm.
+func (h *ModerationHandler) disconnectVoice(realmID, userID uuid.UUID) {
+	if err := h.db.Where("user_id = ? AND channel_id IN (?)", userID,
+		h.db.Model(&Channel{}).Select("id").Where("realm_id = ?", realmID)).
+		Delete(&VoiceState{}).Error; err != nil {
+		log.Printf("Failed to disconnect %s from voice in %s: %v", userID, realmID, err)
+	}
+}
+
+// broadcastTimeout tells a realm that a member is timed out until the given
+// time, or no longer when until is nil.
+func (h *ModerationHandler) broadcastTimeout(realmID, userID uuid.UUID, until *time.Time) {
+	h.hub.BroadcastToRealm(realmID, websocket.WSMessage{
+		Type: websocket.EventMemberTimeoutUpdate,
+		Data: fiber.Map{
+			"realm_id":        realmID,
+			"user_id":         userID,
+			"timed_out_until": until,
+		},
+		RealmID: &realmID,
+	})
+}
+
+// checkTarget enforces the role hierarchy between the moderator and the
+// target, returning the parsed target ID.
+func (h *ModerationHandler) checkTarget(c *fiber.Ctx, userID string) (uuid.UUID, error) {
+	targetID, err := uuid.Parse(userID)
+	if err != nil {
+		return uuid.Nil, fiber.NewError(400, "Invalid user ID")
+	}
+	return targetID, h.perms.CheckTarget(currentMember(c), targetID)
 }
\ No newline at end of file
@@ -1,14 +1,18 @@
 package handlers
 
 import (
+	"errors"
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"slices"
 	"time"
 )
 
 type NotificationsHandler struct {
-	db *gorm.DB
+	db  *gorm.DB
+	hub *websocket.Hub
 }
 
 type Notification struct {
@@ -22,22 +26,37 @@ type Notification struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
-func NewNotificationsHandler(db *gorm.DB) *NotificationsHandler {
-	return &NotificationsHandler{db: db}
+func (n Notification) cursor() Cursor {
+	return Cursor{CreatedAt: n.CreatedAt, ID: n.ID}
+}
+
+func NewNotificationsHandler(db *gorm.DB, hub *websocket.Hub) *NotificationsHandler {
+	return &NotificationsHandler{db: db, hub: hub}
 }
 
 func (h *NotificationsHandler) GetNotifications(c *fiber.Ctx) error {
 	userID := c.Locals("userID").(uuid.UUID)
-	limit := c.QueryInt("limit", 50)
 
-	var notifications []Notification
-	if err := h.db.Where("user_id = ?", userID).
-		Order("created_at DESC").
-		Limit(limit).
-		Find(&notifications).Error; err != nil {
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+
+	notifications, info, err := fetchPage[Notification](h.db, func(db *gorm.DB) *gorm.DB {
+		return db.Where("user_id = ?", userID)
+	}, page)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Notification not found"})
+	}
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch notifications"})
 	}
 
+	// Notifications are listed newest first; the page cursors still lead to
+	// older (before) and newer (after) notifications.
+	slices.Reverse(notifications)
+
+	setPageHeaders(c, info)
 	return c.JSON(notifications)
 }
 
@@ -79,14 +98,38 @@ func (h *NotificationsHandler) GetUnreadCount(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{"count": count})
 }
 
+// CreateNotification stores a notification and pushes it to the user.
 func (h *NotificationsHandler) CreateNotification(userID uuid.UUID, notifType, title, message, data string) error {
-	notification := Notification{
-		UserID:  userID,
-		Type:    notifType,
-		Title:   title,
-		Message: message,
-		Data:    data,
+	return h.CreateNotifications([]uuid.UUID{userID}, notifType, title, message, data)
+}
+
+// CreateNotifications stores the same notification for each user and pushes
+// it to them.
+func (h *NotificationsHandler) CreateNotifications(userIDs []uuid.UUID, notifType, title, message, data string) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	notifications := make([]Notification, len(userIDs))
+	for i, userID := range userIDs {
+		notifications[i] = Notification{
+			UserID:  userID,
+			Type:    notifType,
+			Title:   title,
+			Message: message,
+			Data:    data,
+		}
 	}
 
-	return h.db.Create(&notification).Error
-}
\ No newline at end of file
+	if err := h.db.CreateInBatches(&notifications, 500).Error; err != nil {
+		return err
+	}
+
+	for _, notification := range notifications {
+		h.hub.BroadcastToUser(notification.UserID, websocket.WSMessage{
+			Type: websocket.EventNotificationCreate,
+			Data: notification,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultPageLimit = 50
+	MaxPageLimit     = 100
+
+	// Cursors for the neighbouring pages are returned in headers so list
+	// endpoints keep returning plain arrays.
+	HeaderCursorBefore = "X-Cursor-Before"
+	HeaderCursorAfter  = "X-Cursor-After"
+)
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Cursor is a position in a list ordered by (created_at, id). The ID breaks
+// ties between rows sharing a timestamp.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        uuid.UUID
+}
+
+func (c Cursor) Encode() string {
+	raw := c.CreatedAt.UTC().Format(time.RFC3339Nano) + "|" + c.ID.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, errInvalidCursor
+	}
+
+	ts, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return Cursor{}, errInvalidCursor
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, ts)
+	if err != nil {
+		return Cursor{}, errInvalidCursor
+	}
+	cursorID, err := uuid.Parse(id)
+	if err != nil {
+		return Cursor{}, errInvalidCursor
+	}
+
+	return Cursor{CreatedAt: createdAt, ID: cursorID}, nil
+}
+
+// cursorable is implemented by the models served through paginated endpoints.
+type cursorable interface {
+	cursor() Cursor
+}
+
+// PageRequest selects a page: the newest items, items strictly before or
+// after a cursor, or items centred on an anchor ID.
+type PageRequest struct {
+	Limit  int
+	Before *Cursor
+	After  *Cursor
+	Around *uuid.UUID
+}
+
+// PageInfo holds the cursors of the neighbouring pages. A cursor is empty
+// when there is nothing further in that direction.
+//
+// Directions are chronological whatever order an endpoint returns its items
+// in: Before leads to older items and After to newer ones. Endpoints listing
+// newest first reverse the items fetchPage returns but keep its PageInfo.
+type PageInfo struct {
+	Before string
+	After  string
+}
+
+// parsePage reads limit, before, after and around from the query string. At
+// most one of before, after and around may be given.
+func parsePage(c *fiber.Ctx) (*PageRequest, error) {
+	page := &PageRequest{Limit: c.QueryInt("limit", DefaultPageLimit)}
+	if page.Limit <= 0 {
+		page.Limit = DefaultPageLimit
+	}
+	if page.Limit > MaxPageLimit {
+		page.Limit = MaxPageLimit
+	}
+
+	anchors := 0
+	if before := c.Query("before"); before != "" {
+		cursor, err := DecodeCursor(before)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid before cursor")
+		}
+		page.Before = &cursor
+		anchors++
+	}
+	if after := c.Query("after"); after != "" {
+		cursor, err := DecodeCursor(after)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid after cursor")
+		}
+		page.After = &cursor
+		anchors++
+	}
+	if around := c.Query("around"); around != "" {
+		id, err := uuid.Parse(around)
+		if err != nil {
+			return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid around ID")
+		}
+		page.Around = &id
+		anchors++
+	}
+	if anchors > 1 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Only one of before, after and around may be set")
+	}
+
+	return page, nil
+}
+
+// fetchPage loads one page of the rows matched by scope, oldest first. When
+// page.Around is set and no row in scope has that ID it returns
+// gorm.ErrRecordNotFound.
+func fetchPage[T cursorable](db *gorm.DB, scope func(*gorm.DB) *gorm.DB, page *PageRequest) ([]T, *PageInfo, error) {
+	return paginate[T](dbPages[T]{db: db, scope: scope}, page)
+}
+
+// pageSource loads rows ordered by (created_at, id) for paginate.
+type pageSource[T cursorable] interface {
+	// find returns the row with the given ID.
+	find(id uuid.UUID) (T, error)
+	// before returns up to limit rows strictly before cursor, or the newest
+	// rows when cursor is nil, oldest first, and whether more rows precede
+	// them.
+	before(cursor *Cursor, limit int) ([]T, bool, error)
+	// after returns up to limit rows after cursor, oldest first, and whether
+	// more rows follow them.
+	after(cursor Cursor, inclusive bool, limit int) ([]T, bool, error)
+}
+
+// paginate selects the page requested by page from source.
+func paginate[T cursorable](source pageSource[T], page *PageRequest) ([]T, *PageInfo, error) {
+	switch {
+	case page.After != nil:
+		items, more, err := source.after(*page.After, false, page.Limit)
+		if err != nil {
+			return nil, nil, err
+		}
+		// Anything after a cursor means there is something before it too.
+		return items, pageInfo(items, true, more), nil
+
+	case page.Around != nil:
+		anchor, err := source.find(*page.Around)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		cursor := anchor.cursor()
+		older, moreBefore, err := source.before(&cursor, page.Limit/2)
+		if err != nil {
+			return nil, nil, err
+		}
+		newer, moreAfter, err := source.after(cursor, true, page.Limit-len(older))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		items := append(older, newer...)
+		return items, pageInfo(items, moreBefore, moreAfter), nil
+
+	default:
+		items, more, err := source.before(page.Before, page.Limit)
+		if err != nil {
+			return nil, nil, err
+		}
+		return items, pageInfo(items, more, page.Before != nil), nil
+	}
+}
+
+// dbPages is the pageSource of the rows matched by scope.
+type dbPages[T cursorable] struct {
+	db    *gorm.DB
+	scope func(*gorm.DB) *gorm.DB
+}
+
+func (p dbPages[T]) find(id uuid.UUID) (T, error) {
+	var item T
+	err := p.db.Scopes(p.scope).Where("id = ?", id).First(&item).Error
+	return item, err
+}
+
+func (p dbPages[T]) before(cursor *Cursor, limit int) ([]T, bool, error) {
+	// A limit of zero still looks one row ahead, so an around page of one
+	// item only reports older rows that exist.
+	query := p.db.Scopes(p.scope)
+	if cursor != nil {
+		query = query.Where("(created_at, id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+	}
+
+	var items []T
+	err := query.
+		Order("created_at DESC, id DESC").
+		Limit(limit + 1).
+		Find(&items).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	more := len(items) > limit
+	if more {
+		items = items[:limit]
+	}
+	slices.Reverse(items)
+	return items, more, nil
+}
+
+func (p dbPages[T]) after(cursor Cursor, inclusive bool, limit int) ([]T, bool, error) {
+	op := ">"
+	if inclusive {
+		op = ">="
+	}
+
+	var items []T
+	err := p.db.Scopes(p.scope).
+		Where("(created_at, id) "+op+" (?, ?)", cursor.CreatedAt, cursor.ID).
+		Order("created_at ASC, id ASC").
+		Limit(limit + 1).
+		Find(&items).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	more := len(items) > limit
+	if more {
+		items = items[:limit]
+	}
+	return items, more, nil
+}
+
+func pageInfo[T cursorable](items []T, moreBefore, moreAfter bool) *PageInfo {
+	info := &PageInfo{}
+	if len(items) == 0 {
+		return info
+	}
+	if moreBefore {
+		info.Before = items[0].cursor().Encode()
+	}
+	if moreAfter {
+		info.After = items[len(items)-1].cursor().Encode()
+	}
+	return info
+}
+
+// setPageHeaders returns the cursors of info, older items in
+// HeaderCursorBefore and newer ones in HeaderCursorAfter.
+func setPageHeaders(c *fiber.Ctx, info *PageInfo) {
+	if info.Before != "" {
+		c.Set(HeaderCursorBefore, info.Before)
+	}
+	if info.After != "" {
+		c.Set(HeaderCursorAfter, info.After)
+	}
+}
@@ -0,0 +1,253 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	zone := time.FixedZone("UTC+5:30", 5*3600+1800)
+	cursor := Cursor{CreatedAt: time.Date(2024, 2, 29, 23, 59, 59, 123456789, zone), ID: uuid.New()}
+
+	decoded, err := DecodeCursor(cursor.Encode())
+	if err != nil {
+		t.Fatalf("DecodeCursor failed: %v", err)
+	}
+	if !decoded.CreatedAt.Equal(cursor.CreatedAt) || decoded.ID != cursor.ID {
+		t.Fatalf("expected %v, got %v", cursor, decoded)
+	}
+}
+
+func TestDecodeCursorRejectsInvalid(t *testing.T) {
+	encode := func(raw string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(raw))
+	}
+
+	tests := []struct {
+		name   string
+		cursor string
+	}{
+		{"not base64", "not base64!"},
+		{"no separator", encode("2024-01-01T00:00:00Z")},
+		{"bad timestamp", encode("yesterday|" + uuid.NewString())},
+		{"bad ID", encode("2024-01-01T00:00:00Z|42")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeCursor(tt.cursor); !errors.Is(err, errInvalidCursor) {
+				t.Fatalf("expected errInvalidCursor, got %v", err)
+			}
+		})
+	}
+}
+
+func TestParsePage(t *testing.T) {
+	var page *PageRequest
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		var err error
+		page, err = parsePage(c)
+		if err != nil {
+			return err
+		}
+		return c.SendStatus(204)
+	})
+
+	cursor := Cursor{CreatedAt: time.Now(), ID: uuid.New()}.Encode()
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		limit  int
+	}{
+		{"defaults", "", 204, DefaultPageLimit},
+		{"limit", "?limit=10", 204, 10},
+		{"limit clamped", "?limit=1000", 204, MaxPageLimit},
+		{"non-positive limit", "?limit=-1", 204, DefaultPageLimit},
+		{"before", "?before=" + cursor, 204, DefaultPageLimit},
+		{"around", "?around=" + uuid.NewString(), 204, DefaultPageLimit},
+		{"invalid before", "?before=nope", 400, 0},
+		{"invalid around", "?around=nope", 400, 0},
+		{"two anchors", "?before=" + cursor + "&after=" + cursor, 400, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page = nil
+			resp, err := app.Test(httptest.NewRequest("GET", "/"+tt.query, nil))
+			if err != nil {
+				t.Fatalf("request failed: %v", err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %d", tt.status, resp.StatusCode)
+			}
+			if tt.status == 204 && page.Limit != tt.limit {
+				t.Fatalf("expected limit %d, got %d", tt.limit, page.Limit)
+			}
+		})
+	}
+}
+
+type pageItem struct {
+	Cursor
+}
+
+func (i pageItem) cursor() Cursor {
+	return i.Cursor
+}
+
+func cursorLess(a, b Cursor) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return bytes.Compare(a.ID[:], b.ID[:]) < 0
+}
+
+// slicePages is a pageSource over items sorted by (created_at, id).
+type slicePages []pageItem
+
+func (s slicePages) find(id uuid.UUID) (pageItem, error) {
+	for _, item := range s {
+		if item.ID == id {
+			return item, nil
+		}
+	}
+	return pageItem{}, gorm.ErrRecordNotFound
+}
+
+func (s slicePages) before(cursor *Cursor, limit int) ([]pageItem, bool, error) {
+	end := len(s)
+	if cursor != nil {
+		end = slices.IndexFunc(s, func(item pageItem) bool { return !cursorLess(item.Cursor, *cursor) })
+		if end < 0 {
+			end = len(s)
+		}
+	}
+	start := max(0, end-limit)
+	return slices.Clone(s[start:end]), start > 0, nil
+}
+
+func (s slicePages) after(cursor Cursor, inclusive bool, limit int) ([]pageItem, bool, error) {
+	start := slices.IndexFunc(s, func(item pageItem) bool {
+		return cursorLess(cursor, item.Cursor) || (inclusive && item.Cursor == cursor)
+	})
+	if start < 0 {
+		return nil, false, nil
+	}
+	end := min(len(s), start+limit)
+	return slices.Clone(s[start:end]), end < len(s), nil
+}
+
+func TestPaginate(t *testing.T) {
+	// Ten items, two per timestamp so the ID has to break ties.
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var items slicePages
+	for i := 0; i < 10; i++ {
+		items = append(items, pageItem{Cursor{CreatedAt: base.Add(time.Duration(i/2) * time.Minute), ID: uuid.New()}})
+	}
+	slices.SortFunc(items, func(a, b pageItem) int {
+		if cursorLess(a.Cursor, b.Cursor) {
+			return -1
+		}
+		return 1
+	})
+
+	at := func(i int) *Cursor { return &items[i].Cursor }
+	encoded := func(i int) string {
+		if i < 0 {
+			return ""
+		}
+		return items[i].Encode()
+	}
+
+	tests := []struct {
+		name string
+		page PageRequest
+		// first and last are the indexes of the expected items; before and
+		// after those of the expected cursors, -1 for none.
+		first, last   int
+		before, after int
+	}{
+		{"latest", PageRequest{Limit: 3}, 7, 9, 7, -1},
+		{"latest fits", PageRequest{Limit: 20}, 0, 9, -1, -1},
+		{"before", PageRequest{Limit: 3, Before: at(7)}, 4, 6, 4, 6},
+		{"before reaches the start", PageRequest{Limit: 3, Before: at(2)}, 0, 1, -1, 1},
+		{"after", PageRequest{Limit: 3, After: at(2)}, 3, 5, 3, 5},
+		{"after reaches the end", PageRequest{Limit: 3, After: at(7)}, 8, 9, 8, -1},
+		{"around", PageRequest{Limit: 4, Around: &items[5].ID}, 3, 6, 3, 6},
+		{"around the start", PageRequest{Limit: 4, Around: &items[0].ID}, 0, 3, -1, 3},
+		{"around the end", PageRequest{Limit: 4, Around: &items[9].ID}, 7, 9, 7, -1},
+		{"around one", PageRequest{Limit: 1, Around: &items[5].ID}, 5, 5, 5, 5},
+		{"around one at the start", PageRequest{Limit: 1, Around: &items[0].ID}, 0, 0, -1, 0},
+		{"around one at the end", PageRequest{Limit: 1, Around: &items[9].ID}, 9, 9, 9, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, info, err := paginate[pageItem](items, &tt.page)
+			if err != nil {
+				t.Fatalf("paginate failed: %v", err)
+			}
+			if want := items[tt.first : tt.last+1]; !slices.Equal(got, want) {
+				t.Fatalf("expected items %d to %d, got %d items", tt.first, tt.last, len(got))
+			}
+			if info.Before != encoded(tt.before) {
+				t.Fatalf("expected the before cursor of item %d, got %q", tt.before, info.Before)
+			}
+			if info.After != encoded(tt.after) {
+				t.Fatalf("expected the after cursor of item %d, got %q", tt.after, info.After)
+			}
+		})
+	}
+
+	t.Run("unknown anchor", func(t *testing.T) {
+		missing := uuid.New()
+		if _, _, err := paginate[pageItem](items, &PageRequest{Limit: 4, Around: &missing}); !errors.Is(err, gorm.ErrRecordNotFound) {
+			t.Fatalf("expected gorm.ErrRecordNotFound, got %v", err)
+		}
+	})
+}
+
+// TestNewestFirstPageCursors checks that reversing a page for a newest first
+// listing keeps its cursors chronological.
+func TestNewestFirstPageCursors(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var items slicePages
+	for i := 0; i < 5; i++ {
+		items = append(items, pageItem{Cursor{CreatedAt: base.Add(time.Duration(i) * time.Minute), ID: uuid.New()}})
+	}
+
+	page, info, err := paginate[pageItem](items, &PageRequest{Limit: 2, Before: &items[4].Cursor})
+	if err != nil {
+		t.Fatalf("paginate failed: %v", err)
+	}
+	slices.Reverse(page)
+
+	app := fiber.New()
+	app.Get("/", func(c *fiber.Ctx) error {
+		setPageHeaders(c, info)
+		return c.SendStatus(204)
+	})
+	resp, err := app.Test(httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	// The oldest item of the page is now last, but before still leads to
+	// older items and after to newer ones.
+	older, err := DecodeCursor(resp.Header.Get(HeaderCursorBefore))
+	if err != nil || older != page[len(page)-1].Cursor {
+		t.Fatalf("expected the before cursor at the oldest item, got %v (%v)", older, err)
+	}
+	newer, err := DecodeCursor(resp.Header.Get(HeaderCursorAfter))
+	if err != nil || newer != page[0].Cursor {
+		t.Fatalf("expected the after cursor at the newest item, got %v (%v)", newer, err)
+	}
+}
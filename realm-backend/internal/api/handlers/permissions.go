@@ -0,0 +1,478 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var ErrNotRealmMember = errors.New("user is not a member of this realm")
+
+// MemberPermissions is a member's effective permission set within a realm.
+type MemberPermissions struct {
+	RealmID     uuid.UUID `json:"realm_id"`
+	UserID      uuid.UUID `json:"user_id"`
+	Owner       bool      `json:"owner"`
+	Permissions int64     `json:"permissions"`
+	// HighestPosition is the position of the member's top role, -1 when the
+	// member has no roles, -2 for non-members and math.MaxInt for the realm
+	// owner.
+	HighestPosition int         `json:"highest_position"`
+	RoleIDs         []uuid.UUID `json:"role_ids"`
+	// TimedOutUntil is set while the member is timed out.
+	TimedOutUntil *time.Time `json:"timed_out_until,omitempty"`
+}
+
+func (m *MemberPermissions) Has(perm int64) bool {
+	return m.Permissions&perm == perm
+}
+
+// Outranks reports whether m may moderate or manage the target member.
+func (m *MemberPermissions) Outranks(target *MemberPermissions) bool {
+	if target.Owner || m.UserID == target.UserID {
+		return false
+	}
+	return m.HighestPosition > target.HighestPosition
+}
+
+// CanManageRole reports whether m is placed above a role at the given position.
+func (m *MemberPermissions) CanManageRole(position int) bool {
+	return m.HighestPosition > position
+}
+
+type PermissionResolver struct {
+	db *gorm.DB
+}
+
+func NewPermissionResolver(db *gorm.DB) *PermissionResolver {
+	return &PermissionResolver{db: db}
+}
+
+// Resolve computes the effective permissions of a user within a realm.
+func (r *PermissionResolver) Resolve(realmID, userID uuid.UUID) (*MemberPermissions, error) {
+	var realm Realm
+	if err := r.db.Where("id = ?", realmID).First(&realm).Error; err != nil {
+		return nil, err
+	}
+
+	var member RealmMember
+	if err := r.db.Where("realm_id = ? AND user_id = ?", realmID, userID).First(&member).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNotRealmMember
+		}
+		return nil, err
+	}
+
+	var roles []Role
+	if err := r.db.Joins("JOIN member_roles ON member_roles.role_id = roles.id").
+		Where("member_roles.realm_id = ? AND member_roles.user_id = ?", realmID, userID).
+		Find(&roles).Error; err != nil {
+		return nil, err
+	}
+
+	timeout, err := activeSanction(r.db, realmID, userID, ActionTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	perms := memberPermissions(&realm, userID, roles)
+	if timeout != nil {
+		perms.applyTimeout(timeout.ExpiresAt)
+	}
+	return perms, nil
+}
+
+// memberPermissions combines the roles of a realm member into their
+// effective permissions.
+func memberPermissions(realm *Realm, userID uuid.UUID, roles []Role) *MemberPermissions {
+	perms := &MemberPermissions{
+		RealmID:         realm.ID,
+		UserID:          userID,
+		Permissions:     DefaultPermissions,
+		HighestPosition: -1,
+	}
+
+	if realm.OwnerID == userID {
+		perms.Owner = true
+		perms.Permissions = PermissionAll
+		perms.HighestPosition = math.MaxInt
+		return perms
+	}
+
+	for _, role := range roles {
+		perms.RoleIDs = append(perms.RoleIDs, role.ID)
+		perms.Permissions |= role.Permissions
+		if role.Position > perms.HighestPosition {
+			perms.HighestPosition = role.Position
+		}
+	}
+
+	if perms.Permissions&PermissionAdministrator != 0 {
+		perms.Permissions = PermissionAll
+	}
+
+	return perms
+}
+
+// ForChannel applies a channel's permission overwrites on top of the member's
+// realm permissions. Overwrites targeting the realm ID act as the implicit
+// @everyone role and are applied first, followed by the member's roles and
+// finally the member itself.
+func (m *MemberPermissions) ForChannel(overwrites []ChannelOverwrite) *MemberPermissions {
+	scoped := *m
+	if m.Has(PermissionAdministrator) {
+		return &scoped
+	}
+
+	roles := make(map[uuid.UUID]bool, len(m.RoleIDs))
+	for _, id := range m.RoleIDs {
+		roles[id] = true
+	}
+
+	var everyone, member *ChannelOverwrite
+	var roleAllow, roleDeny int64
+	for i := range overwrites {
+		ow := &overwrites[i]
+		switch {
+		case ow.TargetType == OverwriteTypeRole && ow.TargetID == m.RealmID:
+			everyone = ow
+		case ow.TargetType == OverwriteTypeRole && roles[ow.TargetID]:
+			roleAllow |= ow.Allow
+			roleDeny |= ow.Deny
+		case ow.TargetType == OverwriteTypeMember && ow.TargetID == m.UserID:
+			member = ow
+		}
+	}
+
+	if everyone != nil {
+		scoped.Permissions = scoped.Permissions&^everyone.Deny | everyone.Allow
+	}
+	scoped.Permissions = scoped.Permissions&^roleDeny | roleAllow
+	if member != nil {
+		scoped.Permissions = scoped.Permissions&^member.Deny | member.Allow
+	}
+
+	// Overwrites cannot grant anything back to a timed out member.
+	scoped.applyTimeout(m.TimedOutUntil)
+
+	return &scoped
+}
+
+// ResolveChannel computes the effective permissions of a user in a channel.
+func (r *PermissionResolver) ResolveChannel(channel *Channel, userID uuid.UUID) (*MemberPermissions, error) {
+	member, err := r.Resolve(channel.RealmID, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var overwrites []ChannelOverwrite
+	if err := r.db.Where("channel_id = ?", channel.ID).Find(&overwrites).Error; err != nil {
+		return nil, err
+	}
+
+	return member.ForChannel(overwrites), nil
+}
+
+// ChannelAudience returns which of userIDs are realm members able to view
+// channel. A nil userIDs considers every member of the realm.
+func (r *PermissionResolver) ChannelAudience(channel *Channel, userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	if userIDs != nil && len(userIDs) == 0 {
+		return nil, nil
+	}
+
+	var realm Realm
+	if err := r.db.Where("id = ?", channel.RealmID).First(&realm).Error; err != nil {
+		return nil, err
+	}
+
+	members := r.db.Where("realm_id = ?", channel.RealmID)
+	assignments := r.db.Where("realm_id = ?", channel.RealmID)
+	if userIDs != nil {
+		members = members.Where("user_id IN ?", userIDs)
+		assignments = assignments.Where("user_id IN ?", userIDs)
+	}
+
+	var realmMembers []RealmMember
+	if err := members.Find(&realmMembers).Error; err != nil {
+		return nil, err
+	}
+
+	var memberRoles []MemberRole
+	if err := assignments.Find(&memberRoles).Error; err != nil {
+		return nil, err
+	}
+
+	var roles []Role
+	if err := r.db.Where("realm_id = ?", channel.RealmID).Find(&roles).Error; err != nil {
+		return nil, err
+	}
+
+	var overwrites []ChannelOverwrite
+	if err := r.db.Where("channel_id = ?", channel.ID).Find(&overwrites).Error; err != nil {
+		return nil, err
+	}
+
+	rolesByID := make(map[uuid.UUID]Role, len(roles))
+	for _, role := range roles {
+		rolesByID[role.ID] = role
+	}
+	rolesByUser := make(map[uuid.UUID][]Role)
+	for _, mr := range memberRoles {
+		if role, ok := rolesByID[mr.RoleID]; ok {
+			rolesByUser[mr.UserID] = append(rolesByUser[mr.UserID], role)
+		}
+	}
+
+	audience := make([]uuid.UUID, 0, len(realmMembers))
+	for _, m := range realmMembers {
+		perms := memberPermissions(&realm, m.UserID, rolesByUser[m.UserID])
+		if perms.ForChannel(overwrites).Has(PermissionViewChannels) {
+			audience = append(audience, m.UserID)
+		}
+	}
+
+	return audience, nil
+}
+
+// ChannelViewers implements websocket.ChannelAuthorizer: it returns which
+// of userIDs may view a channel, leaving out users who have not acknowledged
+// their age if the channel is NSFW. Nobody may view a deleted channel.
+func (r *PermissionResolver) ChannelViewers(channelID uuid.UUID, userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	var channel Channel
+	if err := r.db.Where("id = ?", channelID).First(&channel).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	audience, err := r.ChannelAudience(&channel, userIDs)
+	if err != nil || !channel.NSFW || len(audience) == 0 {
+		return audience, err
+	}
+
+	var acknowledged []uuid.UUID
+	err = r.db.Model(&User{}).Where("id IN ? AND age_acknowledged_at IS NOT NULL", audience).Pluck("id", &acknowledged).Error
+	return acknowledged, err
+}
+
+// VisibleChannels returns the channels of the member's realm they may view,
+// in display order.
+func (r *PermissionResolver) VisibleChannels(member *MemberPermissions) ([]Channel, error) {
+	var channels []Channel
+	if err := r.db.Where("realm_id = ?", member.RealmID).Order("position ASC, created_at ASC").Find(&channels).Error; err != nil {
+		return nil, err
+	}
+
+	var overwrites []ChannelOverwrite
+	if err := r.db.Where("channel_id IN (?)", r.db.Model(&Channel{}).Select("id").Where("realm_id = ?", member.RealmID)).
+		Find(&overwrites).Error; err != nil {
+		return nil, err
+	}
+
+	byChannel := make(map[uuid.UUID][]ChannelOverwrite)
+	for _, ow := range overwrites {
+		byChannel[ow.ChannelID] = append(byChannel[ow.ChannelID], ow)
+	}
+
+	visible := make([]Channel, 0, len(channels))
+	for _, channel := range channels {
+		if member.ForChannel(byChannel[channel.ID]).Has(PermissionViewChannels) {
+			visible = append(visible, channel)
+		}
+	}
+
+	return visible, nil
+}
+
+// RealmLocator extracts the realm a request operates on.
+type RealmLocator func(c *fiber.Ctx, db *gorm.DB) (uuid.UUID, error)
+
+// RealmParam reads the realm ID directly from a route parameter.
+func RealmParam(name string) RealmLocator {
+	return func(c *fiber.Ctx, db *gorm.DB) (uuid.UUID, error) {
+		return uuid.Parse(c.Params(name))
+	}
+}
+
+// RoleRealm resolves the realm owning the role in a route parameter.
+func RoleRealm(name string) RealmLocator {
+	return func(c *fiber.Ctx, db *gorm.DB) (uuid.UUID, error) {
+		var role Role
+		if err := db.Select("realm_id").Where("id = ?", c.Params(name)).First(&role).Error; err != nil {
+			return uuid.Nil, err
+		}
+		return role.RealmID, nil
+	}
+}
+
+// CategoryRealm resolves the realm owning the category in a route parameter
+// and stores the category in Locals.
+func CategoryRealm(name string) RealmLocator {
+	return func(c *fiber.Ctx, db *gorm.DB) (uuid.UUID, error) {
+		var category ChannelCategory
+		if err := db.Where("id = ?", c.Params(name)).First(&category).Error; err != nil {
+			return uuid.Nil, err
+		}
+		c.Locals("category", &category)
+		return category.RealmID, nil
+	}
+}
+
+// RequirePermission rejects requests from users lacking perm in the realm
+// found by locate (the :realmId parameter by default). On success the
+// resolved realm ID and member permissions are stored in Locals.
+func (r *PermissionResolver) RequirePermission(perm int64, locate ...RealmLocator) fiber.Handler {
+	locator := RealmParam("realmId")
+	if len(locate) > 0 {
+		locator = locate[0]
+	}
+
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uuid.UUID)
+
+		realmID, err := locator(c, r.db)
+		if err != nil {
+			return c.Status(404).JSON(fiber.Map{"error": "Realm not found"})
+		}
+
+		member, err := r.Resolve(realmID, userID)
+		if errors.Is(err, ErrNotRealmMember) {
+			return c.Status(403).JSON(fiber.Map{"error": "Access denied"})
+		}
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Realm not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve permissions"})
+		}
+
+		if !member.Has(perm) {
+			return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+		}
+
+		c.Locals("realmID", realmID)
+		c.Locals("member", member)
+		return c.Next()
+	}
+}
+
+// ChannelLocator loads the channel a request operates on. Locators that load
+// a record on the way, such as a message, store it in Locals. Errors are
+// returned as *fiber.Error.
+type ChannelLocator func(c *fiber.Ctx, db *gorm.DB) (*Channel, error)
+
+// ChannelParam reads the channel ID directly from a route parameter.
+func ChannelParam(name string) ChannelLocator {
+	return func(c *fiber.Ctx, db *gorm.DB) (*Channel, error) {
+		return findChannel(db, c.Params(name))
+	}
+}
+
+// MessageChannel resolves the channel of the message in a route parameter
+// and stores the message in Locals.
+func MessageChannel(name string) ChannelLocator {
+	return func(c *fiber.Ctx, db *gorm.DB) (*Channel, error) {
+		var message Message
+		if err := db.Where("id = ?", c.Params(name)).First(&message).Error; err != nil {
+			return nil, fiber.NewError(404, "Message not found")
+		}
+		c.Locals("message", &message)
+		return findChannel(db, message.ChannelID)
+	}
+}
+
+// ThreadChannel resolves the parent channel of the thread in a route
+// parameter and stores the thread in Locals.
+func ThreadChannel(name string) ChannelLocator {
+	return func(c *fiber.Ctx, db *gorm.DB) (*Channel, error) {
+		var thread Thread
+		if err := db.Where("id = ?", c.Params(name)).First(&thread).Error; err != nil {
+			return nil, fiber.NewError(404, "Thread not found")
+		}
+		c.Locals("thread", &thread)
+		return findChannel(db, thread.ChannelID)
+	}
+}
+
+func findChannel(db *gorm.DB, id interface{}) (*Channel, error) {
+	var channel Channel
+	if err := db.Where("id = ?", id).First(&channel).Error; err != nil {
+		return nil, fiber.NewError(404, "Channel not found")
+	}
+	return &channel, nil
+}
+
+// RequireChannelPermission is RequirePermission for routes addressing a
+// channel through locate; channel overwrites are taken into account and the
+// loaded channel is stored in Locals.
+func (r *PermissionResolver) RequireChannelPermission(perm int64, locate ChannelLocator) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userID := c.Locals("userID").(uuid.UUID)
+
+		channel, err := locate(c, r.db)
+		if err != nil {
+			return err
+		}
+
+		member, err := r.ResolveChannel(channel, userID)
+		if errors.Is(err, ErrNotRealmMember) {
+			return c.Status(403).JSON(fiber.Map{"error": "Access denied"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to resolve permissions"})
+		}
+
+		// Channels the member cannot see are reported as missing.
+		if !member.Has(PermissionViewChannels) {
+			return c.Status(404).JSON(fiber.Map{"error": "Channel not found"})
+		}
+		if !member.Has(perm) {
+			return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+		}
+		if err := checkNSFW(r.db, channel, userID); err != nil {
+			return err
+		}
+
+		c.Locals("realmID", channel.RealmID)
+		c.Locals("member", member)
+		c.Locals("channel", channel)
+		return c.Next()
+	}
+}
+
+// CheckTarget returns a 403 *fiber.Error unless actor outranks the target
+// user. Users who are not members of the realm rank below everyone.
+func (r *PermissionResolver) CheckTarget(actor *MemberPermissions, targetID uuid.UUID) error {
+	target, err := r.Resolve(actor.RealmID, targetID)
+	if errors.Is(err, ErrNotRealmMember) {
+		target = nonMemberPermissions(actor.RealmID, targetID)
+	} else if err != nil {
+		return fiber.NewError(500, "Failed to resolve permissions")
+	}
+	return checkRank(actor, target)
+}
+
+// nonMemberPermissions ranks a user who is not a member of the realm below
+// every member, including members without roles.
+func nonMemberPermissions(realmID, userID uuid.UUID) *MemberPermissions {
+	return &MemberPermissions{RealmID: realmID, UserID: userID, HighestPosition: -2}
+}
+
+// checkRank returns a 403 *fiber.Error unless actor outranks target.
+func checkRank(actor, target *MemberPermissions) error {
+	if !actor.Outranks(target) {
+		return fiber.NewError(403, "Cannot act on a member with an equal or higher role")
+	}
+	return nil
+}
+
+// currentMember returns the permissions stored by RequirePermission.
+func currentMember(c *fiber.Ctx) *MemberPermissions {
+	member, _ := c.Locals("member").(*MemberPermissions)
+	return member
+}
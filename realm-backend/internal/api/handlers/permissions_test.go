@@ -0,0 +1,204 @@
+package handlers
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+func TestMemberPermissions(t *testing.T) {
+	ownerID := uuid.New()
+	userID := uuid.New()
+	realm := &Realm{ID: uuid.New(), OwnerID: ownerID}
+
+	moderator := Role{ID: uuid.New(), Position: 3, Permissions: PermissionKickMembers | PermissionManageMessages}
+	helper := Role{ID: uuid.New(), Position: 1, Permissions: PermissionCreateInvite}
+	admin := Role{ID: uuid.New(), Position: 2, Permissions: PermissionAdministrator}
+
+	tests := []struct {
+		name     string
+		userID   uuid.UUID
+		roles    []Role
+		want     int64
+		owner    bool
+		position int
+	}{
+		{"no roles", userID, nil, DefaultPermissions, false, -1},
+		{"roles combine", userID, []Role{helper, moderator}, DefaultPermissions | PermissionCreateInvite | PermissionKickMembers | PermissionManageMessages, false, 3},
+		{"administrator grants everything", userID, []Role{helper, admin}, PermissionAll, false, 2},
+		{"owner overrides roles", ownerID, []Role{helper}, PermissionAll, true, math.MaxInt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms := memberPermissions(realm, tt.userID, tt.roles)
+			if perms.Permissions != tt.want {
+				t.Fatalf("expected permissions %b, got %b", tt.want, perms.Permissions)
+			}
+			if perms.Owner != tt.owner {
+				t.Fatalf("expected owner %v, got %v", tt.owner, perms.Owner)
+			}
+			if perms.HighestPosition != tt.position {
+				t.Fatalf("expected highest position %d, got %d", tt.position, perms.HighestPosition)
+			}
+		})
+	}
+}
+
+// TestResolveTimeout covers how Resolve masks the permissions of a timed out
+// member.
+func TestResolveTimeout(t *testing.T) {
+	ownerID := uuid.New()
+	realm := &Realm{ID: uuid.New(), OwnerID: ownerID}
+	until := time.Now().Add(time.Hour)
+	admin := Role{ID: uuid.New(), Position: 1, Permissions: PermissionAdministrator}
+
+	tests := []struct {
+		name   string
+		userID uuid.UUID
+		roles  []Role
+		want   int64
+	}{
+		{"member keeps only view", uuid.New(), nil, PermissionViewChannels},
+		{"administrator keeps only view", uuid.New(), []Role{admin}, PermissionViewChannels},
+		{"owner is never timed out", ownerID, nil, PermissionAll},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms := memberPermissions(realm, tt.userID, tt.roles)
+			perms.applyTimeout(&until)
+			if perms.Permissions != tt.want {
+				t.Fatalf("expected permissions %b, got %b", tt.want, perms.Permissions)
+			}
+		})
+	}
+}
+
+func TestForChannel(t *testing.T) {
+	realmID := uuid.New()
+	userID := uuid.New()
+	roleA := uuid.New()
+	roleB := uuid.New()
+	until := time.Now().Add(time.Hour)
+
+	everyone := func(allow, deny int64) ChannelOverwrite {
+		return ChannelOverwrite{TargetType: OverwriteTypeRole, TargetID: realmID, Allow: allow, Deny: deny}
+	}
+	role := func(id uuid.UUID, allow, deny int64) ChannelOverwrite {
+		return ChannelOverwrite{TargetType: OverwriteTypeRole, TargetID: id, Allow: allow, Deny: deny}
+	}
+	member := func(id uuid.UUID, allow, deny int64) ChannelOverwrite {
+		return ChannelOverwrite{TargetType: OverwriteTypeMember, TargetID: id, Allow: allow, Deny: deny}
+	}
+
+	base := int64(PermissionViewChannels | PermissionSendMessages)
+
+	tests := []struct {
+		name       string
+		perms      int64
+		timedOut   bool
+		overwrites []ChannelOverwrite
+		want       int64
+	}{
+		{"no overwrites", base, false, nil, base},
+		{"everyone deny", base, false, []ChannelOverwrite{
+			everyone(0, PermissionSendMessages),
+		}, PermissionViewChannels},
+		{"role allow beats everyone deny", base, false, []ChannelOverwrite{
+			role(roleA, PermissionSendMessages, 0),
+			everyone(0, PermissionSendMessages),
+		}, base},
+		{"role allows beat role denies", base, false, []ChannelOverwrite{
+			role(roleA, 0, PermissionSendMessages),
+			role(roleB, PermissionSendMessages, 0),
+		}, base},
+		{"member deny beats role allow", base, false, []ChannelOverwrite{
+			member(userID, 0, PermissionSendMessages),
+			role(roleA, PermissionSendMessages, 0),
+		}, PermissionViewChannels},
+		{"member allow beats everyone deny", base, false, []ChannelOverwrite{
+			everyone(0, PermissionViewChannels),
+			member(userID, PermissionViewChannels, 0),
+		}, base},
+		{"other targets are ignored", base, false, []ChannelOverwrite{
+			role(uuid.New(), 0, PermissionViewChannels),
+			member(uuid.New(), 0, PermissionViewChannels),
+		}, base},
+		{"administrator ignores overwrites", PermissionAll, false, []ChannelOverwrite{
+			everyone(0, PermissionViewChannels),
+			member(userID, 0, PermissionAll),
+		}, PermissionAll},
+		{"timeout masks allows", base, true, []ChannelOverwrite{
+			member(userID, PermissionSendMessages|PermissionManageMessages, 0),
+		}, PermissionViewChannels},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			perms := &MemberPermissions{
+				RealmID:     realmID,
+				UserID:      userID,
+				Permissions: tt.perms,
+				RoleIDs:     []uuid.UUID{roleA, roleB},
+			}
+			if tt.timedOut {
+				perms.applyTimeout(&until)
+			}
+
+			scoped := perms.ForChannel(tt.overwrites)
+			if scoped.Permissions != tt.want {
+				t.Fatalf("expected permissions %b, got %b", tt.want, scoped.Permissions)
+			}
+		})
+	}
+}
+
+func TestCheckRank(t *testing.T) {
+	realm := &Realm{ID: uuid.New(), OwnerID: uuid.New()}
+	high := Role{ID: uuid.New(), Position: 5}
+	low := Role{ID: uuid.New(), Position: 2}
+	admin := Role{ID: uuid.New(), Position: 1, Permissions: PermissionAdministrator}
+
+	owner := memberPermissions(realm, realm.OwnerID, nil)
+	senior := memberPermissions(realm, uuid.New(), []Role{high})
+	peer := memberPermissions(realm, uuid.New(), []Role{high, low})
+	junior := memberPermissions(realm, uuid.New(), []Role{low})
+	administrator := memberPermissions(realm, uuid.New(), []Role{admin})
+	plain := memberPermissions(realm, uuid.New(), nil)
+	stranger := nonMemberPermissions(realm.ID, uuid.New())
+
+	tests := []struct {
+		name          string
+		actor, target *MemberPermissions
+		allowed       bool
+	}{
+		{"owner over anyone", owner, senior, true},
+		{"nobody over the owner", senior, owner, false},
+		{"higher role", senior, junior, true},
+		{"lower role", junior, senior, false},
+		{"equal top roles", senior, peer, false},
+		{"self", senior, senior, false},
+		{"administrator ranks by position", administrator, junior, false},
+		{"role over no roles", junior, plain, true},
+		{"no roles over non-member", plain, stranger, true},
+		{"non-member over no roles", stranger, plain, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkRank(tt.actor, tt.target)
+			if tt.allowed {
+				if err != nil {
+					t.Fatalf("expected the action to be allowed, got %v", err)
+				}
+				return
+			}
+
+			var fiberErr *fiber.Error
+			if !errors.As(err, &fiberErr) || fiberErr.Code != 403 {
+				t.Fatalf("expected a 403, got %v", err)
+			}
+		})
+	}
+}
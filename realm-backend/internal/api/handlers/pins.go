@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// MaxPinsPerChannel caps how many messages a channel may have pinned.
+const MaxPinsPerChannel = 50
+
+var errPinLimit = fiber.NewError(fiber.StatusBadRequest, "Channel has reached the maximum number of pins")
+
+type PinsHandler struct {
+	db      *gorm.DB
+	hub     *websocket.Hub
+	uploads *Uploader
+}
+
+func NewPinsHandler(db *gorm.DB, hub *websocket.Hub, uploads *Uploader) *PinsHandler {
+	return &PinsHandler{db: db, hub: hub, uploads: uploads}
+}
+
+// GetPins lists the pinned messages of a channel, most recently pinned first.
+func (h *PinsHandler) GetPins(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+
+	var messages []Message
+	if err := h.db.Where("channel_id = ? AND pinned = ?", channel.ID, true).
+		Preload("User").Preload("Pinner").Preload("Attachments").
+		Order("pinned_at DESC").
+		Find(&messages).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch pins"})
+	}
+
+	signMessages(c.Context(), h.uploads, messages)
+	attachMemberList(h.db, messages)
+
+	return c.JSON(messages)
+}
+
+// PinMessage pins a message and announces it with a system message. Pinning
+// an already pinned message does nothing.
+func (h *PinsHandler) PinMessage(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	channel := c.Locals("channel").(*Channel)
+	messageID := c.Params("messageId")
+
+	var message Message
+	var notice *Message
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		// Lock the channel so concurrent pins cannot exceed the cap.
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Channel{}, "id = ?", channel.ID).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Where("id = ? AND channel_id = ? AND type <> ?", messageID, channel.ID, MessageTypeSystem).First(&message).Error; err != nil {
+			return err
+		}
+		if message.Pinned {
+			return nil
+		}
+
+		var pins int64
+		if err := tx.Model(&Message{}).Where("channel_id = ? AND pinned = ?", channel.ID, true).Count(&pins).Error; err != nil {
+			return err
+		}
+		if pins >= MaxPinsPerChannel {
+			return errPinLimit
+		}
+
+		now := time.Now()
+		if err := tx.Model(&message).Updates(map[string]interface{}{
+			"pinned":    true,
+			"pinned_at": now,
+			"pinned_by": userID,
+		}).Error; err != nil {
+			return err
+		}
+
+		notice = &Message{
+			ChannelID: channel.ID,
+			UserID:    userID,
+			Type:      MessageTypeSystem,
+			Content:   "pinned a message",
+			ReplyTo:   &message.ID,
+		}
+		return tx.Create(notice).Error
+	})
+	if errors.Is(err, errPinLimit) {
+		return err
+	}
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to pin message"})
+	}
+
+	if notice != nil {
+		h.db.Preload("User").First(notice, "id = ?", notice.ID)
+		attachMembers(h.db, notice)
+		h.broadcast(channel.ID, websocket.EventMessageCreate, notice)
+		h.pinsUpdated(c, channel.ID, message.ID)
+	}
+
+	return c.JSON(fiber.Map{"message": "Message pinned"})
+}
+
+func (h *PinsHandler) UnpinMessage(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+	messageID, err := uuid.Parse(c.Params("messageId"))
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid message ID"})
+	}
+
+	result := h.db.Model(&Message{}).
+		Where("id = ? AND channel_id = ? AND pinned = ?", messageID, channel.ID, true).
+		Updates(map[string]interface{}{
+			"pinned":    false,
+			"pinned_at": nil,
+			"pinned_by": nil,
+		})
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to unpin message"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(404).JSON(fiber.Map{"error": "Pinned message not found"})
+	}
+
+	h.pinsUpdated(c, channel.ID, messageID)
+
+	return c.JSON(fiber.Map{"message": "Message unpinned"})
+}
+
+// pinsUpdated pushes the changed message and a channel_pins_update.
+func (h *PinsHandler) pinsUpdated(c *fiber.Ctx, channelID, messageID uuid.UUID) {
+	var message Message
+	if err := h.db.Preload("User").Preload("Attachments").First(&message, "id = ?", messageID).Error; err == nil {
+		signAttachments(c.Context(), h.uploads, message.Attachments)
+		attachMembers(h.db, &message)
+		h.broadcast(channelID, websocket.EventMessageUpdate, message)
+	}
+
+	announcePins(h.db, h.hub, channelID, messageID)
+}
+
+// announcePins sends a channel_pins_update for a message pinned or unpinned
+// in a channel, carrying the time of the channel's most recent pin.
+func announcePins(db *gorm.DB, hub *websocket.Hub, channelID, messageID uuid.UUID) {
+	var lastPin *time.Time
+	db.Model(&Message{}).Where("channel_id = ? AND pinned = ?", channelID, true).
+		Select("MAX(pinned_at)").Scan(&lastPin)
+
+	hub.BroadcastToChannel(channelID, websocket.WSMessage{
+		Type: websocket.EventChannelPinsUpdate,
+		Data: fiber.Map{
+			"channel_id":  channelID,
+			"message_id":  messageID,
+			"last_pin_at": lastPin,
+		},
+		ChannelID: &channelID,
+	})
+}
+
+func (h *PinsHandler) broadcast(channelID uuid.UUID, eventType string, data interface{}) {
+	h.hub.BroadcastToChannel(channelID, websocket.WSMessage{
+		Type:      eventType,
+		Data:      data,
+		ChannelID: &channelID,
+	})
+}
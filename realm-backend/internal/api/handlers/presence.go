@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Statuses a user may choose. "online" lets presence follow their
+// connections; the others override what everyone else sees while connected.
+const (
+	StatusOnline    = "online"
+	StatusIdle      = "idle"
+	StatusDND       = "dnd"
+	StatusInvisible = "invisible"
+)
+
+// PresenceHandler reports the connection-derived presence of this hub node
+// to a PresenceStore, which combines it with the other nodes, and persists
+// and fans out the combined presence whenever it changes. A user connected
+// to several replicas therefore only goes offline once every one of them
+// lost the user's last connection.
+type PresenceHandler struct {
+	db    *gorm.DB
+	hub   *websocket.Hub
+	store websocket.PresenceStore
+
+	// pending holds the latest unreported presence of each user on this
+	// node; wake tells run there is something to report.
+	mu      sync.Mutex
+	pending map[uuid.UUID]string
+	wake    chan struct{}
+}
+
+type UpdateStatusRequest struct {
+	Status   string `json:"status"`
+	Activity string `json:"activity"`
+}
+
+func NewPresenceHandler(db *gorm.DB, hub *websocket.Hub, store websocket.PresenceStore) *PresenceHandler {
+	h := &PresenceHandler{
+		db:      db,
+		hub:     hub,
+		store:   store,
+		pending: make(map[uuid.UUID]string),
+		wake:    make(chan struct{}, 1),
+	}
+	go h.run()
+	return h
+}
+
+// PresenceChanged implements websocket.PresenceListener. It never blocks:
+// changes are coalesced per user and reported on a single goroutine, so the
+// hub never waits on the database or the presence store.
+func (h *PresenceHandler) PresenceChanged(userID uuid.UUID, status string) {
+	h.mu.Lock()
+	h.pending[userID] = status
+	h.mu.Unlock()
+
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run reports pending changes as they come in. Periodically it also renews
+// this node's leases, retries failed reports and applies the presence of
+// users whose node stopped renewing its leases.
+func (h *PresenceHandler) run() {
+	ticker := time.NewTicker(websocket.PresenceLeaseTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.wake:
+			h.report()
+		case <-ticker.C:
+			h.report()
+			h.renew()
+		}
+	}
+}
+
+func (h *PresenceHandler) report() {
+	h.mu.Lock()
+	pending := h.pending
+	h.pending = make(map[uuid.UUID]string)
+	h.mu.Unlock()
+
+	ctx := context.Background()
+	for userID, status := range pending {
+		combined, changed, err := h.store.Report(ctx, userID, h.hub.NodeID(), status)
+		if err != nil {
+			log.Printf("Failed to report presence for user %s: %v", userID, err)
+			h.retry(userID, status)
+			continue
+		}
+		if changed {
+			h.apply(userID, combined)
+		}
+	}
+}
+
+// retry queues a failed report again unless a newer change superseded it.
+func (h *PresenceHandler) retry(userID uuid.UUID, status string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.pending[userID]; !ok {
+		h.pending[userID] = status
+	}
+}
+
+func (h *PresenceHandler) renew() {
+	ctx := context.Background()
+	if err := h.store.Renew(ctx, h.hub.NodeID(), h.hub.PresentUsers()); err != nil {
+		log.Printf("Failed to renew presence leases: %v", err)
+	}
+
+	changes, err := h.store.Expire(ctx)
+	if err != nil {
+		log.Printf("Failed to expire presence leases: %v", err)
+	}
+	for userID, status := range changes {
+		h.apply(userID, status)
+	}
+}
+
+// apply publishes a change of a user's combined presence.
+func (h *PresenceHandler) apply(userID uuid.UUID, presence string) {
+	if err := h.publish(userID, presence); err != nil {
+		log.Printf("Failed to update presence for user %s: %v", userID, err)
+	}
+	if presence == websocket.PresenceOffline {
+		dropTemporaryMemberships(h.db, h.hub, userID)
+	}
+}
+
+func (h *PresenceHandler) UpdateStatus(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	var req UpdateStatusRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	validStatuses := map[string]bool{
+		StatusOnline: true, StatusIdle: true, StatusDND: true, StatusInvisible: true,
+	}
+
+	if !validStatuses[req.Status] {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid status"})
+	}
+
+	updates := map[string]interface{}{
+		"preferred_status": req.Status,
+	}
+	if req.Activity != "" {
+		updates["activity"] = req.Activity
+	}
+
+	if err := h.db.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update status"})
+	}
+
+	presence, err := h.store.Presence(c.Context(), userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update status"})
+	}
+	if err := h.publish(userID, presence); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update status"})
+	}
+
+	return c.JSON(fiber.Map{"message": "Status updated successfully"})
+}
+
+// publish stores the status others see for the user and broadcasts it once
+// to each realm the user is in, for that realm's subscribers, and once to
+// the user and their friends.
+func (h *PresenceHandler) publish(userID uuid.UUID, presence string) error {
+	var user User
+	if err := h.db.Select("id", "preferred_status").Where("id = ?", userID).First(&user).Error; err != nil {
+		return err
+	}
+
+	status := visibleStatus(presence, user.PreferredStatus)
+	updates := map[string]interface{}{"status": status}
+
+	data := map[string]interface{}{
+		"user_id": userID,
+		"status":  status,
+	}
+	if presence == websocket.PresenceOffline {
+		now := time.Now()
+		updates["last_seen"] = now
+		data["last_seen"] = now
+	}
+
+	if err := h.db.Model(&User{}).Where("id = ?", userID).Updates(updates).Error; err != nil {
+		return err
+	}
+
+	var realms []uuid.UUID
+	if err := h.db.Model(&RealmMember{}).Where("user_id = ?", userID).Pluck("realm_id", &realms).Error; err != nil {
+		return err
+	}
+	friends, err := h.friends(userID)
+	if err != nil {
+		return err
+	}
+
+	for _, realmID := range realms {
+		h.hub.BroadcastToRealm(realmID, websocket.WSMessage{
+			Type:    websocket.EventPresenceUpdate,
+			Data:    data,
+			RealmID: &realmID,
+		})
+	}
+	h.hub.BroadcastToUsers(append(friends, userID), websocket.WSMessage{
+		Type: websocket.EventPresenceUpdate,
+		Data: data,
+	})
+	return nil
+}
+
+// friends returns the accepted friends of a user.
+func (h *PresenceHandler) friends(userID uuid.UUID) ([]uuid.UUID, error) {
+	var ids []uuid.UUID
+	err := h.db.Raw(`
+		SELECT friend_id FROM friends WHERE user_id = ? AND status = 'accepted'
+		UNION
+		SELECT user_id FROM friends WHERE friend_id = ? AND status = 'accepted'`, userID, userID).Scan(&ids).Error
+	return ids, err
+}
+
+// visibleStatus combines connection-derived presence with the user's chosen
+// status. Invisible users always appear offline.
+func visibleStatus(presence, preferred string) string {
+	if presence == websocket.PresenceOffline || preferred == StatusInvisible {
+		return websocket.PresenceOffline
+	}
+	if preferred == StatusDND || preferred == StatusIdle {
+		return preferred
+	}
+	return presence
+}
@@ -0,0 +1,255 @@
+package handlers
+
+import (
+	"log"
+	"regexp"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	// MaxBulkDeleteMessages caps the IDs accepted by a bulk delete.
+	MaxBulkDeleteMessages = 100
+	// MaxPurgeMessages caps how many messages a single purge deletes.
+	MaxPurgeMessages = 1000
+	// MaxPurgePatternLength bounds purge content patterns.
+	MaxPurgePatternLength = 200
+	// MaxPurgeScan caps how many messages a single purge examines, so a
+	// pattern that rarely matches cannot walk a whole channel.
+	MaxPurgeScan = 10000
+
+	// purgeBatchSize is how many messages each purge batch examines.
+	purgeBatchSize = 100
+)
+
+type PurgeHandler struct {
+	db  *gorm.DB
+	hub *websocket.Hub
+}
+
+type BulkDeleteRequest struct {
+	MessageIDs []uuid.UUID `json:"message_ids"`
+	Reason     string      `json:"reason"`
+}
+
+// PurgeRequest selects the messages of a channel to delete, newest first.
+// Every filter is optional; Pattern is a Go regular expression matched
+// against message content.
+type PurgeRequest struct {
+	AuthorID       *uuid.UUID `json:"author_id"`
+	Since          *time.Time `json:"since"`
+	Until          *time.Time `json:"until"`
+	Pattern        string     `json:"pattern"`
+	HasAttachments *bool      `json:"has_attachments"`
+	Limit          int        `json:"limit"`
+	Reason         string     `json:"reason"`
+}
+
+func NewPurgeHandler(db *gorm.DB, hub *websocket.Hub) *PurgeHandler {
+	return &PurgeHandler{db: db, hub: hub}
+}
+
+// BulkDelete deletes up to MaxBulkDeleteMessages messages of a channel at
+// once. IDs that are unknown or already deleted are ignored.
+func (h *PurgeHandler) BulkDelete(c *fiber.Ctx) error {
+	var req BulkDeleteRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if len(req.MessageIDs) == 0 {
+		return c.Status(400).JSON(fiber.Map{"error": "Message IDs required"})
+	}
+	if len(req.MessageIDs) > MaxBulkDeleteMessages {
+		return c.Status(400).JSON(fiber.Map{"error": "Too many messages"})
+	}
+
+	return h.run(c, "message_bulk_delete", req.Reason, len(req.MessageIDs), func(db *gorm.DB) *gorm.DB {
+		return db.Where("id IN ?", req.MessageIDs)
+	}, nil)
+}
+
+// Purge deletes the newest messages of a channel matching the request
+// filters, at most Limit or MaxPurgeMessages of them.
+func (h *PurgeHandler) Purge(c *fiber.Ctx) error {
+	var req PurgeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.Limit <= 0 || req.Limit > MaxPurgeMessages {
+		req.Limit = MaxPurgeMessages
+	}
+	if len(req.Pattern) > MaxPurgePatternLength {
+		return c.Status(400).JSON(fiber.Map{"error": "Pattern too long"})
+	}
+	// Patterns are matched here rather than by Postgres, whose regular
+	// expression dialect differs from the one they are validated with.
+	var pattern *regexp.Regexp
+	if req.Pattern != "" {
+		var err error
+		if pattern, err = regexp.Compile(req.Pattern); err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid pattern"})
+		}
+	}
+
+	return h.run(c, "message_purge", req.Reason, req.Limit, func(db *gorm.DB) *gorm.DB {
+		if req.AuthorID != nil {
+			db = db.Where("user_id = ?", *req.AuthorID)
+		}
+		if req.Since != nil {
+			db = db.Where("created_at >= ?", *req.Since)
+		}
+		if req.Until != nil {
+			db = db.Where("created_at < ?", *req.Until)
+		}
+		if req.HasAttachments != nil {
+			exists := "EXISTS (SELECT 1 FROM attachments WHERE attachments.message_id = messages.id)"
+			if !*req.HasAttachments {
+				exists = "NOT " + exists
+			}
+			db = db.Where(exists)
+		}
+		return db
+	}, pattern)
+}
+
+// run soft-deletes up to limit messages of the channel in Locals selected by
+// filter and, if set, whose content matches pattern. Candidates are scanned
+// newest first in batches within one transaction, at most MaxPurgeScan of
+// them. The purge is logged as a single moderation action and announced with
+// one message_delete_bulk event.
+func (h *PurgeHandler) run(c *fiber.Ctx, action, reason string, limit int, filter func(*gorm.DB) *gorm.DB, pattern *regexp.Regexp) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	channel := c.Locals("channel").(*Channel)
+
+	var deleted []Message
+	var unpinned []uuid.UUID
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		var cursor *Cursor
+		for scanned := 0; len(deleted) < limit && scanned < MaxPurgeScan; {
+			query := tx.Model(&Message{}).Select("id", "content", "created_at", "pinned").
+				Where("channel_id = ?", channel.ID).
+				Scopes(filter).
+				Order("created_at DESC, id DESC").
+				Limit(purgeBatchSize)
+			if cursor != nil {
+				query = query.Where("(created_at, id) < (?, ?)", cursor.CreatedAt, cursor.ID)
+			}
+
+			var candidates []Message
+			if err := query.Find(&candidates).Error; err != nil {
+				return err
+			}
+			if len(candidates) == 0 {
+				break
+			}
+			scanned += len(candidates)
+			last := candidates[len(candidates)-1].cursor()
+			cursor = &last
+
+			var ids []uuid.UUID
+			for _, candidate := range candidates {
+				if len(deleted)+len(ids) == limit {
+					break
+				}
+				if pattern == nil || pattern.MatchString(candidate.Content) {
+					ids = append(ids, candidate.ID)
+					if candidate.Pinned {
+						unpinned = append(unpinned, candidate.ID)
+					}
+				}
+			}
+
+			if len(ids) > 0 {
+				var rows []Message
+				if err := tx.Model(&rows).
+					Clauses(clause.Returning{Columns: []clause.Column{{Name: "id"}, {Name: "user_id"}, {Name: "thread_id"}}}).
+					Where("id IN ?", ids).
+					Updates(map[string]interface{}{
+						"deleted_at": time.Now(),
+						"deleted_by": userID,
+						"pinned":     false,
+						"pinned_at":  nil,
+						"pinned_by":  nil,
+					}).Error; err != nil {
+					return err
+				}
+				deleted = append(deleted, rows...)
+			}
+
+			if len(candidates) < purgeBatchSize {
+				break
+			}
+		}
+		if len(deleted) == 0 {
+			return nil
+		}
+
+		entry := ModerationAction{
+			RealmID:     channel.RealmID,
+			ModeratorID: userID,
+			Action:      action,
+			Reason:      reason,
+			ChannelID:   &channel.ID,
+			Count:       len(deleted),
+		}
+		// A purge of a single author's messages is logged against them.
+		if author := deleted[0].UserID; allBy(deleted, author) {
+			entry.UserID = &author
+		}
+		return tx.Create(&entry).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete messages"})
+	}
+
+	ids := make([]uuid.UUID, len(deleted))
+	threads := make(map[uuid.UUID]bool)
+	for i, message := range deleted {
+		ids[i] = message.ID
+		if message.ThreadID != nil {
+			threads[*message.ThreadID] = true
+		}
+	}
+
+	if len(ids) > 0 {
+		h.broadcast(channel.ID, websocket.EventMessageDeleteBulk, fiber.Map{
+			"ids":        ids,
+			"channel_id": channel.ID,
+		})
+	}
+	for _, messageID := range unpinned {
+		announcePins(h.db, h.hub, channel.ID, messageID)
+	}
+	for threadID := range threads {
+		thread, err := refreshThread(h.db, threadID, false)
+		if err != nil {
+			log.Printf("Failed to update thread %s: %v", threadID, err)
+			continue
+		}
+		h.broadcast(channel.ID, websocket.EventThreadUpdate, thread)
+	}
+
+	return c.JSON(fiber.Map{"deleted": ids})
+}
+
+func (h *PurgeHandler) broadcast(channelID uuid.UUID, eventType string, data interface{}) {
+	h.hub.BroadcastToChannel(channelID, websocket.WSMessage{
+		Type:      eventType,
+		Data:      data,
+		ChannelID: &channelID,
+	})
+}
+
+func allBy(messages []Message, userID uuid.UUID) bool {
+	for _, message := range messages {
+		if message.UserID != userID {
+			return false
+		}
+	}
+	return true
+}
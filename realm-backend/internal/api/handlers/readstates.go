@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type ReadStatesHandler struct {
+	db  *gorm.DB
+	hub *websocket.Hub
+}
+
+// ReadState marks how far a user has read a channel or DM conversation:
+// messages after (LastReadAt, LastMessageID) are unread.
+type ReadState struct {
+	UserID uuid.UUID `json:"user_id" gorm:"type:uuid;primaryKey"`
+	// ChannelID is a channel ID or a DM conversation ID.
+	ChannelID     uuid.UUID `json:"channel_id" gorm:"type:uuid;primaryKey"`
+	LastMessageID uuid.UUID `json:"last_message_id" gorm:"type:uuid;not null"`
+	LastReadAt    time.Time `json:"last_read_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// ReadStateSummary is returned alongside channels and conversations.
+type ReadStateSummary struct {
+	LastMessageID *uuid.UUID `json:"last_message_id"`
+	UnreadCount   int        `json:"unread_count"`
+	MentionCount  int        `json:"mention_count"`
+}
+
+type AckRequest struct {
+	MessageID uuid.UUID `json:"message_id"`
+}
+
+// unreadRow is one row of the unread count queries.
+type unreadRow struct {
+	ChannelID    uuid.UUID
+	UnreadCount  int
+	MentionCount int
+}
+
+func NewReadStatesHandler(db *gorm.DB, hub *websocket.Hub) *ReadStatesHandler {
+	return &ReadStatesHandler{db: db, hub: hub}
+}
+
+// AckChannel marks a channel as read up to and including a message.
+func (h *ReadStatesHandler) AckChannel(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	channel := c.Locals("channel").(*Channel)
+
+	var req AckRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var message Message
+	if err := h.db.Where("id = ? AND channel_id = ?", req.MessageID, channel.ID).First(&message).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+
+	if err := h.ack(userID, channel.ID, message.ID, message.CreatedAt); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update read state"})
+	}
+
+	summaries, err := channelReadStates(h.db, userID, channel.RealmID, []uuid.UUID{channel.ID})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update read state"})
+	}
+	h.push(userID, channel.ID, summaries[channel.ID])
+
+	return c.JSON(summaries[channel.ID])
+}
+
+// AckConversation marks a DM conversation as read up to and including a
+// message.
+func (h *ReadStatesHandler) AckConversation(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	conversationID := c.Params("id")
+
+	var req AckRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	var conversation DMConversation
+	if err := h.db.Where("id = ? AND (user1_id = ? OR user2_id = ?)", conversationID, userID, userID).First(&conversation).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Conversation not found"})
+	}
+
+	var dm DirectMessage
+	if err := h.db.Where("id = ? AND ((sender_id = ? AND recipient_id = ?) OR (sender_id = ? AND recipient_id = ?))",
+		req.MessageID, conversation.User1ID, conversation.User2ID, conversation.User2ID, conversation.User1ID).
+		First(&dm).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+
+	if err := h.ack(userID, conversation.ID, dm.ID, dm.CreatedAt); err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update read state"})
+	}
+
+	summaries, err := conversationReadStates(h.db, userID, []uuid.UUID{conversation.ID})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update read state"})
+	}
+	h.push(userID, conversation.ID, summaries[conversation.ID])
+
+	return c.JSON(summaries[conversation.ID])
+}
+
+// ack moves a read state forward; acknowledging an older message than the
+// one already read is a no-op.
+func (h *ReadStatesHandler) ack(userID, channelID, messageID uuid.UUID, at time.Time) error {
+	state := ReadState{
+		UserID:        userID,
+		ChannelID:     channelID,
+		LastMessageID: messageID,
+		LastReadAt:    at,
+	}
+	return h.db.Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "user_id"}, {Name: "channel_id"}},
+		DoUpdates: clause.AssignmentColumns([]string{"last_message_id", "last_read_at", "updated_at"}),
+		Where: clause.Where{Exprs: []clause.Expression{clause.Expr{
+			SQL: "(read_states.last_read_at, read_states.last_message_id) < (excluded.last_read_at, excluded.last_message_id)",
+		}}},
+	}).Create(&state).Error
+}
+
+// push syncs a read state to every connection of the user.
+func (h *ReadStatesHandler) push(userID, channelID uuid.UUID, summary *ReadStateSummary) {
+	h.hub.BroadcastToUser(userID, websocket.WSMessage{
+		Type: websocket.EventReadStateUpdate,
+		Data: fiber.Map{
+			"channel_id":      channelID,
+			"last_message_id": summary.LastMessageID,
+			"unread_count":    summary.UnreadCount,
+			"mention_count":   summary.MentionCount,
+		},
+	})
+}
+
+// channelReadStates summarises the read state of channels of one realm.
+// Channel replies in threads are not counted. Without a read state, messages
+// since the user joined the realm are unread.
+func channelReadStates(db *gorm.DB, userID, realmID uuid.UUID, channelIDs []uuid.UUID) (map[uuid.UUID]*ReadStateSummary, error) {
+	summaries := make(map[uuid.UUID]*ReadStateSummary, len(channelIDs))
+	if len(channelIDs) == 0 {
+		return summaries, nil
+	}
+
+	var member RealmMember
+	if err := db.Where("realm_id = ? AND user_id = ?", realmID, userID).First(&member).Error; err != nil {
+		return nil, err
+	}
+
+	var roleIDs []string
+	if err := db.Model(&MemberRole{}).Where("realm_id = ? AND user_id = ?", realmID, userID).Pluck("role_id::text", &roleIDs).Error; err != nil {
+		return nil, err
+	}
+
+	var rows []unreadRow
+	if err := db.Raw(`
+		SELECT m.channel_id,
+			COUNT(*) AS unread_count,
+			COUNT(*) FILTER (WHERE m.mention_everyone
+				OR m.mentions @> ?::jsonb
+				OR jsonb_exists_any(COALESCE(m.mention_roles, '[]'::jsonb), ?::text[])) AS mention_count
+		FROM messages m
+		LEFT JOIN read_states rs ON rs.channel_id = m.channel_id AND rs.user_id = ?
+		WHERE m.channel_id IN ? AND m.thread_id IS NULL AND m.deleted_at IS NULL AND m.user_id <> ?
+			AND CASE WHEN rs.user_id IS NULL THEN m.created_at > ?
+				ELSE (m.created_at, m.id) > (rs.last_read_at, rs.last_message_id) END
+		GROUP BY m.channel_id`,
+		`["`+userID.String()+`"]`, "{"+strings.Join(roleIDs, ",")+"}", userID,
+		channelIDs, userID, member.JoinedAt,
+	).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	return summarise(db, userID, channelIDs, rows, summaries)
+}
+
+// conversationReadStates summarises the read state of DM conversations.
+// Every unread direct message counts as a mention.
+func conversationReadStates(db *gorm.DB, userID uuid.UUID, conversationIDs []uuid.UUID) (map[uuid.UUID]*ReadStateSummary, error) {
+	summaries := make(map[uuid.UUID]*ReadStateSummary, len(conversationIDs))
+	if len(conversationIDs) == 0 {
+		return summaries, nil
+	}
+
+	var rows []unreadRow
+	if err := db.Raw(`
+		SELECT c.id AS channel_id, COUNT(*) AS unread_count, COUNT(*) AS mention_count
+		FROM dm_conversations c
+		JOIN direct_messages dm ON dm.recipient_id = ?
+			AND dm.sender_id = CASE WHEN c.user1_id = ? THEN c.user2_id ELSE c.user1_id END
+			AND dm.deleted_at IS NULL
+		LEFT JOIN read_states rs ON rs.channel_id = c.id AND rs.user_id = ?
+		WHERE c.id IN ?
+			AND (rs.user_id IS NULL OR (dm.created_at, dm.id) > (rs.last_read_at, rs.last_message_id))
+		GROUP BY c.id`,
+		userID, userID, userID, conversationIDs,
+	).Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	return summarise(db, userID, conversationIDs, rows, summaries)
+}
+
+func summarise(db *gorm.DB, userID uuid.UUID, ids []uuid.UUID, rows []unreadRow, summaries map[uuid.UUID]*ReadStateSummary) (map[uuid.UUID]*ReadStateSummary, error) {
+	var states []ReadState
+	if err := db.Where("user_id = ? AND channel_id IN ?", userID, ids).Find(&states).Error; err != nil {
+		return nil, err
+	}
+
+	for _, id := range ids {
+		summaries[id] = &ReadStateSummary{}
+	}
+	for _, state := range states {
+		summaries[state.ChannelID].LastMessageID = &state.LastMessageID
+	}
+	for _, row := range rows {
+		summaries[row.ChannelID].UnreadCount = row.UnreadCount
+		summaries[row.ChannelID].MentionCount = row.MentionCount
+	}
+	return summaries, nil
+}
@@ -1,22 +1,39 @@
 package handlers
 
 import (
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"strings"
 	"time"
+	"unicode/utf8"
+)
+
+const (
+	MaxRealmNameLength        = 100
+	MaxRealmDescriptionLength = 1024
+
+	// DefaultMemberPageLimit and MaxMemberPageLimit bound member listings,
+	// which are paged by user ID rather than by cursor.
+	DefaultMemberPageLimit = 100
+	MaxMemberPageLimit     = 1000
 )
 
 type RealmHandler struct {
-	db *gorm.DB
+	db      *gorm.DB
+	hub     *websocket.Hub
+	uploads *Uploader
+	images  *ImageProcessor
 }
 
 type Realm struct {
 	ID          uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	Name        string    `json:"name" gorm:"not null"`
 	Description string    `json:"description"`
+	IconURL     string    `json:"icon_url"`
 	OwnerID     uuid.UUID `json:"owner_id" gorm:"type:uuid;not null"`
-	InviteCode  string    `json:"invite_code" gorm:"unique;not null"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
@@ -24,7 +41,15 @@ type RealmMember struct {
 	ID      uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
 	RealmID uuid.UUID `json:"realm_id" gorm:"type:uuid;not null"`
 	UserID  uuid.UUID `json:"user_id" gorm:"type:uuid;not null"`
-	JoinedAt time.Time `json:"joined_at"`
+	JoinedAt time.Time `json:"joined_at" gorm:"autoCreateTime"`
+	// Temporary is set for members who joined through a temporary invite.
+	Temporary bool `json:"temporary" gorm:"default:false"`
+	// Nickname and Avatar override the user's display name and avatar
+	// within the realm.
+	Nickname string      `json:"nickname"`
+	Avatar   string      `json:"avatar"`
+	User     *User       `json:"user,omitempty" gorm:"foreignKey:UserID"`
+	RoleIDs  []uuid.UUID `json:"role_ids,omitempty" gorm:"-"`
 }
 
 type CreateRealmRequest struct {
@@ -32,8 +57,19 @@ type CreateRealmRequest struct {
 	Description string `json:"description"`
 }
 
-func NewRealmHandler(db *gorm.DB) *RealmHandler {
-	return &RealmHandler{db: db}
+// UpdateRealmRequest is sent as JSON, or as multipart form fields alongside
+// a new icon in "icon".
+type UpdateRealmRequest struct {
+	Name        *string `json:"name" form:"name"`
+	Description *string `json:"description" form:"description"`
+}
+
+type TransferRealmRequest struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+func NewRealmHandler(db *gorm.DB, hub *websocket.Hub, uploads *Uploader, images *ImageProcessor) *RealmHandler {
+	return &RealmHandler{db: db, hub: hub, uploads: uploads, images: images}
 }
 
 func (h *RealmHandler) CreateRealm(c *fiber.Ctx) error {
@@ -52,7 +88,6 @@ func (h *RealmHandler) CreateRealm(c *fiber.Ctx) error {
 		Name:        req.Name,
 		Description: req.Description,
 		OwnerID:     userID,
-		InviteCode:  uuid.New().String()[:8],
 	}
 
 	if err := h.db.Create(&realm).Error; err != nil {
@@ -100,40 +135,320 @@ func (h *RealmHandler) GetRealm(c *fiber.Ctx) error {
 	return c.JSON(realm)
 }
 
-func (h *RealmHandler) JoinRealm(c *fiber.Ctx) error {
-	inviteCode := c.Params("code")
+// UpdateRealm changes the name, description or icon of a realm.
+func (h *RealmHandler) UpdateRealm(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+
+	var req UpdateRealmRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		name := strings.TrimSpace(*req.Name)
+		if name == "" {
+			return c.Status(400).JSON(fiber.Map{"error": "Realm name is required"})
+		}
+		if utf8.RuneCountInString(name) > MaxRealmNameLength {
+			return c.Status(400).JSON(fiber.Map{"error": "Realm name too long"})
+		}
+		updates["name"] = name
+	}
+	if req.Description != nil {
+		if utf8.RuneCountInString(*req.Description) > MaxRealmDescriptionLength {
+			return c.Status(400).JSON(fiber.Map{"error": "Realm description too long"})
+		}
+		updates["description"] = *req.Description
+	}
+
+	var realm Realm
+	if err := h.db.Where("id = ?", realmID).First(&realm).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Realm not found"})
+	}
+
+	if len(updates) > 0 {
+		if err := h.db.Model(&realm).Updates(updates).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to update realm"})
+		}
+	}
+
+	if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+		if fh, err := c.FormFile("icon"); err == nil {
+			if _, err := setRealmIcon(c.Context(), h.db, h.uploads, h.images, &realm, fh); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.broadcast(realm.ID, websocket.EventRealmUpdate, realm)
+
+	return c.JSON(realm)
+}
+
+// DeleteRealm deletes a realm with its channels, messages, roles, members,
+// invites and voice states. Only the owner may delete it.
+func (h *RealmHandler) DeleteRealm(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+	if !currentMember(c).Owner {
+		return c.Status(403).JSON(fiber.Map{"error": "Only the realm owner can delete the realm"})
+	}
+
+	var realm Realm
+	if err := h.db.Where("id = ?", realmID).First(&realm).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Realm not found"})
+	}
+
+	var members []uuid.UUID
+	var avatars []string
+	var attachments []Attachment
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&RealmMember{}).Where("realm_id = ?", realmID).Pluck("user_id", &members).Error; err != nil {
+			return err
+		}
+		if err := tx.Model(&RealmMember{}).Where("realm_id = ? AND avatar <> ''", realmID).Pluck("avatar", &avatars).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("message_id IN (?)", realmMessages(tx, realmID)).Find(&attachments).Error; err != nil {
+			return err
+		}
+		if err := deleteRealmData(tx, realmID); err != nil {
+			return err
+		}
+		var err error
+		attachments, err = unsharedAttachments(tx, attachments)
+		return err
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete realm"})
+	}
+
+	h.broadcast(realmID, websocket.EventRealmDelete, fiber.Map{"id": realmID})
+	h.hub.EvictMembers(realmID, members...)
+
+	deleteMedia(c.Context(), h.uploads, realm.IconURL)
+	for _, avatar := range avatars {
+		deleteMedia(c.Context(), h.uploads, avatar)
+	}
+	for _, attachment := range attachments {
+		h.uploads.Delete(c.Context(), attachment.Key)
+		if attachment.ThumbnailKey != "" {
+			h.uploads.Delete(c.Context(), attachment.ThumbnailKey)
+		}
+	}
+
+	return c.JSON(fiber.Map{"message": "Realm deleted successfully"})
+}
+
+// TransferRealm hands ownership of a realm to another member. Only the
+// owner may transfer it.
+func (h *RealmHandler) TransferRealm(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
 	userID := c.Locals("userID").(uuid.UUID)
+	if !currentMember(c).Owner {
+		return c.Status(403).JSON(fiber.Map{"error": "Only the realm owner can transfer the realm"})
+	}
+
+	var req TransferRealmRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+	if req.UserID == userID {
+		return c.Status(400).JSON(fiber.Map{"error": "You already own this realm"})
+	}
+
+	var member RealmMember
+	if err := h.db.Where("realm_id = ? AND user_id = ?", realmID, req.UserID).First(&member).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
 
 	var realm Realm
-	if err := h.db.Where("invite_code = ?", inviteCode).First(&realm).Error; err != nil {
-		return c.Status(404).JSON(fiber.Map{"error": "Invalid invite code"})
+	result := h.db.Model(&realm).Clauses(clause.Returning{}).
+		Where("id = ? AND owner_id = ?", realmID, userID).
+		Update("owner_id", req.UserID)
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to transfer realm"})
+	}
+	if result.RowsAffected == 0 {
+		return c.Status(409).JSON(fiber.Map{"error": "Realm ownership changed"})
 	}
 
-	// Check if already member
-	var existing RealmMember
-	if err := h.db.Where("realm_id = ? AND user_id = ?", realm.ID, userID).First(&existing).Error; err == nil {
-		return c.Status(400).JSON(fiber.Map{"error": "Already a member"})
+	// A temporary member becomes permanent along with ownership.
+	if member.Temporary {
+		h.db.Model(&member).Update("temporary", false)
 	}
 
-	member := RealmMember{
-		RealmID: realm.ID,
-		UserID:  userID,
+	h.broadcast(realmID, websocket.EventRealmUpdate, realm)
+
+	return c.JSON(realm)
+}
+
+// GetRealmMembers lists the members of a realm with their roles and
+// presence, ordered by user ID. Pages are requested with limit and after,
+// the last user ID of the previous page.
+func (h *RealmHandler) GetRealmMembers(c *fiber.Ctx) error {
+	realmID := c.Locals("realmID").(uuid.UUID)
+
+	limit := c.QueryInt("limit", DefaultMemberPageLimit)
+	if limit <= 0 || limit > MaxMemberPageLimit {
+		limit = DefaultMemberPageLimit
+	}
+
+	query := h.db.Where("realm_id = ?", realmID)
+	if after := c.Query("after"); after != "" {
+		afterID, err := uuid.Parse(after)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid after ID"})
+		}
+		query = query.Where("user_id > ?", afterID)
 	}
 
-	if err := h.db.Create(&member).Error; err != nil {
-		return c.Status(500).JSON(fiber.Map{"error": "Failed to join realm"})
+	var members []RealmMember
+	if err := query.Preload("User").Order("user_id ASC").Limit(limit).Find(&members).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch members"})
 	}
 
-	return c.JSON(fiber.Map{"message": "Successfully joined realm"})
+	userIDs := make([]uuid.UUID, len(members))
+	for i, member := range members {
+		userIDs[i] = member.UserID
+	}
+
+	var assignments []MemberRole
+	if len(userIDs) > 0 {
+		if err := h.db.Where("realm_id = ? AND user_id IN ?", realmID, userIDs).Find(&assignments).Error; err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch members"})
+		}
+	}
+
+	roles := make(map[uuid.UUID][]uuid.UUID, len(members))
+	for _, assignment := range assignments {
+		roles[assignment.UserID] = append(roles[assignment.UserID], assignment.RoleID)
+	}
+	for i := range members {
+		members[i].RoleIDs = roles[members[i].UserID]
+	}
+
+	return c.JSON(members)
 }
 
 func (h *RealmHandler) LeaveRealm(c *fiber.Ctx) error {
 	realmID := c.Params("id")
 	userID := c.Locals("userID").(uuid.UUID)
 
-	if err := h.db.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&RealmMember{}).Error; err != nil {
+	var realm Realm
+	if err := h.db.Where("id = ?", realmID).First(&realm).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Realm not found"})
+	}
+	if realm.OwnerID == userID {
+		return c.Status(400).JSON(fiber.Map{"error": "Transfer ownership before leaving the realm"})
+	}
+
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&MemberRole{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("realm_id = ? AND user_id = ?", realmID, userID).Delete(&RealmMember{}).Error
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to leave realm"})
 	}
 
+	if id, err := uuid.Parse(realmID); err == nil {
+		h.hub.EvictMembers(id, userID)
+	}
+
 	return c.JSON(fiber.Map{"message": "Successfully left realm"})
-}
\ No newline at end of file
+}
+func (h *RealmHandler) broadcast(realmID uuid.UUID, eventType string, data interface{}) {
+	h.hub.BroadcastToRealm(realmID, websocket.WSMessage{
+		Type:    eventType,
+		Data:    data,
+		RealmID: &realmID,
+	})
+}
+
+// realmMessages selects the IDs of every message in a realm, including
+// deleted ones.
+func realmMessages(db *gorm.DB, realmID uuid.UUID) *gorm.DB {
+	return db.Unscoped().Model(&Message{}).Select("id").Where("channel_id IN (?)", realmChannels(db, realmID))
+}
+
+// unsharedAttachments drops the attachments whose blobs are still used by
+// other attachments, such as crossposts of a published message.
+func unsharedAttachments(db *gorm.DB, attachments []Attachment) ([]Attachment, error) {
+	if len(attachments) == 0 {
+		return attachments, nil
+	}
+	keys := make([]string, len(attachments))
+	for i, a := range attachments {
+		keys[i] = a.Key
+	}
+
+	var shared []string
+	if err := db.Model(&Attachment{}).Where("storage_key IN ?", keys).Pluck("storage_key", &shared).Error; err != nil {
+		return nil, err
+	}
+	inUse := make(map[string]bool, len(shared))
+	for _, key := range shared {
+		inUse[key] = true
+	}
+
+	unshared := attachments[:0]
+	for _, a := range attachments {
+		if !inUse[a.Key] {
+			unshared = append(unshared, a)
+		}
+	}
+	return unshared, nil
+}
+
+func realmChannels(db *gorm.DB, realmID uuid.UUID) *gorm.DB {
+	return db.Model(&Channel{}).Select("id").Where("realm_id = ?", realmID)
+}
+
+// deleteRealmData removes a realm and everything belonging to it, children
+// first.
+func deleteRealmData(tx *gorm.DB, realmID uuid.UUID) error {
+	threads := func() *gorm.DB {
+		return tx.Model(&Thread{}).Select("id").Where("channel_id IN (?)", realmChannels(tx, realmID))
+	}
+
+	steps := []struct {
+		model interface{}
+		query string
+		arg   func() interface{}
+	}{
+		{&MessageReaction{}, "message_id IN (?)", func() interface{} { return realmMessages(tx, realmID) }},
+		{&Attachment{}, "message_id IN (?)", func() interface{} { return realmMessages(tx, realmID) }},
+		{&MessageRevision{}, "message_id IN (?)", func() interface{} { return realmMessages(tx, realmID) }},
+		{&CrosspostDelivery{}, "message_id IN (?)", func() interface{} { return realmMessages(tx, realmID) }},
+		{&CrosspostDelivery{}, "target_channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&ChannelFollow{}, "source_channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&ChannelFollow{}, "target_channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&ThreadMember{}, "thread_id IN (?)", func() interface{} { return threads() }},
+		// Thread starters and replies reference each other, so threads go
+		// before their messages.
+		{&Thread{}, "channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&Message{}, "channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&ReadState{}, "channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&ChannelOverwrite{}, "channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&VoiceState{}, "channel_id IN (?)", func() interface{} { return realmChannels(tx, realmID) }},
+		{&Invite{}, "realm_id = ?", func() interface{} { return realmID }},
+		{&Channel{}, "realm_id = ?", func() interface{} { return realmID }},
+		{&CategoryOverwrite{}, "category_id IN (?)", func() interface{} {
+			return tx.Model(&ChannelCategory{}).Select("id").Where("realm_id = ?", realmID)
+		}},
+		{&ChannelCategory{}, "realm_id = ?", func() interface{} { return realmID }},
+		{&MemberRole{}, "realm_id = ?", func() interface{} { return realmID }},
+		{&Role{}, "realm_id = ?", func() interface{} { return realmID }},
+		{&RealmMember{}, "realm_id = ?", func() interface{} { return realmID }},
+		{&ModerationAction{}, "realm_id = ?", func() interface{} { return realmID }},
+	}
+
+	for _, step := range steps {
+		if err := tx.Unscoped().Where(step.query, step.arg()).Delete(step.model).Error; err != nil {
+			return err
+		}
+	}
+	return tx.Where("id = ?", realmID).Delete(&Realm{}).Error
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// MessageRevision is a previous version of a channel or direct message,
+// recorded when the message is edited. Revisions are append-only.
+type MessageRevision struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	MessageID uuid.UUID `json:"message_id" gorm:"type:uuid;not null"`
+	Content   string    `json:"content"`
+	// ReplacedAt is when the edit superseding this version was made.
+	ReplacedAt time.Time `json:"replaced_at" gorm:"autoCreateTime"`
+}
+
+// MessageHistory is a message with its earlier versions, oldest first.
+type MessageHistory struct {
+	Message   interface{}       `json:"message"`
+	Revisions []MessageRevision `json:"revisions"`
+}
+
+// recordRevision stores the content a message had before an edit.
+func recordRevision(tx *gorm.DB, messageID uuid.UUID, content string) error {
+	return tx.Create(&MessageRevision{MessageID: messageID, Content: content}).Error
+}
+
+func messageRevisions(db *gorm.DB, messageID uuid.UUID) ([]MessageRevision, error) {
+	revisions := []MessageRevision{}
+	if err := db.Where("message_id = ?", messageID).Order("replaced_at ASC").Find(&revisions).Error; err != nil {
+		return nil, err
+	}
+	return revisions, nil
+}
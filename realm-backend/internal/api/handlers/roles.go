@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
@@ -8,7 +9,9 @@ import (
 )
 
 type RolesHandler struct {
-	db *gorm.DB
+	db    *gorm.DB
+	hub   *websocket.Hub
+	perms *PermissionResolver
 }
 
 type Role struct {
@@ -63,10 +66,68 @@ const (
 	PermissionMuteMembers     = 1 << 10
 	PermissionDeafenMembers   = 1 << 11
 	PermissionMoveMembers     = 1 << 12
+	// PermissionMentionEveryone allows @everyone, @here and mentions of
+	// roles that are not mentionable.
+	PermissionMentionEveryone = 1 << 13
+	PermissionCreateInvite    = 1 << 14
+	// PermissionManageRealm allows changing the realm name, description
+	// and icon.
+	PermissionManageRealm     = 1 << 15
+	PermissionManageNicknames = 1 << 16
+
+	// PermissionAll is every permission bit, granted to realm owners and administrators.
+	PermissionAll = PermissionViewChannels | PermissionSendMessages | PermissionManageMessages |
+		PermissionManageChannels | PermissionManageRoles | PermissionKickMembers | PermissionBanMembers |
+		PermissionAdministrator | PermissionConnect | PermissionSpeak | PermissionMuteMembers |
+		PermissionDeafenMembers | PermissionMoveMembers | PermissionMentionEveryone | PermissionCreateInvite |
+		PermissionManageRealm | PermissionManageNicknames
+
+	// DefaultPermissions are granted to every realm member regardless of assigned roles.
+	DefaultPermissions = PermissionViewChannels | PermissionSendMessages | PermissionConnect | PermissionSpeak |
+		PermissionCreateInvite
 )
 
-func NewRolesHandler(db *gorm.DB) *RolesHandler {
-	return &RolesHandler{db: db}
+func NewRolesHandler(db *gorm.DB, hub *websocket.Hub, perms *PermissionResolver) *RolesHandler {
+	return &RolesHandler{db: db, hub: hub, perms: perms}
+}
+
+// loadManagedRole fetches a role and ensures the caller sits above it.
+func (h *RolesHandler) loadManagedRole(c *fiber.Ctx, roleID string) (*Role, error) {
+	member := currentMember(c)
+
+	var role Role
+	if err := h.db.Where("id = ? AND realm_id = ?", roleID, member.RealmID).First(&role).Error; err != nil {
+		return nil, fiber.NewError(404, "Role not found")
+	}
+
+	if !member.CanManageRole(role.Position) {
+		return nil, fiber.NewError(403, "Cannot manage a role at or above your highest role")
+	}
+
+	return &role, nil
+}
+
+// checkMember parses the member a role is assigned to or removed from and,
+// unless it is the caller, checks the caller outranks them.
+func (h *RolesHandler) checkMember(c *fiber.Ctx, userID string) (uuid.UUID, error) {
+	targetID, err := uuid.Parse(userID)
+	if err != nil {
+		return uuid.Nil, fiber.NewError(400, "Invalid user ID")
+	}
+	if targetID != c.Locals("userID").(uuid.UUID) {
+		if err := h.perms.CheckTarget(currentMember(c), targetID); err != nil {
+			return uuid.Nil, err
+		}
+	}
+	return targetID, nil
+}
+
+// checkGrant rejects attempts to hand out permissions the caller lacks.
+func checkGrant(member *MemberPermissions, permissions int64) error {
+	if permissions&^member.Permissions != 0 {
+		return fiber.NewError(403, "Cannot grant permissions you do not have")
+	}
+	return nil
 }
 
 func (h *RolesHandler) CreateRole(c *fiber.Ctx) error {
@@ -81,6 +142,11 @@ func (h *RolesHandler) CreateRole(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Role name required"})
 	}
 
+	member := currentMember(c)
+	if err := checkGrant(member, req.Permissions); err != nil {
+		return err
+	}
+
 	role := Role{
 		RealmID:     uuid.MustParse(realmID),
 		Name:        req.Name,
@@ -94,7 +160,24 @@ func (h *RolesHandler) CreateRole(c *fiber.Ctx) error {
 		role.Color = "#99aab5"
 	}
 
-	if err := h.db.Create(&role).Error; err != nil {
+	// New roles go on top for the owner and directly below the creator's
+	// highest role otherwise, so the creator can still manage them.
+	err := h.db.Transaction(func(tx *gorm.DB) error {
+		if member.Owner {
+			if err := tx.Model(&Role{}).Where("realm_id = ?", role.RealmID).
+				Select("COALESCE(MAX(position), -1) + 1").Scan(&role.Position).Error; err != nil {
+				return err
+			}
+		} else {
+			role.Position = max(member.HighestPosition, 0)
+			if err := tx.Model(&Role{}).Where("realm_id = ? AND position >= ?", role.RealmID, role.Position).
+				Update("position", gorm.Expr("position + 1")).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Create(&role).Error
+	})
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to create role"})
 	}
 
@@ -120,6 +203,17 @@ func (h *RolesHandler) UpdateRole(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
+	member := currentMember(c)
+	if _, err := h.loadManagedRole(c, roleID); err != nil {
+		return err
+	}
+	if err := checkGrant(member, req.Permissions); err != nil {
+		return err
+	}
+	if req.Position != nil && !member.CanManageRole(*req.Position) {
+		return c.Status(403).JSON(fiber.Map{"error": "Cannot move a role at or above your highest role"})
+	}
+
 	updates := map[string]interface{}{}
 	if req.Name != "" {
 		updates["name"] = req.Name
@@ -143,6 +237,9 @@ func (h *RolesHandler) UpdateRole(c *fiber.Ctx) error {
 	if err := h.db.Model(&Role{}).Where("id = ?", roleID).Updates(updates).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to update role"})
 	}
+	if req.Permissions != 0 {
+		h.hub.RevalidateRealm(member.RealmID)
+	}
 
 	return c.JSON(fiber.Map{"message": "Role updated successfully"})
 }
@@ -150,6 +247,10 @@ func (h *RolesHandler) UpdateRole(c *fiber.Ctx) error {
 func (h *RolesHandler) DeleteRole(c *fiber.Ctx) error {
 	roleID := c.Params("roleId")
 
+	if _, err := h.loadManagedRole(c, roleID); err != nil {
+		return err
+	}
+
 	// Remove role from all members
 	h.db.Where("role_id = ?", roleID).Delete(&MemberRole{})
 
@@ -157,17 +258,30 @@ func (h *RolesHandler) DeleteRole(c *fiber.Ctx) error {
 	if err := h.db.Where("id = ?", roleID).Delete(&Role{}).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to delete role"})
 	}
+	h.hub.RevalidateRealm(currentMember(c).RealmID)
 
 	return c.JSON(fiber.Map{"message": "Role deleted successfully"})
 }
 
 func (h *RolesHandler) AssignRole(c *fiber.Ctx) error {
 	realmID := c.Params("realmId")
-	userID := c.Params("userId")
 	roleID := c.Params("roleId")
 
+	if _, err := h.loadManagedRole(c, roleID); err != nil {
+		return err
+	}
+	userID, err := h.checkMember(c, c.Params("userId"))
+	if err != nil {
+		return err
+	}
+
+	var member RealmMember
+	if err := h.db.Where("realm_id = ? AND user_id = ?", realmID, userID).First(&member).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Member not found"})
+	}
+
 	memberRole := MemberRole{
-		UserID:  uuid.MustParse(userID),
+		UserID:  userID,
 		RealmID: uuid.MustParse(realmID),
 		RoleID:  uuid.MustParse(roleID),
 	}
@@ -175,17 +289,27 @@ func (h *RolesHandler) AssignRole(c *fiber.Ctx) error {
 	if err := h.db.Create(&memberRole).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to assign role"})
 	}
+	// Channel overwrites may deny the new role access to channels.
+	h.hub.RevalidateRealm(memberRole.RealmID)
 
 	return c.JSON(fiber.Map{"message": "Role assigned successfully"})
 }
 
 func (h *RolesHandler) RemoveRole(c *fiber.Ctx) error {
-	userID := c.Params("userId")
 	roleID := c.Params("roleId")
 
+	if _, err := h.loadManagedRole(c, roleID); err != nil {
+		return err
+	}
+	userID, err := h.checkMember(c, c.Params("userId"))
+	if err != nil {
+		return err
+	}
+
 	if err := h.db.Where("user_id = ? AND role_id = ?", userID, roleID).Delete(&MemberRole{}).Error; err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to remove role"})
 	}
+	h.hub.RevalidateRealm(currentMember(c).RealmID)
 
 	return c.JSON(fiber.Map{"message": "Role removed successfully"})
 }
\ No newline at end of file
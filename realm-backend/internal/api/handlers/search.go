@@ -0,0 +1,298 @@
+package handlers
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Snippets are generated with control characters around each match, which
+// are then stripped and turned into highlight offsets.
+const (
+	highlightStart = '\x02'
+	highlightStop  = '\x03'
+
+	headlineOptions = `StartSel="` + string(highlightStart) + `", StopSel="` + string(highlightStop) + `", ` +
+		`MaxFragments=2, MaxWords=30, MinWords=10, FragmentDelimiter=" … "`
+)
+
+type SearchHandler struct {
+	db      *gorm.DB
+	perms   *PermissionResolver
+	uploads *Uploader
+}
+
+// Highlight marks a matched term in a snippet. Offsets are in UTF-16 code
+// units so clients can slice the snippet string directly.
+type Highlight struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+type SearchResult[T any] struct {
+	Message    T           `json:"message"`
+	Snippet    string      `json:"snippet"`
+	Highlights []Highlight `json:"highlights"`
+}
+
+// searchParams holds the filters shared by realm and DM search.
+type searchParams struct {
+	Query    string
+	AuthorID *uuid.UUID
+	Since    *time.Time
+	Until    *time.Time
+}
+
+type searchHit struct {
+	ID        uuid.UUID
+	CreatedAt time.Time
+	Snippet   string
+}
+
+func NewSearchHandler(db *gorm.DB, perms *PermissionResolver, uploads *Uploader) *SearchHandler {
+	return &SearchHandler{db: db, perms: perms, uploads: uploads}
+}
+
+// SearchRealmMessages searches the channels of a realm the caller can view.
+// Besides q it accepts author_id, channel_id, since, until, has=attachment,
+// mentions=<user id> and pinned=true|false.
+func (h *SearchHandler) SearchRealmMessages(c *fiber.Ctx) error {
+	params, page, err := parseSearch(c)
+	if err != nil {
+		return err
+	}
+
+	channels, err := h.perms.VisibleChannels(currentMember(c))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+	}
+
+	// NSFW channels are left out for users who have not acknowledged their
+	// age.
+	acknowledged, err := ageAcknowledged(h.db, c.Locals("userID").(uuid.UUID))
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+	}
+
+	var channelIDs []uuid.UUID
+	filter := c.Query("channel_id")
+	for _, channel := range channels {
+		if channel.NSFW && !acknowledged {
+			continue
+		}
+		if filter == "" || channel.ID.String() == filter {
+			channelIDs = append(channelIDs, channel.ID)
+		}
+	}
+	if len(channelIDs) == 0 {
+		return c.JSON([]SearchResult[Message]{})
+	}
+
+	query := h.db.Table("messages").Where("channel_id IN ? AND deleted_at IS NULL", channelIDs)
+	if params.AuthorID != nil {
+		query = query.Where("user_id = ?", *params.AuthorID)
+	}
+
+	switch c.Query("has") {
+	case "":
+	case "attachment":
+		query = query.Where("EXISTS (SELECT 1 FROM attachments WHERE attachments.message_id = messages.id)")
+	default:
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid has filter"})
+	}
+
+	if mentions := c.Query("mentions"); mentions != "" {
+		mentionedID, err := uuid.Parse(mentions)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid mentions filter"})
+		}
+		mentioned, _ := json.Marshal([]uuid.UUID{mentionedID})
+		query = query.Where("mentions @> ?::jsonb", string(mentioned))
+	}
+
+	if pinned := c.Query("pinned"); pinned != "" {
+		query = query.Where("pinned = ?", c.QueryBool("pinned"))
+	}
+
+	hits, info, err := searchPage(query, params, page)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+	}
+
+	var messages []Message
+	if err := h.db.Where("id IN ?", hitIDs(hits)).Preload("User").Preload("Attachments").Find(&messages).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+	}
+	signMessages(c.Context(), h.uploads, messages)
+	attachMemberList(h.db, messages)
+
+	setPageHeaders(c, info)
+	return c.JSON(buildResults(hits, messages, func(m Message) uuid.UUID { return m.ID }))
+}
+
+// SearchDirectMessages searches the caller's direct messages. Besides q it
+// accepts user_id to restrict results to one conversation, author_id, since
+// and until.
+func (h *SearchHandler) SearchDirectMessages(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+
+	params, page, err := parseSearch(c)
+	if err != nil {
+		return err
+	}
+
+	query := h.db.Table("direct_messages").Where("(sender_id = ? OR recipient_id = ?) AND deleted_at IS NULL", userID, userID)
+	if other := c.Query("user_id"); other != "" {
+		otherID, err := uuid.Parse(other)
+		if err != nil {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid user_id filter"})
+		}
+		query = query.Where("(sender_id = ? OR recipient_id = ?)", otherID, otherID)
+	}
+	if params.AuthorID != nil {
+		query = query.Where("sender_id = ?", *params.AuthorID)
+	}
+
+	hits, info, err := searchPage(query, params, page)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+	}
+
+	var messages []DirectMessage
+	if err := h.db.Where("id IN ?", hitIDs(hits)).
+		Preload("Sender").
+		Preload("Recipient").
+		Preload("Attachments").
+		Find(&messages).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to search messages"})
+	}
+	signDirectMessages(c.Context(), h.uploads, messages)
+
+	setPageHeaders(c, info)
+	return c.JSON(buildResults(hits, messages, func(m DirectMessage) uuid.UUID { return m.ID }))
+}
+
+// parseSearch reads the common search filters and the page. Results are
+// returned newest first, so only the before cursor is accepted.
+func parseSearch(c *fiber.Ctx) (*searchParams, *PageRequest, error) {
+	params := &searchParams{Query: strings.TrimSpace(c.Query("q"))}
+	if params.Query == "" {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Search query is required")
+	}
+
+	if author := c.Query("author_id"); author != "" {
+		authorID, err := uuid.Parse(author)
+		if err != nil {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid author_id filter")
+		}
+		params.AuthorID = &authorID
+	}
+
+	for name, dst := range map[string]**time.Time{"since": &params.Since, "until": &params.Until} {
+		if value := c.Query(name); value != "" {
+			t, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid "+name+" filter")
+			}
+			*dst = &t
+		}
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if page.After != nil || page.Around != nil {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Search results can only be paged with before")
+	}
+
+	return params, page, nil
+}
+
+// searchPage runs the full-text query on top of query, newest first.
+func searchPage(query *gorm.DB, params *searchParams, page *PageRequest) ([]searchHit, *PageInfo, error) {
+	query = query.
+		Select("id, created_at, ts_headline('english', content, websearch_to_tsquery('english', ?), ?) AS snippet",
+			params.Query, headlineOptions).
+		Where("search_vector @@ websearch_to_tsquery('english', ?)", params.Query)
+
+	if params.Since != nil {
+		query = query.Where("created_at >= ?", *params.Since)
+	}
+	if params.Until != nil {
+		query = query.Where("created_at < ?", *params.Until)
+	}
+	if page.Before != nil {
+		query = query.Where("(created_at, id) < (?, ?)", page.Before.CreatedAt, page.Before.ID)
+	}
+
+	var hits []searchHit
+	if err := query.Order("created_at DESC, id DESC").Limit(page.Limit + 1).Scan(&hits).Error; err != nil {
+		return nil, nil, err
+	}
+
+	info := &PageInfo{}
+	if len(hits) > page.Limit {
+		hits = hits[:page.Limit]
+		last := hits[len(hits)-1]
+		info.Before = Cursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	return hits, info, nil
+}
+
+func hitIDs(hits []searchHit) []uuid.UUID {
+	ids := make([]uuid.UUID, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.ID
+	}
+	return ids
+}
+
+// buildResults pairs hits with their loaded messages, keeping hit order.
+func buildResults[T any](hits []searchHit, messages []T, id func(T) uuid.UUID) []SearchResult[T] {
+	byID := make(map[uuid.UUID]T, len(messages))
+	for _, m := range messages {
+		byID[id(m)] = m
+	}
+
+	results := make([]SearchResult[T], 0, len(hits))
+	for _, hit := range hits {
+		m, ok := byID[hit.ID]
+		if !ok {
+			continue
+		}
+		snippet, highlights := parseHeadline(hit.Snippet)
+		results = append(results, SearchResult[T]{Message: m, Snippet: snippet, Highlights: highlights})
+	}
+	return results
+}
+
+// parseHeadline strips the highlight markers from a ts_headline snippet and
+// returns the plain snippet with the highlighted ranges.
+func parseHeadline(headline string) (string, []Highlight) {
+	var b strings.Builder
+	highlights := []Highlight{}
+	offset, start := 0, -1
+
+	for _, r := range headline {
+		switch r {
+		case highlightStart:
+			start = offset
+		case highlightStop:
+			if start >= 0 && offset > start {
+				highlights = append(highlights, Highlight{Start: start, End: offset})
+			}
+			start = -1
+		default:
+			b.WriteRune(r)
+			offset += utf16.RuneLen(r)
+		}
+	}
+
+	return b.String(), highlights
+}
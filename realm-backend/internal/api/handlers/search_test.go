@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"slices"
+	"testing"
+	"unicode/utf16"
+)
+
+func TestParseHeadline(t *testing.T) {
+	tests := []struct {
+		name       string
+		headline   string
+		snippet    string
+		highlights []Highlight
+	}{
+		{"no matches", "plain text", "plain text", []Highlight{}},
+		{"one match", "say \x02hello\x03 there", "say hello there", []Highlight{{4, 9}}},
+		{"adjacent matches", "\x02foo\x03\x02bar\x03", "foobar", []Highlight{{0, 3}, {3, 6}}},
+		{"empty match dropped", "a\x02\x03b", "ab", []Highlight{}},
+		{"unterminated match dropped", "a \x02b", "a b", []Highlight{}},
+		{"stray stop ignored", "a\x03 \x02b\x03", "a b", []Highlight{{2, 3}}},
+		// é and 中 are one UTF-16 unit each, 🎉 and 𝄞 are surrogate pairs.
+		{"non-BMP before match", "🎉 \x02party\x03", "🎉 party", []Highlight{{3, 8}}},
+		{"non-BMP inside match", "\x02𝄞clef\x03 é", "𝄞clef é", []Highlight{{0, 6}}},
+		{"mixed text", "中文 \x02🎉\x03 and \x02é\x03", "中文 🎉 and é", []Highlight{{3, 5}, {10, 11}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snippet, highlights := parseHeadline(tt.headline)
+			if snippet != tt.snippet {
+				t.Fatalf("expected snippet %q, got %q", tt.snippet, snippet)
+			}
+			if !slices.Equal(highlights, tt.highlights) {
+				t.Fatalf("expected highlights %v, got %v", tt.highlights, highlights)
+			}
+
+			// Offsets index the snippet as a JavaScript string would.
+			units := utf16.Encode([]rune(snippet))
+			for _, h := range highlights {
+				if h.Start < 0 || h.End > len(units) || h.Start >= h.End {
+					t.Fatalf("highlight %v out of range of %d UTF-16 units", h, len(units))
+				}
+			}
+		})
+	}
+}
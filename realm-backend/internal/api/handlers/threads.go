@@ -0,0 +1,390 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	MaxThreadNameLength = 100
+
+	// DefaultAutoArchiveMinutes archives a thread after a day without replies.
+	DefaultAutoArchiveMinutes = 24 * 60
+
+	// ThreadArchiveInterval is how often inactive threads are archived.
+	ThreadArchiveInterval = time.Minute
+)
+
+// AutoArchiveOptions are the inactivity periods, in minutes, a thread may use.
+var AutoArchiveOptions = []int{60, 24 * 60, 3 * 24 * 60, 7 * 24 * 60}
+
+type ThreadsHandler struct {
+	db      *gorm.DB
+	hub     *websocket.Hub
+	uploads *Uploader
+}
+
+// Thread is a named conversation branching off a channel message. Replies
+// are messages in the parent channel carrying the thread's ID.
+type Thread struct {
+	ID        uuid.UUID `json:"id" gorm:"type:uuid;primary_key;default:gen_random_uuid()"`
+	ChannelID uuid.UUID `json:"channel_id" gorm:"type:uuid;not null"`
+	// MessageID is the message the thread was started from; it is cleared
+	// when that message is deleted.
+	MessageID          *uuid.UUID `json:"message_id" gorm:"type:uuid"`
+	OwnerID            uuid.UUID  `json:"owner_id" gorm:"type:uuid;not null"`
+	Name               string     `json:"name" gorm:"not null"`
+	ReplyCount         int        `json:"reply_count" gorm:"default:0"`
+	LastReplyAt        *time.Time `json:"last_reply_at"`
+	Archived           bool       `json:"archived" gorm:"default:false"`
+	ArchivedAt         *time.Time `json:"archived_at"`
+	AutoArchiveMinutes int        `json:"auto_archive_minutes" gorm:"default:1440"`
+	CreatedAt          time.Time  `json:"created_at"`
+	UpdatedAt          time.Time  `json:"updated_at"`
+}
+
+func (t Thread) cursor() Cursor {
+	return Cursor{CreatedAt: t.CreatedAt, ID: t.ID}
+}
+
+type ThreadMember struct {
+	ThreadID uuid.UUID `json:"thread_id" gorm:"type:uuid;primaryKey"`
+	UserID   uuid.UUID `json:"user_id" gorm:"type:uuid;primaryKey"`
+	JoinedAt time.Time `json:"joined_at" gorm:"autoCreateTime"`
+	User     User      `json:"user" gorm:"foreignKey:UserID"`
+}
+
+type CreateThreadRequest struct {
+	Name               string `json:"name"`
+	AutoArchiveMinutes int    `json:"auto_archive_minutes"`
+}
+
+type UpdateThreadRequest struct {
+	Name               *string `json:"name"`
+	Archived           *bool   `json:"archived"`
+	AutoArchiveMinutes *int    `json:"auto_archive_minutes"`
+}
+
+func NewThreadsHandler(db *gorm.DB, hub *websocket.Hub, uploads *Uploader) *ThreadsHandler {
+	return &ThreadsHandler{db: db, hub: hub, uploads: uploads}
+}
+
+// CreateThread starts a thread from the message in the route; its author
+// becomes the thread's first member.
+func (h *ThreadsHandler) CreateThread(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	parent := c.Locals("message").(*Message)
+
+	var req CreateThreadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	name, err := threadName(req.Name)
+	if err != nil {
+		return err
+	}
+
+	autoArchive := req.AutoArchiveMinutes
+	if autoArchive == 0 {
+		autoArchive = DefaultAutoArchiveMinutes
+	}
+	if !slices.Contains(AutoArchiveOptions, autoArchive) {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid auto archive duration"})
+	}
+
+	if parent.ThreadID != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Cannot start a thread from a thread reply"})
+	}
+
+	var existing Thread
+	if err := h.db.Where("message_id = ?", parent.ID).First(&existing).Error; err == nil {
+		return c.Status(409).JSON(fiber.Map{"error": "Message already has a thread"})
+	}
+
+	thread := Thread{
+		ChannelID:          parent.ChannelID,
+		MessageID:          &parent.ID,
+		OwnerID:            userID,
+		Name:               name,
+		AutoArchiveMinutes: autoArchive,
+	}
+
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&thread).Error; err != nil {
+			return err
+		}
+		return tx.Create(&ThreadMember{ThreadID: thread.ID, UserID: userID}).Error
+	})
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to create thread"})
+	}
+
+	h.broadcast(websocket.EventThreadCreate, &thread)
+
+	return c.JSON(thread)
+}
+
+// GetChannelThreads lists the active threads of a channel, most recently
+// active first. With ?archived=true it pages through archived threads
+// instead, newest first.
+func (h *ThreadsHandler) GetChannelThreads(c *fiber.Ctx) error {
+	channel := c.Locals("channel").(*Channel)
+
+	if c.QueryBool("archived") {
+		page, err := parsePage(c)
+		if err != nil {
+			return err
+		}
+
+		threads, info, err := fetchPage[Thread](h.db, func(db *gorm.DB) *gorm.DB {
+			return db.Where("channel_id = ? AND archived = ?", channel.ID, true)
+		}, page)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return c.Status(404).JSON(fiber.Map{"error": "Thread not found"})
+		}
+		if err != nil {
+			return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch threads"})
+		}
+		// Listed newest first; the page cursors still lead to older (before)
+		// and newer (after) threads.
+		slices.Reverse(threads)
+
+		setPageHeaders(c, info)
+		return c.JSON(threads)
+	}
+
+	var threads []Thread
+	if err := h.db.Where("channel_id = ? AND archived = ?", channel.ID, false).
+		Order("COALESCE(last_reply_at, created_at) DESC").
+		Find(&threads).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch threads"})
+	}
+
+	return c.JSON(threads)
+}
+
+func (h *ThreadsHandler) GetThread(c *fiber.Ctx) error {
+	return c.JSON(c.Locals("thread").(*Thread))
+}
+
+// UpdateThread renames, archives or unarchives a thread. Only its owner and
+// members who can manage messages may do so.
+func (h *ThreadsHandler) UpdateThread(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	thread := c.Locals("thread").(*Thread)
+
+	if thread.OwnerID != userID && !currentMember(c).Has(PermissionManageMessages) {
+		return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+	}
+
+	var req UpdateThreadRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
+	}
+
+	updates := map[string]interface{}{}
+	if req.Name != nil {
+		name, err := threadName(*req.Name)
+		if err != nil {
+			return err
+		}
+		updates["name"] = name
+	}
+	if req.AutoArchiveMinutes != nil {
+		if !slices.Contains(AutoArchiveOptions, *req.AutoArchiveMinutes) {
+			return c.Status(400).JSON(fiber.Map{"error": "Invalid auto archive duration"})
+		}
+		updates["auto_archive_minutes"] = *req.AutoArchiveMinutes
+	}
+	if req.Archived != nil && *req.Archived != thread.Archived {
+		updates["archived"] = *req.Archived
+		if *req.Archived {
+			updates["archived_at"] = time.Now()
+		} else {
+			updates["archived_at"] = nil
+		}
+	}
+
+	if len(updates) == 0 {
+		return c.JSON(thread)
+	}
+
+	if err := h.db.Model(thread).Updates(updates).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to update thread"})
+	}
+
+	h.db.First(thread, "id = ?", thread.ID)
+	h.broadcast(websocket.EventThreadUpdate, thread)
+
+	return c.JSON(thread)
+}
+
+func (h *ThreadsHandler) GetThreadMessages(c *fiber.Ctx) error {
+	thread := c.Locals("thread").(*Thread)
+	withDeleted := currentMember(c).Has(PermissionManageMessages)
+
+	page, err := parsePage(c)
+	if err != nil {
+		return err
+	}
+
+	messages, info, err := fetchPage[Message](h.db, func(db *gorm.DB) *gorm.DB {
+		if withDeleted {
+			db = db.Unscoped()
+		}
+		return db.Where("thread_id = ?", thread.ID).Preload("User").Preload("Attachments")
+	}, page)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return c.Status(404).JSON(fiber.Map{"error": "Message not found"})
+	}
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch messages"})
+	}
+
+	signMessages(c.Context(), h.uploads, messages)
+	attachMemberList(h.db, messages)
+
+	setPageHeaders(c, info)
+	return c.JSON(messages)
+}
+
+func (h *ThreadsHandler) GetThreadMembers(c *fiber.Ctx) error {
+	thread := c.Locals("thread").(*Thread)
+
+	var members []ThreadMember
+	if err := h.db.Where("thread_id = ?", thread.ID).Preload("User").Order("joined_at ASC").Find(&members).Error; err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to fetch thread members"})
+	}
+
+	return c.JSON(members)
+}
+
+func (h *ThreadsHandler) JoinThread(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	thread := c.Locals("thread").(*Thread)
+
+	joined, err := joinThread(h.db, thread.ID, userID)
+	if err != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to join thread"})
+	}
+	if joined {
+		broadcastThreadMember(h.hub, thread, userID, true)
+	}
+
+	return c.JSON(fiber.Map{"message": "Joined thread"})
+}
+
+func (h *ThreadsHandler) LeaveThread(c *fiber.Ctx) error {
+	userID := c.Locals("userID").(uuid.UUID)
+	thread := c.Locals("thread").(*Thread)
+
+	result := h.db.Where("thread_id = ? AND user_id = ?", thread.ID, userID).Delete(&ThreadMember{})
+	if result.Error != nil {
+		return c.Status(500).JSON(fiber.Map{"error": "Failed to leave thread"})
+	}
+	if result.RowsAffected > 0 {
+		broadcastThreadMember(h.hub, thread, userID, false)
+	}
+
+	return c.JSON(fiber.Map{"message": "Left thread"})
+}
+
+// RunArchiver archives inactive threads every interval. It never returns.
+func (h *ThreadsHandler) RunArchiver(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := h.ArchiveInactive(); err != nil {
+			log.Printf("Failed to archive inactive threads: %v", err)
+		}
+	}
+}
+
+// ArchiveInactive archives threads whose last reply, or creation if they
+// have none, is older than their auto archive duration. Only the node whose
+// update archived a thread announces it.
+func (h *ThreadsHandler) ArchiveInactive() error {
+	var threads []Thread
+	err := h.db.Model(&threads).Clauses(clause.Returning{}).
+		Where("archived = ? AND COALESCE(last_reply_at, created_at) + auto_archive_minutes * INTERVAL '1 minute' < NOW()", false).
+		Updates(map[string]interface{}{"archived": true, "archived_at": gorm.Expr("NOW()")}).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range threads {
+		h.broadcast(websocket.EventThreadUpdate, &threads[i])
+	}
+	return nil
+}
+
+func (h *ThreadsHandler) broadcast(eventType string, thread *Thread) {
+	h.hub.BroadcastToChannel(thread.ChannelID, websocket.WSMessage{
+		Type:      eventType,
+		Data:      thread,
+		ChannelID: &thread.ChannelID,
+	})
+}
+
+// threadName validates a thread name, returning a 400 *fiber.Error if it is
+// empty or too long.
+func threadName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "", fiber.NewError(fiber.StatusBadRequest, "Thread name required")
+	}
+	if utf8.RuneCountInString(name) > MaxThreadNameLength {
+		return "", fiber.NewError(fiber.StatusBadRequest, "Thread name too long")
+	}
+	return name, nil
+}
+
+// refreshThread recomputes a thread's reply count and last reply time after
+// a reply was added or removed. A new reply also unarchives the thread.
+func refreshThread(db *gorm.DB, threadID uuid.UUID, unarchive bool) (*Thread, error) {
+	updates := map[string]interface{}{
+		"reply_count":   gorm.Expr("(SELECT COUNT(*) FROM messages WHERE thread_id = ? AND deleted_at IS NULL)", threadID),
+		"last_reply_at": gorm.Expr("(SELECT MAX(created_at) FROM messages WHERE thread_id = ? AND deleted_at IS NULL)", threadID),
+	}
+	if unarchive {
+		updates["archived"] = false
+		updates["archived_at"] = nil
+	}
+
+	thread := Thread{ID: threadID}
+	if err := db.Model(&thread).Clauses(clause.Returning{}).Updates(updates).Error; err != nil {
+		return nil, err
+	}
+	return &thread, nil
+}
+
+// joinThread adds a member to a thread, reporting whether they were new.
+func joinThread(db *gorm.DB, threadID, userID uuid.UUID) (bool, error) {
+	result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&ThreadMember{ThreadID: threadID, UserID: userID})
+	return result.RowsAffected > 0, result.Error
+}
+
+func broadcastThreadMember(hub *websocket.Hub, thread *Thread, userID uuid.UUID, joined bool) {
+	hub.BroadcastToChannel(thread.ChannelID, websocket.WSMessage{
+		Type: websocket.EventThreadMembersUpdate,
+		Data: fiber.Map{
+			"thread_id":  thread.ID,
+			"channel_id": thread.ChannelID,
+			"user_id":    userID,
+			"joined":     joined,
+		},
+		ChannelID: &thread.ChannelID,
+	})
+}
@@ -0,0 +1,260 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Flack74/realm-backend/internal/infrastructure/media"
+	"github.com/Flack74/realm-backend/internal/infrastructure/storage"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	MaxAttachmentSize        = 25 << 20
+	MaxAttachmentsPerMessage = 10
+	MaxImageSize             = 8 << 20
+	// MaxUploadSize bounds a whole multipart request.
+	MaxUploadSize = MaxAttachmentsPerMessage*MaxAttachmentSize + 1<<20
+	// MaxRequestBodySize bounds every other request body.
+	MaxRequestBodySize = 1 << 20
+
+	// SignedURLTTL is how long download URLs handed to clients stay valid.
+	SignedURLTTL = 12 * time.Hour
+
+	// MediaPath serves avatars, banners and realm icons through stable URLs
+	// that redirect to a freshly signed download URL.
+	MediaPath = "/api/v1/media/"
+)
+
+// UploadPolicy restricts what an upload endpoint accepts.
+type UploadPolicy struct {
+	MaxSize    int64
+	ImagesOnly bool
+}
+
+var (
+	AttachmentPolicy = UploadPolicy{MaxSize: MaxAttachmentSize}
+	ImagePolicy      = UploadPolicy{MaxSize: MaxImageSize, ImagesOnly: true}
+)
+
+// storedTypes are the sniffed content types kept as-is; anything else is
+// stored as application/octet-stream so it is never rendered by browsers.
+var storedTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true,
+	"video/mp4": true, "video/webm": true,
+	"audio/mpeg": true, "audio/wave": true, "application/ogg": true,
+	"application/pdf": true, "application/zip": true, "text/plain": true,
+}
+
+// inlineTypes may be displayed inline by clients; everything else downloads.
+var inlineTypes = map[string]bool{
+	"image/png": true, "image/jpeg": true, "image/gif": true, "image/webp": true,
+	"video/mp4": true, "video/webm": true,
+	"audio/mpeg": true, "audio/wave": true, "application/ogg": true,
+}
+
+// strippedFormats maps the content types whose metadata is removed on upload
+// to their image format names.
+var strippedFormats = map[string]string{
+	"image/jpeg": "jpeg", "image/png": "png", "image/webp": "webp",
+}
+
+// StoredFile describes an upload written to the blob store.
+type StoredFile struct {
+	Key      string
+	Filename string
+	MimeType string
+	Size     int64
+}
+
+// Uploader validates uploads and writes them to a BlobStore.
+type Uploader struct {
+	store storage.BlobStore
+}
+
+func NewUploader(store storage.BlobStore) *Uploader {
+	return &Uploader{store: store}
+}
+
+// Save checks an uploaded file against policy, sniffs its content type and
+// stores it below prefix.
+func (u *Uploader) Save(ctx context.Context, prefix string, fh *multipart.FileHeader, policy UploadPolicy) (*StoredFile, error) {
+	if fh.Size > policy.MaxSize {
+		return nil, fiber.NewError(fiber.StatusRequestEntityTooLarge, "File too large")
+	}
+	if fh.Size == 0 {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "File is empty")
+	}
+
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// Trust the bytes, not the client-supplied Content-Type or extension.
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	mimeType := sniffContentType(head)
+	if policy.ImagesOnly && !strings.HasPrefix(mimeType, "image/") {
+		return nil, fiber.NewError(fiber.StatusUnsupportedMediaType, "Unsupported image type")
+	}
+
+	stored := &StoredFile{
+		Key:      path.Join(prefix, uuid.NewString(), sanitizeFilename(fh.Filename)),
+		Filename: fh.Filename,
+		MimeType: mimeType,
+		Size:     fh.Size,
+	}
+	body := io.MultiReader(bytes.NewReader(head), f)
+
+	// Signed URLs go out as soon as the upload is saved, so the metadata has
+	// to be gone before then rather than after background processing.
+	if format, ok := strippedFormats[mimeType]; ok {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		clean, err := stripMetadata(data, format)
+		if err != nil {
+			return nil, err
+		}
+		body, stored.Size = bytes.NewReader(clean), int64(len(clean))
+	}
+
+	if err := u.store.Put(ctx, stored.Key, body, stored.Size, mimeType); err != nil {
+		return nil, err
+	}
+
+	return stored, nil
+}
+
+// stripMetadata removes EXIF and other metadata from an image upload. JPEG
+// and PNG files are re-encoded upright, so uploads that do not decode are
+// rejected.
+func stripMetadata(data []byte, format string) ([]byte, error) {
+	var img image.Image
+	if format != "webp" {
+		var err error
+		if img, _, err = media.Decode(data); err != nil {
+			return nil, fiber.NewError(fiber.StatusUnsupportedMediaType, "Unsupported image")
+		}
+	}
+
+	clean, _, err := media.StripMetadata(data, format, img)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusUnsupportedMediaType, "Unsupported image")
+	}
+	return clean, nil
+}
+
+// SaveAll stores every file or none of them.
+func (u *Uploader) SaveAll(ctx context.Context, prefix string, files []*multipart.FileHeader, policy UploadPolicy) ([]*StoredFile, error) {
+	stored := make([]*StoredFile, 0, len(files))
+	for _, fh := range files {
+		file, err := u.Save(ctx, prefix, fh, policy)
+		if err != nil {
+			u.DeleteAll(ctx, stored)
+			return nil, err
+		}
+		stored = append(stored, file)
+	}
+	return stored, nil
+}
+
+// DeleteAll removes stored files, logging failures; it is used to clean up
+// after a request fails.
+func (u *Uploader) DeleteAll(ctx context.Context, files []*StoredFile) {
+	for _, file := range files {
+		u.Delete(ctx, file.Key)
+	}
+}
+
+func (u *Uploader) Delete(ctx context.Context, key string) {
+	if err := u.store.Delete(ctx, key); err != nil {
+		log.Printf("Failed to delete blob %s: %v", key, err)
+	}
+}
+
+// URL returns a signed download URL for a stored object, or "" if signing
+// failed.
+func (u *Uploader) URL(ctx context.Context, key, mimeType string) string {
+	url, err := u.store.SignedURL(ctx, key, SignedURLTTL, inlineTypes[mimeType])
+	if err != nil {
+		log.Printf("Failed to sign URL for %s: %v", key, err)
+		return ""
+	}
+	return url
+}
+
+// ImageURL returns a signed URL that displays an image inline, or "".
+func (u *Uploader) ImageURL(ctx context.Context, key string) string {
+	url, err := u.store.SignedURL(ctx, key, SignedURLTTL, true)
+	if err != nil {
+		log.Printf("Failed to sign URL for %s: %v", key, err)
+		return ""
+	}
+	return url
+}
+
+// MediaURL returns the stable URL of a public image such as an avatar.
+func (u *Uploader) MediaURL(key string) string {
+	return MediaPath + key
+}
+
+// mediaKey returns the key behind a URL from MediaURL, or "".
+func mediaKey(url string) string {
+	key, ok := strings.CutPrefix(url, MediaPath)
+	if !ok {
+		return ""
+	}
+	return key
+}
+
+func sniffContentType(head []byte) string {
+	mimeType, _, err := mime.ParseMediaType(http.DetectContentType(head))
+	if err != nil || !storedTypes[mimeType] {
+		return "application/octet-stream"
+	}
+	return mimeType
+}
+
+// sanitizeFilename keeps object keys URL-safe while preserving a readable
+// name and extension.
+func sanitizeFilename(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-', r == '_':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('_')
+		}
+	}
+
+	clean := strings.TrimLeft(b.String(), ".")
+	if clean == "" {
+		clean = "file"
+	}
+	if len(clean) > 100 {
+		clean = clean[len(clean)-100:]
+	}
+	return clean
+}
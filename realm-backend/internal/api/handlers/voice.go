@@ -1,14 +1,19 @@
 package handlers
 
 import (
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"time"
 )
 
+var errVoiceFull = fiber.NewError(fiber.StatusForbidden, "Voice channel is full")
+
 type VoiceHandler struct {
-	db *gorm.DB
+	db    *gorm.DB
+	perms *PermissionResolver
 }
 
 type VoiceState struct {
@@ -35,8 +40,8 @@ type UpdateVoiceRequest struct {
 	Streaming *bool `json:"streaming"`
 }
 
-func NewVoiceHandler(db *gorm.DB) *VoiceHandler {
-	return &VoiceHandler{db: db}
+func NewVoiceHandler(db *gorm.DB, perms *PermissionResolver) *VoiceHandler {
+	return &VoiceHandler{db: db, perms: perms}
 }
 
 func (h *VoiceHandler) JoinVoice(c *fiber.Ctx) error {
@@ -47,18 +52,56 @@ func (h *VoiceHandler) JoinVoice(c *fiber.Ctx) error {
 		return c.Status(400).JSON(fiber.Map{"error": "Invalid request"})
 	}
 
-	channelID := uuid.MustParse(req.ChannelID)
+	channelID, err := uuid.Parse(req.ChannelID)
+	if err != nil {
+		return c.Status(400).JSON(fiber.Map{"error": "Invalid channel ID"})
+	}
 
-	// Remove existing voice state
-	h.db.Where("user_id = ?", userID).Delete(&VoiceState{})
+	var channel Channel
+	if err := h.db.Where("id = ? AND type = ?", channelID, ChannelTypeVoice).First(&channel).Error; err != nil {
+		return c.Status(404).JSON(fiber.Map{"error": "Voice channel not found"})
+	}
+
+	member, err := h.perms.ResolveChannel(&channel, userID)
+	if err != nil || !member.Has(PermissionViewChannels) {
+		return c.Status(404).JSON(fiber.Map{"error": "Voice channel not found"})
+	}
+	if !member.Has(PermissionConnect) {
+		return c.Status(403).JSON(fiber.Map{"error": "Missing permissions"})
+	}
+	if err := checkNSFW(h.db, &channel, userID); err != nil {
+		return err
+	}
 
-	// Create new voice state
 	voiceState := VoiceState{
 		UserID:    userID,
 		ChannelID: &channelID,
 	}
-
-	if err := h.db.Create(&voiceState).Error; err != nil {
+	err = h.db.Transaction(func(tx *gorm.DB) error {
+		// Full channels only admit members who could move others in.
+		if channel.UserLimit > 0 && !member.Has(PermissionMoveMembers) {
+			if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&Channel{}, "id = ?", channel.ID).Error; err != nil {
+				return err
+			}
+			var connected int64
+			if err := tx.Model(&VoiceState{}).Where("channel_id = ? AND user_id <> ?", channel.ID, userID).Count(&connected).Error; err != nil {
+				return err
+			}
+			if connected >= int64(channel.UserLimit) {
+				return errVoiceFull
+			}
+		}
+
+		// Remove existing voice state
+		if err := tx.Where("user_id = ?", userID).Delete(&VoiceState{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&voiceState).Error
+	})
+	if errors.Is(err, errVoiceFull) {
+		return err
+	}
+	if err != nil {
 		return c.Status(500).JSON(fiber.Map{"error": "Failed to join voice"})
 	}
 
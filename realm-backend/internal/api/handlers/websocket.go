@@ -2,55 +2,84 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
+	"time"
 
 	"github.com/Flack74/realm-backend/internal/infrastructure/websocket"
 	"github.com/gofiber/fiber/v2"
 	ws "github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// readTimeout closes connections that sent neither a message, a
+	// heartbeat nor a pong for two heartbeat intervals.
+	readTimeout  = 2 * websocket.HeartbeatInterval
+	pingPeriod   = websocket.HeartbeatInterval / 2
+	writeTimeout = 10 * time.Second
+	maxFrameSize = 64 * 1024
 )
 
 type WebSocketHandler struct {
-	hub *websocket.Hub
+	hub   *websocket.Hub
+	db    *gorm.DB
+	perms *PermissionResolver
 }
 
-func NewWebSocketHandler(hub *websocket.Hub) *WebSocketHandler {
-	return &WebSocketHandler{hub: hub}
+func NewWebSocketHandler(hub *websocket.Hub, db *gorm.DB, perms *PermissionResolver) *WebSocketHandler {
+	return &WebSocketHandler{hub: hub, db: db, perms: perms}
 }
 
 func (h *WebSocketHandler) HandleWebSocket(c *fiber.Ctx) error {
 	return ws.New(func(conn *ws.Conn) {
 		userID := c.Locals("userID").(uuid.UUID)
-		clientID := uuid.New()
+		send := make(chan []byte, websocket.SendBufferSize)
 
 		client := &websocket.Client{
-			ID:     clientID,
+			ID:     uuid.New(),
 			UserID: userID,
-			Conn:   conn,
-			Send:   make(chan []byte, 256),
+			Send:   send,
 		}
 
-		h.hub.Register <- client
+		hello, _ := json.Marshal(websocket.WSMessage{
+			Type: websocket.EventHello,
+			Data: map[string]interface{}{
+				"session_id":         client.ID,
+				"heartbeat_interval": websocket.HeartbeatInterval.Milliseconds(),
+			},
+		})
+		send <- hello
+
+		h.hub.Connect(client)
 
-		go h.writePump(client)
-		h.readPump(client)
+		go h.writePump(conn, send)
+		h.readPump(conn, client, send)
 	})(c)
 }
 
-func (h *WebSocketHandler) readPump(client *websocket.Client) {
+func (h *WebSocketHandler) readPump(conn *ws.Conn, client *websocket.Client, send chan []byte) {
 	defer func() {
-		h.hub.Unregister <- client
-		client.Conn.Close()
+		h.hub.Detach(client, send)
+		conn.Close()
 	}()
 
+	conn.SetReadLimit(maxFrameSize)
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(readTimeout))
+	})
+
 	for {
-		_, message, err := client.Conn.ReadMessage()
+		_, message, err := conn.ReadMessage()
 		if err != nil {
 			if ws.IsUnexpectedCloseError(err, ws.CloseGoingAway, ws.CloseAbnormalClosure) {
 				log.Printf("WebSocket error: %v", err)
 			}
 			break
 		}
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
 
 		var wsMsg websocket.WSMessage
 		if err := json.Unmarshal(message, &wsMsg); err != nil {
@@ -58,31 +87,103 @@ func (h *WebSocketHandler) readPump(client *websocket.Client) {
 			continue
 		}
 
+		if wsMsg.Type == "resume" {
+			client = h.resume(client, message)
+			continue
+		}
+
 		h.handleMessage(client, &wsMsg)
 	}
 }
 
-func (h *WebSocketHandler) writePump(client *websocket.Client) {
-	defer client.Conn.Close()
+func (h *WebSocketHandler) writePump(conn *ws.Conn, send chan []byte) {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
 
-	for message := range client.Send {
-		if err := client.Conn.WriteMessage(ws.TextMessage, message); err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			return
+	for {
+		select {
+		case message, ok := <-send:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if !ok {
+				conn.WriteMessage(ws.CloseMessage, []byte{})
+				return
+			}
+			if err := conn.WriteMessage(ws.TextMessage, message); err != nil {
+				log.Printf("WebSocket write error: %v", err)
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			if err := conn.WriteMessage(ws.PingMessage, nil); err != nil {
+				return
+			}
 		}
 	}
 }
 
+// resume attaches the connection to a previous session and replays missed
+// events. It returns the session the connection is bound to afterwards.
+func (h *WebSocketHandler) resume(client *websocket.Client, raw []byte) *websocket.Client {
+	var req struct {
+		Data struct {
+			SessionID uuid.UUID `json:"session_id"`
+			Seq       uint64    `json:"seq"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(raw, &req); err != nil {
+		h.hub.SendToClient(client.ID, websocket.WSMessage{Type: websocket.EventInvalidSession})
+		return client
+	}
+
+	session, err := h.hub.Resume(client, req.Data.SessionID, req.Data.Seq)
+	if err != nil {
+		h.hub.SendToClient(client.ID, websocket.WSMessage{
+			Type: websocket.EventInvalidSession,
+			Data: map[string]interface{}{"message": err.Error()},
+		})
+		return client
+	}
+
+	h.hub.SendToClient(session.ID, websocket.WSMessage{
+		Type: websocket.EventResumed,
+		Data: map[string]interface{}{
+			"session_id": session.ID,
+			"seq":        session.Seq(),
+		},
+	})
+	return session
+}
+
 func (h *WebSocketHandler) handleMessage(client *websocket.Client, msg *websocket.WSMessage) {
 	switch msg.Type {
+	case "heartbeat":
+		h.hub.SendToClient(client.ID, websocket.WSMessage{
+			Type: websocket.EventHeartbeatAck,
+			Data: map[string]interface{}{"seq": client.Seq()},
+		})
 	case "join_realm":
 		if msg.RealmID != nil {
-			h.hub.AddClientToRealm(client.ID, *msg.RealmID)
+			h.joinRealm(client, *msg.RealmID)
+		}
+	case "leave_realm":
+		if msg.RealmID != nil {
+			h.hub.RemoveClientFromRealm(client.ID, *msg.RealmID)
 		}
 	case "join_channel":
 		if msg.ChannelID != nil {
-			h.hub.AddClientToChannel(client.ID, *msg.ChannelID)
+			h.joinChannel(client, *msg.ChannelID)
 		}
+	case "leave_channel":
+		if msg.ChannelID != nil {
+			h.hub.RemoveClientFromChannel(client.ID, *msg.ChannelID)
+		}
+	case "idle":
+		h.hub.SetIdle(client, true)
+	case "active":
+		h.hub.SetIdle(client, false)
 	case "typing_start":
 		h.broadcastTyping(client, msg, true)
 	case "typing_stop":
@@ -90,6 +191,61 @@ func (h *WebSocketHandler) handleMessage(client *websocket.Client, msg *websocke
 	}
 }
 
+func (h *WebSocketHandler) joinRealm(client *websocket.Client, realmID uuid.UUID) {
+	if _, err := h.perms.Resolve(realmID, client.UserID); err != nil {
+		h.sendError(client, "join_realm", err)
+		return
+	}
+
+	h.hub.AddClientToRealm(client.ID, realmID)
+}
+
+func (h *WebSocketHandler) joinChannel(client *websocket.Client, channelID uuid.UUID) {
+	var channel Channel
+	if err := h.db.Where("id = ?", channelID).First(&channel).Error; err != nil {
+		h.sendError(client, "join_channel", err)
+		return
+	}
+
+	member, err := h.perms.ResolveChannel(&channel, client.UserID)
+	if err != nil {
+		h.sendError(client, "join_channel", err)
+		return
+	}
+	if !member.Has(PermissionViewChannels) {
+		h.sendError(client, "join_channel", gorm.ErrRecordNotFound)
+		return
+	}
+	if err := checkNSFW(h.db, &channel, client.UserID); err != nil {
+		h.sendError(client, "join_channel", err)
+		return
+	}
+
+	h.hub.AddClientToChannel(client.ID, channel.RealmID, channel.ID)
+}
+
+// sendError reports a rejected operation back to the client that sent it.
+func (h *WebSocketHandler) sendError(client *websocket.Client, op string, err error) {
+	message := "Access denied"
+	var fe *fiber.Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		message = "Not found"
+	} else if errors.As(err, &fe) && fe.Code < 500 {
+		message = fe.Message
+	} else if !errors.Is(err, ErrNotRealmMember) {
+		log.Printf("WebSocket %s failed: %v", op, err)
+		message = "Internal error"
+	}
+
+	h.hub.SendToClient(client.ID, websocket.WSMessage{
+		Type: "error",
+		Data: map[string]interface{}{
+			"op":      op,
+			"message": message,
+		},
+	})
+}
+
 func (h *WebSocketHandler) broadcastTyping(client *websocket.Client, msg *websocket.WSMessage, isTyping bool) {
 	typingMsg := websocket.WSMessage{
 		Type: "typing",
@@ -100,7 +256,20 @@ func (h *WebSocketHandler) broadcastTyping(client *websocket.Client, msg *websoc
 		ChannelID: msg.ChannelID,
 	}
 
-	if msg.ChannelID != nil {
-		h.hub.BroadcastToChannel(*msg.ChannelID, typingMsg)
+	// Only subscribers of a channel may signal typing in it, and only if
+	// they may send messages there, which timed out members may not.
+	if msg.ChannelID == nil || !h.hub.InChannel(client.ID, *msg.ChannelID) {
+		return
+	}
+
+	var channel Channel
+	if err := h.db.Where("id = ?", *msg.ChannelID).First(&channel).Error; err != nil {
+		return
+	}
+	member, err := h.perms.ResolveChannel(&channel, client.UserID)
+	if err != nil || !member.Has(PermissionSendMessages) {
+		return
 	}
+
+	h.hub.BroadcastToChannel(*msg.ChannelID, typingMsg)
 }
\ No newline at end of file
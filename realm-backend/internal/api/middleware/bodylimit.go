@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// BodyLimit rejects request bodies larger than limit. Multipart bodies on
+// routes under one of uploadPrefixes may be up to uploadLimit instead; they
+// are streamed into temporary files as they are parsed rather than held in
+// memory.
+//
+// The server must stream request bodies (fiber.Config.StreamRequestBody)
+// with a BodyLimit no larger than limit and must not pre-parse multipart
+// forms, so that nothing past limit has been read when this runs.
+func BodyLimit(limit, uploadLimit int, uploadPrefixes ...string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		length := c.Request().Header.ContentLength()
+		if length == -1 {
+			// Chunked bodies would be read without any bound.
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusLengthRequired).JSON(fiber.Map{
+				"error": "Content-Length required",
+			})
+		}
+
+		max := limit
+		if strings.HasPrefix(c.Get(fiber.HeaderContentType), fiber.MIMEMultipartForm) {
+			for _, prefix := range uploadPrefixes {
+				if strings.HasPrefix(c.Path(), prefix) {
+					max = uploadLimit
+					break
+				}
+			}
+		}
+		if length > max {
+			// The rest of the body is still unread on the connection.
+			c.Context().SetConnectionClose()
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{
+				"error": "Request body too large",
+			})
+		}
+
+		return c.Next()
+	}
+}
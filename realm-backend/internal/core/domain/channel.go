@@ -8,8 +8,9 @@ import (
 type ChannelType string
 
 const (
-	ChannelTypeText  ChannelType = "text"
-	ChannelTypeVoice ChannelType = "voice"
+	ChannelTypeText         ChannelType = "text"
+	ChannelTypeVoice        ChannelType = "voice"
+	ChannelTypeAnnouncement ChannelType = "announcement"
 )
 
 type Channel struct {
@@ -0,0 +1,155 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/buckket/go-blurhash"
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// MaxPixels bounds the decoded size of an image to guard against
+// decompression bombs.
+const MaxPixels = 50_000_000
+
+var ErrTooLarge = errors.New("image dimensions too large")
+
+// Decode decodes an image and applies its EXIF orientation, so the result is
+// upright once the metadata is stripped. It returns the format name reported
+// by the image package ("jpeg", "png", "gif" or "webp").
+func Decode(data []byte) (image.Image, string, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, "", ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+
+	if format == "jpeg" {
+		img = orient(img, jpegOrientation(data))
+	}
+	return img, format, nil
+}
+
+// Fit scales img down to fit within maxW x maxH, keeping its aspect ratio.
+// Smaller images are returned unchanged.
+func Fit(img image.Image, maxW, maxH int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxW && h <= maxH {
+		return img
+	}
+
+	if w*maxH > h*maxW {
+		h = max(1, h*maxW/w)
+		w = maxW
+	} else {
+		w = max(1, w*maxH/h)
+		h = maxH
+	}
+	return scale(img, b, w, h)
+}
+
+// Cover scales and centre-crops img to exactly w x h.
+func Cover(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	// Crop the source to the target aspect ratio first.
+	crop := b
+	if sw*h > sh*w {
+		cw := sh * w / h
+		crop.Min.X += (sw - cw) / 2
+		crop.Max.X = crop.Min.X + cw
+	} else {
+		ch := sw * h / w
+		crop.Min.Y += (sh - ch) / 2
+		crop.Max.Y = crop.Min.Y + ch
+	}
+	return scale(img, crop, w, h)
+}
+
+func scale(img image.Image, src image.Rectangle, w, h int) image.Image {
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, src, xdraw.Src, nil)
+	return dst
+}
+
+// Opaque reports whether img has no transparent pixels.
+func Opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	return false
+}
+
+// Encode writes img as PNG when it has transparency and as JPEG otherwise.
+// It returns the content type and file extension used.
+func Encode(img image.Image) ([]byte, string, string, error) {
+	var buf bytes.Buffer
+	if Opaque(img) {
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 85})
+		return buf.Bytes(), "image/jpeg", ".jpg", err
+	}
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), "image/png", ".png", err
+}
+
+// EncodePNG writes img as PNG.
+func EncodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	return buf.Bytes(), err
+}
+
+// BlurHash computes a compact placeholder for img.
+func BlurHash(img image.Image) (string, error) {
+	return blurhash.Encode(4, 3, Fit(img, 32, 32))
+}
+
+// StripMetadata removes EXIF and other metadata from an encoded image. JPEG
+// and PNG files are re-encoded from img, which Decode already oriented; WebP
+// metadata chunks are dropped without re-encoding. GIFs carry no EXIF and are
+// left alone so animations survive. It reports whether data changed.
+func StripMetadata(data []byte, format string, img image.Image) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	switch format {
+	case "jpeg":
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 92}); err != nil {
+			return nil, false, err
+		}
+	case "png":
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, false, err
+		}
+	case "webp":
+		clean, err := stripWebP(data)
+		if err != nil {
+			return nil, false, err
+		}
+		return clean, len(clean) != len(data), nil
+	default:
+		return data, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// toNRGBA returns img as an *image.NRGBA with its origin at (0, 0).
+func toNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
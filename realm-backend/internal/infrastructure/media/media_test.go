@@ -0,0 +1,157 @@
+package media
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func gradient(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	return img
+}
+
+// withOrientation inserts an EXIF APP1 segment carrying orientation o right
+// after the SOI marker of a JPEG file.
+func withOrientation(jpg []byte, o uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, 0x0112)
+	tiff = binary.BigEndian.AppendUint16(tiff, 3)
+	tiff = binary.BigEndian.AppendUint32(tiff, 1)
+	tiff = binary.BigEndian.AppendUint16(tiff, o)
+	tiff = append(tiff, 0, 0, 0, 0, 0, 0)
+
+	segment := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := []byte{0xFF, 0xE1}
+	app1 = binary.BigEndian.AppendUint16(app1, uint16(len(segment)+2))
+	app1 = append(app1, segment...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, app1...)
+	return append(out, jpg[2:]...)
+}
+
+func TestDecodeAppliesOrientationAndStripsIt(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, gradient(40, 20), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := withOrientation(buf.Bytes(), 6)
+
+	if o := jpegOrientation(data); o != 6 {
+		t.Fatalf("expected orientation 6, got %d", o)
+	}
+
+	img, format, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode failed: %v", err)
+	}
+	if format != "jpeg" {
+		t.Fatalf("expected jpeg, got %s", format)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 40 {
+		t.Fatalf("expected a rotated 20x40 image, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	clean, changed, err := StripMetadata(data, format, img)
+	if err != nil || !changed {
+		t.Fatalf("StripMetadata failed: changed=%v err=%v", changed, err)
+	}
+	if o := jpegOrientation(clean); o != 1 {
+		t.Fatalf("expected metadata to be stripped, orientation %d remains", o)
+	}
+}
+
+func TestFitAndCover(t *testing.T) {
+	src := gradient(400, 200)
+
+	if b := Fit(src, 100, 100).Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Fatalf("Fit: expected 100x50, got %dx%d", b.Dx(), b.Dy())
+	}
+	if Fit(src, 800, 800) != image.Image(src) {
+		t.Fatal("Fit should not upscale")
+	}
+	if b := Cover(src, 64, 64).Bounds(); b.Dx() != 64 || b.Dy() != 64 {
+		t.Fatalf("Cover: expected 64x64, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	hash, err := BlurHash(src)
+	if err != nil || hash == "" {
+		t.Fatalf("BlurHash failed: %q %v", hash, err)
+	}
+}
+
+func TestStripWebPDropsMetadataChunks(t *testing.T) {
+	chunk := func(fourCC string, payload []byte) []byte {
+		c := append([]byte(fourCC), 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(c[4:], uint32(len(payload)))
+		c = append(c, payload...)
+		if len(payload)%2 == 1 {
+			c = append(c, 0)
+		}
+		return c
+	}
+
+	var body []byte
+	body = append(body, chunk("VP8X", []byte{0x0C, 0, 0, 0, 0, 0, 0, 0, 0, 0})...)
+	body = append(body, chunk("VP8 ", []byte{1, 2, 3})...)
+	body = append(body, chunk("EXIF", []byte("secret gps"))...)
+	body = append(body, chunk("XMP ", []byte("<x/>"))...)
+
+	data := append([]byte("RIFF\x00\x00\x00\x00WEBP"), body...)
+	binary.LittleEndian.PutUint32(data[4:], uint32(len(data)-8))
+
+	clean, err := stripWebP(data)
+	if err != nil {
+		t.Fatalf("stripWebP failed: %v", err)
+	}
+	if bytes.Contains(clean, []byte("EXIF")) || bytes.Contains(clean, []byte("secret gps")) {
+		t.Fatal("expected the EXIF chunk to be removed")
+	}
+	if clean[20]&0x0C != 0 {
+		t.Fatalf("expected VP8X metadata flags to be cleared, got %#x", clean[20])
+	}
+	if size := binary.LittleEndian.Uint32(clean[4:]); int(size) != len(clean)-8 {
+		t.Fatalf("RIFF size %d does not match %d", size, len(clean)-8)
+	}
+}
+
+func TestPoolRunsJobsAndSurvivesPanics(t *testing.T) {
+	pool := NewPool(2, 1)
+
+	var done atomic.Int32
+	for i := 0; i < 10; i++ {
+		i := i
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := pool.Submit(ctx, func() {
+			if i == 3 {
+				panic("bad image")
+			}
+			done.Add(1)
+		})
+		cancel()
+		if err != nil {
+			t.Fatalf("Submit failed: %v", err)
+		}
+	}
+
+	pool.Close()
+	if got := done.Load(); got != 9 {
+		t.Fatalf("expected 9 completed jobs, got %d", got)
+	}
+	if err := pool.Submit(context.Background(), func() {}); err != ErrPoolClosed {
+		t.Fatalf("expected ErrPoolClosed after Close, got %v", err)
+	}
+}
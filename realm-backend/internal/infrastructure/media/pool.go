@@ -0,0 +1,77 @@
+package media
+
+import (
+	"context"
+	"errors"
+	"log"
+	"runtime/debug"
+	"sync"
+)
+
+var ErrPoolClosed = errors.New("worker pool closed")
+
+// Pool runs jobs on a fixed number of background workers with a bounded
+// queue, so bursts of uploads cannot spawn unbounded image work.
+type Pool struct {
+	jobs   chan func()
+	wg     sync.WaitGroup
+	mu     sync.RWMutex
+	closed bool
+}
+
+func NewPool(workers, queue int) *Pool {
+	p := &Pool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// Submit queues job, waiting for room in the queue until ctx is done.
+func (p *Pool) Submit(ctx context.Context, job func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		return ErrPoolClosed
+	}
+
+	select {
+	case p.jobs <- job:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops accepting jobs and waits for queued ones to finish.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.jobs)
+	p.mu.Unlock()
+
+	p.wg.Wait()
+}
+
+func (p *Pool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		p.run(job)
+	}
+}
+
+// run isolates the pool from panics in image decoders fed hostile input.
+func (p *Pool) run(job func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Media job panicked: %v\n%s", r, debug.Stack())
+		}
+	}()
+	job()
+}
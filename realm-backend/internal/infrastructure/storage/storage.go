@@ -0,0 +1,63 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	ErrNotFound         = errors.New("object not found")
+	ErrInvalidSignature = errors.New("invalid or expired signature")
+)
+
+// BlobStore stores uploaded files under opaque keys and hands out
+// time-limited download URLs for them.
+type BlobStore interface {
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Get opens a stored object; it returns ErrNotFound if there is none.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL that downloads the object until ttl elapses.
+	// Downloads are sent as attachments unless inline is set.
+	SignedURL(ctx context.Context, key string, ttl time.Duration, inline bool) (string, error)
+}
+
+// NewBlobStoreFromEnv builds the store selected by STORAGE_DRIVER ("local" by
+// default, or "s3").
+func NewBlobStoreFromEnv() (BlobStore, error) {
+	switch driver := os.Getenv("STORAGE_DRIVER"); driver {
+	case "", "local":
+		root := os.Getenv("STORAGE_LOCAL_PATH")
+		if root == "" {
+			root = "./uploads"
+		}
+		baseURL := os.Getenv("STORAGE_PUBLIC_URL")
+		if baseURL == "" {
+			baseURL = "/api/v1/files"
+		}
+		secret := os.Getenv("STORAGE_SIGNING_SECRET")
+		if secret == "" {
+			secret = os.Getenv("JWT_SECRET")
+		}
+		return NewLocalStore(root, baseURL, []byte(secret))
+	case "s3":
+		store, err := NewS3Store(S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			UseSSL:    os.Getenv("S3_USE_SSL") != "false",
+		})
+		if err != nil {
+			return nil, err
+		}
+		return store, store.EnsureBucket(context.Background())
+	default:
+		return nil, fmt.Errorf("unknown storage driver %q", driver)
+	}
+}
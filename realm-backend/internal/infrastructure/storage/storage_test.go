@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalStoreSignedURLs(t *testing.T) {
+	ctx := context.Background()
+	store, err := NewLocalStore(t.TempDir(), "/api/v1/files", []byte("secret"))
+	if err != nil {
+		t.Fatalf("NewLocalStore failed: %v", err)
+	}
+
+	key := "attachments/abc/hello.txt"
+	if err := store.Put(ctx, key, strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	r, err := store.Get(ctx, key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Fatalf("expected stored content, got %q", data)
+	}
+
+	raw, err := store.SignedURL(ctx, key, time.Minute, false)
+	if err != nil {
+		t.Fatalf("SignedURL failed: %v", err)
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		t.Fatalf("invalid signed URL %q: %v", raw, err)
+	}
+	if got := strings.TrimPrefix(u.Path, "/api/v1/files/"); got != key {
+		t.Fatalf("expected key %q in URL, got %q", key, got)
+	}
+	q := u.Query()
+
+	f, err := store.Open(key, q.Get("expires"), q.Get("signature"), false)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	data, _ = io.ReadAll(f)
+	f.Close()
+	if string(data) != "hello" {
+		t.Fatalf("expected stored content, got %q", data)
+	}
+
+	// The signature covers the key, expiry and disposition.
+	if _, err := store.Open("attachments/abc/other.txt", q.Get("expires"), q.Get("signature"), false); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected a signature mismatch for another key, got %v", err)
+	}
+	if _, err := store.Open(key, q.Get("expires"), q.Get("signature"), true); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected a signature mismatch for inline, got %v", err)
+	}
+
+	expired, _ := store.SignedURL(ctx, key, -time.Minute, false)
+	u, _ = url.Parse(expired)
+	if _, err := store.Open(key, u.Query().Get("expires"), u.Query().Get("signature"), false); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected an expired URL to be rejected, got %v", err)
+	}
+
+	if err := store.Delete(ctx, key); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := store.Open(key, q.Get("expires"), q.Get("signature"), false); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected a deleted object to be missing, got %v", err)
+	}
+	if _, err := store.Get(ctx, key); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected Get of a deleted object to fail, got %v", err)
+	}
+}
+
+func TestLocalStoreRejectsEscapingKeys(t *testing.T) {
+	store, err := NewLocalStore(t.TempDir(), "/files", []byte("secret"))
+	if err != nil {
+		t.Fatalf("NewLocalStore failed: %v", err)
+	}
+
+	for _, key := range []string{"", "../etc/passwd", "/abs", "a/../../b"} {
+		if err := store.Put(context.Background(), key, strings.NewReader("x"), 1, "text/plain"); err == nil {
+			t.Errorf("expected key %q to be rejected", key)
+		}
+	}
+}
+
+// TestS3Store runs against an S3-compatible server such as a local MinIO:
+//
+//	S3_TEST_ENDPOINT=localhost:9000 S3_TEST_ACCESS_KEY=minioadmin S3_TEST_SECRET_KEY=minioadmin go test ./...
+func TestS3Store(t *testing.T) {
+	endpoint := os.Getenv("S3_TEST_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("S3_TEST_ENDPOINT not set")
+	}
+
+	ctx := context.Background()
+	store, err := NewS3Store(S3Config{
+		Endpoint:  endpoint,
+		Bucket:    "realm-test",
+		AccessKey: os.Getenv("S3_TEST_ACCESS_KEY"),
+		SecretKey: os.Getenv("S3_TEST_SECRET_KEY"),
+	})
+	if err != nil {
+		t.Fatalf("NewS3Store failed: %v", err)
+	}
+	if err := store.EnsureBucket(ctx); err != nil {
+		t.Fatalf("EnsureBucket failed: %v", err)
+	}
+
+	key := "attachments/test/hello.txt"
+	if err := store.Put(ctx, key, strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	defer store.Delete(ctx, key)
+
+	signed, err := store.SignedURL(ctx, key, time.Minute, false)
+	if err != nil {
+		t.Fatalf("SignedURL failed: %v", err)
+	}
+
+	resp, err := http.Get(signed)
+	if err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(data) != "hello" {
+		t.Fatalf("expected the stored object, got %d %q", resp.StatusCode, data)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Disposition"), "attachment") {
+		t.Fatalf("expected an attachment disposition, got %q", resp.Header.Get("Content-Disposition"))
+	}
+}
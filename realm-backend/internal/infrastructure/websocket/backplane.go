@@ -0,0 +1,83 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// Scope identifies which clients an envelope is addressed to.
+type Scope string
+
+const (
+	ScopeAll     Scope = "all"
+	ScopeUser    Scope = "user"
+	ScopeRealm   Scope = "realm"
+	ScopeChannel Scope = "channel"
+	// ScopeUsers addresses the users in Targets with a single envelope.
+	ScopeUsers Scope = "users"
+)
+
+// Envelope is an event relayed between hub nodes.
+type Envelope struct {
+	NodeID  string          `json:"node_id"`
+	Scope   Scope           `json:"scope"`
+	Target  uuid.UUID       `json:"target"`
+	Targets []uuid.UUID     `json:"targets,omitempty"`
+	Payload json.RawMessage `json:"payload"`
+}
+
+// Backplane relays broadcasts between hub nodes so that clients connected to
+// different replicas see the same events. Implementations deliver every
+// published envelope to every subscriber, including the publishing node; the
+// hub drops its own envelopes by node ID.
+type Backplane interface {
+	Publish(ctx context.Context, env Envelope) error
+	// Subscribe registers handler for envelopes published from now on.
+	Subscribe(ctx context.Context, handler func(Envelope)) error
+	Close() error
+}
+
+// MemoryBackplane is an in-process Backplane, used to wire several hubs
+// together in tests.
+type MemoryBackplane struct {
+	mu       sync.RWMutex
+	handlers []func(Envelope)
+	closed   bool
+}
+
+func NewMemoryBackplane() *MemoryBackplane {
+	return &MemoryBackplane{}
+}
+
+func (b *MemoryBackplane) Publish(ctx context.Context, env Envelope) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if b.closed {
+		return nil
+	}
+	for _, handler := range b.handlers {
+		handler(env)
+	}
+	return nil
+}
+
+func (b *MemoryBackplane) Subscribe(ctx context.Context, handler func(Envelope)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+func (b *MemoryBackplane) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	b.handlers = nil
+	return nil
+}
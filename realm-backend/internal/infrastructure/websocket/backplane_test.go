@@ -0,0 +1,141 @@
+package websocket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestNode(t *testing.T, bp Backplane) *Hub {
+	t.Helper()
+	hub := NewHub()
+	if err := hub.UseBackplane(bp); err != nil {
+		t.Fatalf("UseBackplane failed: %v", err)
+	}
+	go hub.Run()
+	t.Cleanup(hub.Stop)
+	return hub
+}
+
+// received collects every frame currently queued for a connection.
+func received(send chan []byte) []string {
+	var frames []string
+	for {
+		select {
+		case frame := <-send:
+			frames = append(frames, string(frame))
+		case <-time.After(50 * time.Millisecond):
+			return frames
+		}
+	}
+}
+
+func TestBackplaneFansOutAcrossNodes(t *testing.T) {
+	bp := NewMemoryBackplane()
+	nodeA := newTestNode(t, bp)
+	nodeB := newTestNode(t, bp)
+
+	if nodeA.NodeID() == nodeB.NodeID() {
+		t.Fatal("nodes must have distinct IDs")
+	}
+
+	realmID := uuid.New()
+	channelID := uuid.New()
+	userID := uuid.New()
+
+	onA := newTestClient(userID, SendBufferSize)
+	onB := newTestClient(userID, SendBufferSize)
+	nodeA.Connect(onA)
+	nodeB.Connect(onB)
+	nodeA.AddClientToChannel(onA.ID, realmID, channelID)
+	nodeB.AddClientToChannel(onB.ID, realmID, channelID)
+	nodeB.AddClientToRealm(onB.ID, realmID)
+
+	nodeA.BroadcastToChannel(channelID, WSMessage{Type: "message_create"})
+	nodeA.BroadcastToRealm(realmID, WSMessage{Type: "channel_update"})
+	nodeB.BroadcastToUser(userID, WSMessage{Type: "read_state_update"})
+
+	// Each client sees every event exactly once, whichever node published it.
+	if frames := received(onA.Send); len(frames) != 2 {
+		t.Fatalf("client on node A expected 2 frames, got %d: %v", len(frames), frames)
+	}
+	if frames := received(onB.Send); len(frames) != 3 {
+		t.Fatalf("client on node B expected 3 frames, got %d: %v", len(frames), frames)
+	}
+}
+
+func TestBackplaneDropsOwnEnvelopes(t *testing.T) {
+	bp := NewMemoryBackplane()
+	hub := newTestNode(t, bp)
+
+	client := newTestClient(uuid.New(), SendBufferSize)
+	hub.Connect(client)
+
+	hub.Broadcast(WSMessage{Type: "noop"})
+
+	if frames := received(client.Send); len(frames) != 1 {
+		t.Fatalf("expected the local broadcast once, got %d frames", len(frames))
+	}
+}
+
+func TestBackplaneRelaysUserBatches(t *testing.T) {
+	bp := NewMemoryBackplane()
+	nodeA := newTestNode(t, bp)
+	nodeB := newTestNode(t, bp)
+
+	onA := newTestClient(uuid.New(), SendBufferSize)
+	onB := newTestClient(uuid.New(), SendBufferSize)
+	other := newTestClient(uuid.New(), SendBufferSize)
+	nodeA.Connect(onA)
+	nodeB.Connect(onB)
+	nodeB.Connect(other)
+
+	nodeA.BroadcastToUsers([]uuid.UUID{onA.UserID, onB.UserID}, WSMessage{Type: "presence_update"})
+
+	if frames := received(onA.Send); len(frames) != 1 {
+		t.Fatalf("client on node A expected 1 frame, got %d", len(frames))
+	}
+	if frames := received(onB.Send); len(frames) != 1 {
+		t.Fatalf("client on node B expected 1 frame, got %d", len(frames))
+	}
+	if frames := received(other.Send); len(frames) != 0 {
+		t.Fatalf("unaddressed client expected no frames, got %d", len(frames))
+	}
+}
+
+func TestBackplaneEvictsMembersAcrossNodes(t *testing.T) {
+	bp := NewMemoryBackplane()
+	nodeA := newTestNode(t, bp)
+	nodeB := newTestNode(t, bp)
+
+	realmID := uuid.New()
+	channelID := uuid.New()
+	otherRealmID := uuid.New()
+
+	evicted := newTestClient(uuid.New(), SendBufferSize)
+	kept := newTestClient(uuid.New(), SendBufferSize)
+	for _, client := range []*Client{evicted, kept} {
+		nodeB.Connect(client)
+		nodeB.AddClientToRealm(client.ID, realmID)
+		nodeB.AddClientToChannel(client.ID, realmID, channelID)
+	}
+	nodeB.AddClientToRealm(evicted.ID, otherRealmID)
+
+	// The user is banned through node A while connected to node B.
+	nodeA.EvictMembers(realmID, evicted.UserID)
+
+	waitFor(t, "eviction on node B", func() bool {
+		return !nodeB.InChannel(evicted.ID, channelID)
+	})
+	nodeA.BroadcastToRealm(realmID, WSMessage{Type: "member_update"})
+	nodeA.BroadcastToChannel(channelID, WSMessage{Type: "message_create"})
+	nodeA.BroadcastToRealm(otherRealmID, WSMessage{Type: "channel_update"})
+
+	if frames := received(evicted.Send); len(frames) != 1 {
+		t.Fatalf("expected the evicted client to only see its other realm, got %v", frames)
+	}
+	if frames := received(kept.Send); len(frames) != 2 {
+		t.Fatalf("expected the remaining member to receive 2 frames, got %d", len(frames))
+	}
+}
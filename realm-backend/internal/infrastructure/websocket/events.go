@@ -0,0 +1,38 @@
+package websocket
+
+// Event types pushed to clients through the hub.
+const (
+	EventMessageCreate      = "message_create"
+	EventMessageUpdate      = "message_update"
+	EventMessageDelete      = "message_delete"
+	EventMessageDeleteBulk  = "message_delete_bulk"
+	EventReactionAdd        = "reaction_add"
+	EventReactionRemove     = "reaction_remove"
+	EventPresenceUpdate     = "presence_update"
+	EventChannelPinsUpdate  = "channel_pins_update"
+	EventNotificationCreate = "notification_create"
+	EventReadStateUpdate    = "read_state_update"
+
+	EventMemberTimeoutUpdate = "member_timeout_update"
+	EventMemberUpdate        = "member_update"
+
+	EventRealmUpdate = "realm_update"
+	EventRealmDelete = "realm_delete"
+
+	EventChannelUpdate  = "channel_update"
+	EventCategoryCreate = "category_create"
+	EventCategoryUpdate = "category_update"
+	EventCategoryDelete = "category_delete"
+
+	EventThreadCreate        = "thread_create"
+	EventThreadUpdate        = "thread_update"
+	EventThreadMembersUpdate = "thread_members_update"
+)
+
+// Gateway control events.
+const (
+	EventHello          = "hello"
+	EventHeartbeatAck   = "heartbeat_ack"
+	EventResumed        = "resumed"
+	EventInvalidSession = "invalid_session"
+)
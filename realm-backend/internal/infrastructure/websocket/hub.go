@@ -1,53 +1,110 @@
 package websocket
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/gofiber/websocket/v2"
 	"github.com/google/uuid"
 )
 
+// Client is a gateway session. Its ID doubles as the session ID a client
+// presents to resume, and it outlives the connection that created it for
+// ResumeWindow so events missed during a reconnect can be replayed.
 type Client struct {
 	ID     uuid.UUID
 	UserID uuid.UUID
-	Conn   *websocket.Conn
-	Send   chan []byte
+	// Send is the outbound queue of the attached connection, nil while the
+	// session is detached. Guarded by mu once the client is connected.
+	Send chan []byte
+
+	// Rooms the client is subscribed to, guarded by the hub mutex.
+	// channels maps each channel to the realm it belongs to.
+	realms   map[uuid.UUID]bool
+	channels map[uuid.UUID]uuid.UUID
+
+	mu         sync.Mutex
+	seq        uint64
+	replay     replayRing
+	detachedAt time.Time
+	idle       bool
+	evicting   atomic.Bool
 }
 
+// close detaches whatever connection is bound to the session.
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.detachLocked(c.Send)
+}
+
+// release unbinds the attached connection without closing it.
+func (c *Client) release() chan []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	send := c.Send
+	c.Send = nil
+	return send
+}
+
+type eviction struct {
+	client *Client
+	send   chan []byte
+}
+
+// Hub fans events out to connected clients. Client lifecycle (register,
+// unregister, eviction of slow consumers and expiry of detached sessions) is
+// owned by the Run goroutine; broadcasts hand connections whose buffers are
+// full back to Run instead of closing them themselves. Every send and close
+// of a connection's queue happens under the owning client's mutex.
 type Hub struct {
-	clients    map[uuid.UUID]*Client
-	userClients map[uuid.UUID][]*Client
-	realmClients map[uuid.UUID][]*Client
-	channelClients map[uuid.UUID][]*Client
-	Register   chan *Client
-	Unregister chan *Client
-	broadcast  chan []byte
-	mutex      sync.RWMutex
+	clients        map[uuid.UUID]*Client
+	userClients    map[uuid.UUID][]*Client
+	realmClients   map[uuid.UUID]map[uuid.UUID]*Client
+	channelClients map[uuid.UUID]map[uuid.UUID]*Client
+	Register       chan *Client
+	Unregister     chan *Client
+	backplane      Backplane
+	nodeID         string
+	evict          chan eviction
+	done           chan struct{}
+	mutex          sync.RWMutex
+	presence       *presenceTracker
+	authorizer     ChannelAuthorizer
 }
 
 type WSMessage struct {
-	Type    string      `json:"type"`
-	Data    interface{} `json:"data"`
-	RealmID *uuid.UUID  `json:"realm_id,omitempty"`
-	ChannelID *uuid.UUID `json:"channel_id,omitempty"`
-	UserID  *uuid.UUID  `json:"user_id,omitempty"`
+	Type      string      `json:"type"`
+	Data      interface{} `json:"data"`
+	RealmID   *uuid.UUID  `json:"realm_id,omitempty"`
+	ChannelID *uuid.UUID  `json:"channel_id,omitempty"`
+	UserID    *uuid.UUID  `json:"user_id,omitempty"`
 }
 
 func NewHub() *Hub {
 	return &Hub{
-		clients:      make(map[uuid.UUID]*Client),
-		userClients:  make(map[uuid.UUID][]*Client),
-		realmClients: make(map[uuid.UUID][]*Client),
-		channelClients: make(map[uuid.UUID][]*Client),
-		Register:     make(chan *Client),
-		Unregister:   make(chan *Client),
-		broadcast:    make(chan []byte, 256),
+		clients:        make(map[uuid.UUID]*Client),
+		userClients:    make(map[uuid.UUID][]*Client),
+		realmClients:   make(map[uuid.UUID]map[uuid.UUID]*Client),
+		channelClients: make(map[uuid.UUID]map[uuid.UUID]*Client),
+		Register:       make(chan *Client),
+		Unregister:     make(chan *Client),
+		nodeID:         uuid.NewString(),
+		evict:          make(chan eviction, 256),
+		done:           make(chan struct{}),
+		presence:       newPresenceTracker(),
 	}
 }
 
 func (h *Hub) Run() {
+	reaper := time.NewTicker(ResumeWindow / 4)
+	defer reaper.Stop()
+
 	for {
 		select {
 		case client := <-h.Register:
@@ -56,35 +113,148 @@ func (h *Hub) Run() {
 		case client := <-h.Unregister:
 			h.unregisterClient(client)
 
-		case message := <-h.broadcast:
-			h.broadcastMessage(message)
+		case e := <-h.evict:
+			// The session stays resumable; only the lagging connection is dropped.
+			if e.client.detach(e.send) {
+				log.Printf("Evicted slow connection of session: %s for user: %s", e.client.ID, e.client.UserID)
+				h.refreshPresence(e.client.UserID)
+			}
+
+		case now := <-reaper.C:
+			h.reapSessions(now)
+
+		case <-h.done:
+			h.shutdown()
+			return
 		}
 	}
 }
 
-func (h *Hub) registerClient(client *Client) {
+// UseBackplane connects the hub to other nodes through bp. It must be called
+// before the hub starts serving clients.
+func (h *Hub) UseBackplane(bp Backplane) error {
+	h.backplane = bp
+	return bp.Subscribe(context.Background(), h.receive)
+}
+
+// NodeID identifies this hub on the backplane.
+func (h *Hub) NodeID() string {
+	return h.nodeID
+}
+
+// Connect registers a client. Unlike sending on Register it returns only once
+// the client is indexed, so it can be subscribed to rooms right away.
+func (h *Hub) Connect(client *Client) {
+	h.registerClient(client)
+}
+
+// Detach is called when a session's connection goes away. The session keeps
+// its subscriptions and buffers events until it is resumed or expires.
+func (h *Hub) Detach(client *Client, send chan []byte) {
+	if client.detach(send) {
+		h.refreshPresence(client.UserID)
+	}
+}
+
+// Resume moves the connection attached to current onto the detached session
+// sessionID, replaying the events after lastSeq, and discards current. On
+// failure current is left untouched.
+func (h *Hub) Resume(current *Client, sessionID uuid.UUID, lastSeq uint64) (*Client, error) {
+	h.mutex.Lock()
+
+	session, ok := h.clients[sessionID]
+	if !ok || session.UserID != current.UserID || session == current {
+		h.mutex.Unlock()
+		return nil, ErrSessionNotFound
+	}
+
+	send := current.release()
+	if err := session.attach(send, lastSeq); err != nil {
+		current.mu.Lock()
+		current.Send = send
+		current.mu.Unlock()
+		h.mutex.Unlock()
+		return nil, err
+	}
+
+	h.removeClient(current)
+	h.mutex.Unlock()
+
+	log.Printf("Client resumed: %s for user: %s", session.ID, session.UserID)
+	h.refreshPresence(session.UserID)
+	return session, nil
+}
+
+// reapSessions unregisters sessions detached for longer than ResumeWindow.
+func (h *Hub) reapSessions(now time.Time) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	for _, client := range h.clients {
+		if client.expired(now) {
+			h.removeClient(client)
+		}
+	}
+}
+
+// Disconnect unregisters a client. Unlike sending on Unregister directly it
+// does not block once the hub has been stopped.
+func (h *Hub) Disconnect(client *Client) {
+	select {
+	case h.Unregister <- client:
+	case <-h.done:
+	}
+}
+
+// Stop terminates Run and closes every connected client.
+func (h *Hub) Stop() {
+	close(h.done)
+}
+
+func (h *Hub) shutdown() {
+	h.mutex.Lock()
+	clients := make([]*Client, 0, len(h.clients))
+	for _, client := range h.clients {
+		clients = append(clients, client)
+	}
+	h.mutex.Unlock()
+
+	for _, client := range clients {
+		h.unregisterClient(client)
+	}
+}
+
+func (h *Hub) registerClient(client *Client) {
+	h.mutex.Lock()
+	client.realms = make(map[uuid.UUID]bool)
+	client.channels = make(map[uuid.UUID]uuid.UUID)
 	h.clients[client.ID] = client
 	h.userClients[client.UserID] = append(h.userClients[client.UserID], client)
-	
+	h.mutex.Unlock()
+
 	log.Printf("Client registered: %s for user: %s", client.ID, client.UserID)
+	h.refreshPresence(client.UserID)
 }
 
 func (h *Hub) unregisterClient(client *Client) {
 	h.mutex.Lock()
-	defer h.mutex.Unlock()
+	h.removeClient(client)
+	h.mutex.Unlock()
 
+	h.refreshPresence(client.UserID)
+}
+
+// removeClient must be called with the hub mutex held.
+func (h *Hub) removeClient(client *Client) {
 	if _, ok := h.clients[client.ID]; ok {
 		delete(h.clients, client.ID)
-		close(client.Send)
+		client.close()
 
 		// Remove from user clients
 		userClients := h.userClients[client.UserID]
 		for i, c := range userClients {
 			if c.ID == client.ID {
-				h.userClients[client.UserID] = append(userClients[:i], userClients[i+1:]...)
+				h.userClients[client.UserID] = append(userClients[:i:i], userClients[i+1:]...)
 				break
 			}
 		}
@@ -93,108 +263,288 @@ func (h *Hub) unregisterClient(client *Client) {
 			delete(h.userClients, client.UserID)
 		}
 
+		for realmID := range client.realms {
+			h.removeFromRealm(client, realmID)
+		}
+		for channelID := range client.channels {
+			h.removeFromChannel(client, channelID)
+		}
+
 		log.Printf("Client unregistered: %s for user: %s", client.ID, client.UserID)
 	}
 }
 
-func (h *Hub) broadcastMessage(message []byte) {
-	h.mutex.RLock()
-	defer h.mutex.RUnlock()
+// deliver sequences data for a client and queues it without blocking.
+// Callers must hold the read lock. Connections whose buffer is full are
+// scheduled for eviction.
+func (h *Hub) deliver(client *Client, data []byte) {
+	if send := client.enqueue(data); send != nil {
+		h.scheduleEviction(client, send)
+	}
+}
 
-	for _, client := range h.clients {
-		select {
-		case client.Send <- message:
-		default:
-			close(client.Send)
-			delete(h.clients, client.ID)
-		}
+// scheduleEviction hands a slow connection to the Run goroutine once.
+func (h *Hub) scheduleEviction(client *Client, send chan []byte) {
+	if !client.evicting.CompareAndSwap(false, true) {
+		return
+	}
+
+	e := eviction{client: client, send: send}
+	select {
+	case h.evict <- e:
+	default:
+		// The eviction queue is full; wait for Run without blocking the
+		// broadcaster, which may be holding the read lock.
+		go func() {
+			select {
+			case h.evict <- e:
+			case <-h.done:
+			}
+		}()
 	}
 }
 
+// Broadcast sends a message to every connected client.
+func (h *Hub) Broadcast(message interface{}) error {
+	return h.publish(ScopeAll, uuid.Nil, message)
+}
+
 func (h *Hub) BroadcastToUser(userID uuid.UUID, message interface{}) error {
-	h.mutex.RLock()
-	clients := h.userClients[userID]
-	h.mutex.RUnlock()
+	return h.publish(ScopeUser, userID, message)
+}
 
-	if len(clients) == 0 {
+// BroadcastToUsers sends a message to every session of each of userIDs,
+// relaying it to other nodes in a single envelope.
+func (h *Hub) BroadcastToUsers(userIDs []uuid.UUID, message interface{}) error {
+	if len(userIDs) == 0 {
 		return nil
 	}
-
 	data, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
-	for _, client := range clients {
-		select {
-		case client.Send <- data:
-		default:
-			close(client.Send)
-			delete(h.clients, client.ID)
-		}
+	h.fanOutUsers(userIDs, data)
+
+	if h.backplane == nil {
+		return nil
 	}
 
+	env := Envelope{NodeID: h.nodeID, Scope: ScopeUsers, Targets: userIDs, Payload: data}
+	if err := h.backplane.Publish(context.Background(), env); err != nil {
+		log.Printf("Backplane publish failed: %v", err)
+		return err
+	}
 	return nil
 }
 
 func (h *Hub) BroadcastToRealm(realmID uuid.UUID, message interface{}) error {
+	return h.publish(ScopeRealm, realmID, message)
+}
+
+func (h *Hub) BroadcastToChannel(channelID uuid.UUID, message interface{}) error {
+	return h.publish(ScopeChannel, channelID, message)
+}
+
+// publish delivers a message to the local clients in scope and relays it to
+// the other nodes through the backplane, if one is configured.
+func (h *Hub) publish(scope Scope, target uuid.UUID, message interface{}) error {
 	data, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
+	h.fanOut(scope, target, data)
+
+	if h.backplane == nil {
+		return nil
+	}
+
+	env := Envelope{NodeID: h.nodeID, Scope: scope, Target: target, Payload: data}
+	if err := h.backplane.Publish(context.Background(), env); err != nil {
+		log.Printf("Backplane publish failed: %v", err)
+		return err
+	}
+	return nil
+}
+
+// receive handles an envelope from the backplane. Envelopes published by
+// this node were already delivered locally and are dropped.
+func (h *Hub) receive(env Envelope) {
+	if env.NodeID == h.nodeID {
+		return
+	}
+	// Revalidation asks the authorizer, which may be slow, so it must not
+	// hold up the backplane subscription.
+	switch env.Scope {
+	case ScopeRevalidateChannel:
+		go h.revalidateChannel(env.Target)
+		return
+	case ScopeRevalidateRealm:
+		go h.revalidateRealm(env.Target)
+		return
+	case ScopeEvictMember:
+		h.evictMembers(env.Target, env.Targets)
+		return
+	case ScopeUsers:
+		h.fanOutUsers(env.Targets, env.Payload)
+		return
+	}
+	h.fanOut(env.Scope, env.Target, env.Payload)
+}
+
+func (h *Hub) fanOut(scope Scope, target uuid.UUID, data []byte) {
 	h.mutex.RLock()
-	clients := h.realmClients[realmID]
-	h.mutex.RUnlock()
+	defer h.mutex.RUnlock()
 
-	for _, client := range clients {
-		select {
-		case client.Send <- data:
-		default:
-			close(client.Send)
-			delete(h.clients, client.ID)
+	switch scope {
+	case ScopeAll:
+		for _, client := range h.clients {
+			h.deliver(client, data)
+		}
+	case ScopeUser:
+		for _, client := range h.userClients[target] {
+			h.deliver(client, data)
+		}
+	case ScopeRealm:
+		for _, client := range h.realmClients[target] {
+			h.deliver(client, data)
+		}
+	case ScopeChannel:
+		for _, client := range h.channelClients[target] {
+			h.deliver(client, data)
 		}
 	}
+}
 
-	return nil
+func (h *Hub) fanOutUsers(userIDs []uuid.UUID, data []byte) {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	for _, userID := range userIDs {
+		for _, client := range h.userClients[userID] {
+			h.deliver(client, data)
+		}
+	}
 }
 
-func (h *Hub) BroadcastToChannel(channelID uuid.UUID, message interface{}) error {
+// SendToClient delivers an unsequenced message, such as an error or
+// heartbeat ack, to a single session's current connection.
+func (h *Hub) SendToClient(clientID uuid.UUID, message interface{}) error {
 	data, err := json.Marshal(message)
 	if err != nil {
 		return err
 	}
 
 	h.mutex.RLock()
-	clients := h.channelClients[channelID]
-	h.mutex.RUnlock()
+	defer h.mutex.RUnlock()
 
-	for _, client := range clients {
-		select {
-		case client.Send <- data:
-		default:
-			close(client.Send)
-			delete(h.clients, client.ID)
+	if client, ok := h.clients[clientID]; ok {
+		if send := client.sendDirect(data); send != nil {
+			h.scheduleEviction(client, send)
 		}
 	}
 
 	return nil
 }
 
+// AddClientToRealm subscribes a client to realm-wide events. Joining a realm
+// the client is already in is a no-op.
 func (h *Hub) AddClientToRealm(clientID, realmID uuid.UUID) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
+	client, ok := h.clients[clientID]
+	if !ok || client.realms[realmID] {
+		return
+	}
+
+	if h.realmClients[realmID] == nil {
+		h.realmClients[realmID] = make(map[uuid.UUID]*Client)
+	}
+	h.realmClients[realmID][client.ID] = client
+	client.realms[realmID] = true
+}
+
+// AddClientToChannel subscribes a client to events of a channel in realmID.
+// Joining a channel the client is already in is a no-op.
+func (h *Hub) AddClientToChannel(clientID, realmID, channelID uuid.UUID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	client, ok := h.clients[clientID]
+	if !ok {
+		return
+	}
+	if _, joined := client.channels[channelID]; joined {
+		return
+	}
+
+	if h.channelClients[channelID] == nil {
+		h.channelClients[channelID] = make(map[uuid.UUID]*Client)
+	}
+	h.channelClients[channelID][client.ID] = client
+	client.channels[channelID] = realmID
+}
+
+// RemoveClientFromRealm unsubscribes a client from a realm and every channel
+// of that realm it had joined.
+func (h *Hub) RemoveClientFromRealm(clientID, realmID uuid.UUID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
 	if client, ok := h.clients[clientID]; ok {
-		h.realmClients[realmID] = append(h.realmClients[realmID], client)
+		h.removeFromRealm(client, realmID)
 	}
 }
 
-func (h *Hub) AddClientToChannel(clientID, channelID uuid.UUID) {
+// RemoveClientFromChannel unsubscribes a client from a channel.
+func (h *Hub) RemoveClientFromChannel(clientID, channelID uuid.UUID) {
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
 
 	if client, ok := h.clients[clientID]; ok {
-		h.channelClients[channelID] = append(h.channelClients[channelID], client)
+		h.removeFromChannel(client, channelID)
+	}
+}
+
+// InChannel reports whether a client is subscribed to a channel.
+func (h *Hub) InChannel(clientID, channelID uuid.UUID) bool {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+
+	client, ok := h.clients[clientID]
+	if !ok {
+		return false
+	}
+	_, joined := client.channels[channelID]
+	return joined
+}
+
+// removeFromRealm must be called with the hub mutex held.
+func (h *Hub) removeFromRealm(client *Client, realmID uuid.UUID) {
+	for channelID, channelRealm := range client.channels {
+		if channelRealm == realmID {
+			h.removeFromChannel(client, channelID)
+		}
+	}
+
+	delete(client.realms, realmID)
+	if clients, ok := h.realmClients[realmID]; ok {
+		delete(clients, client.ID)
+		if len(clients) == 0 {
+			delete(h.realmClients, realmID)
+		}
+	}
+}
+
+// removeFromChannel must be called with the hub mutex held.
+func (h *Hub) removeFromChannel(client *Client, channelID uuid.UUID) {
+	delete(client.channels, channelID)
+	if clients, ok := h.channelClients[channelID]; ok {
+		delete(clients, client.ID)
+		if len(clients) == 0 {
+			delete(h.channelClients, channelID)
+		}
 	}
 }
\ No newline at end of file
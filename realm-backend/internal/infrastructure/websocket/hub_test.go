@@ -0,0 +1,319 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func newTestClient(userID uuid.UUID, buffer int) *Client {
+	return &Client{
+		ID:     uuid.New(),
+		UserID: userID,
+		Send:   make(chan []byte, buffer),
+	}
+}
+
+// drain reads from a connection queue until the hub closes it.
+func drain(send chan []byte, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for range send {
+	}
+}
+
+func clientCount(h *Hub) int {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	return len(h.clients)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHubConcurrentBroadcastAndUnregister(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	const numClients = 2000
+	realmID := uuid.New()
+	channelID := uuid.New()
+
+	var readers sync.WaitGroup
+	clients := make([]*Client, numClients)
+	for i := range clients {
+		clients[i] = newTestClient(uuid.New(), 16)
+		hub.Connect(clients[i])
+		hub.AddClientToRealm(clients[i].ID, realmID)
+		hub.AddClientToChannel(clients[i].ID, realmID, channelID)
+
+		readers.Add(1)
+		go drain(clients[i].Send, &readers)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				hub.BroadcastToRealm(realmID, WSMessage{Type: "realm_event"})
+				hub.BroadcastToChannel(channelID, WSMessage{Type: "channel_event"})
+				hub.BroadcastToUser(clients[j%numClients].UserID, WSMessage{Type: "user_event"})
+			}
+		}()
+	}
+
+	// Unregister every client, some of them twice, while broadcasts are in flight.
+	for i, client := range clients {
+		wg.Add(1)
+		go func(client *Client, twice bool) {
+			defer wg.Done()
+			hub.Disconnect(client)
+			if twice {
+				hub.Disconnect(client)
+			}
+		}(client, i%3 == 0)
+	}
+
+	wg.Wait()
+	readers.Wait()
+
+	if n := clientCount(hub); n != 0 {
+		t.Fatalf("expected no clients left, got %d", n)
+	}
+
+	hub.mutex.RLock()
+	defer hub.mutex.RUnlock()
+	if len(hub.realmClients) != 0 || len(hub.channelClients) != 0 || len(hub.userClients) != 0 {
+		t.Fatalf("room indexes were not cleaned up: realms=%d channels=%d users=%d",
+			len(hub.realmClients), len(hub.channelClients), len(hub.userClients))
+	}
+}
+
+func TestHubEvictsSlowConsumers(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	channelID := uuid.New()
+	realmID := uuid.New()
+
+	var readers sync.WaitGroup
+	fast := make([]*Client, 100)
+	for i := range fast {
+		fast[i] = newTestClient(uuid.New(), 1024)
+		hub.Connect(fast[i])
+		hub.AddClientToChannel(fast[i].ID, realmID, channelID)
+		readers.Add(1)
+		go drain(fast[i].Send, &readers)
+	}
+
+	// Slow clients never read, so their buffers fill up immediately.
+	slow := make([]*Client, 500)
+	slowSends := make([]chan []byte, len(slow))
+	for i := range slow {
+		slow[i] = newTestClient(uuid.New(), 1)
+		slowSends[i] = slow[i].Send
+		hub.Connect(slow[i])
+		hub.AddClientToChannel(slow[i].ID, realmID, channelID)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				hub.BroadcastToChannel(channelID, WSMessage{Type: "message_create"})
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, "slow connections to be evicted", func() bool {
+		for _, client := range slow {
+			if client.Attached() {
+				return false
+			}
+		}
+		return true
+	})
+
+	for _, send := range slowSends {
+		// Drain whatever was buffered; the channel must end up closed.
+		for range send {
+		}
+	}
+
+	for _, client := range fast {
+		if !client.Attached() {
+			t.Fatal("fast client was evicted")
+		}
+	}
+
+	// Evicted sessions stay registered so they can be resumed.
+	if n := clientCount(hub); n != len(fast)+len(slow) {
+		t.Fatalf("expected %d sessions, got %d", len(fast)+len(slow), n)
+	}
+
+	for _, client := range fast {
+		hub.Disconnect(client)
+	}
+	readers.Wait()
+}
+
+func TestHubStopClosesClients(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	var readers sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		client := newTestClient(uuid.New(), 4)
+		hub.Connect(client)
+		readers.Add(1)
+		go drain(client.Send, &readers)
+	}
+
+	hub.Stop()
+	readers.Wait()
+
+	// Disconnecting and broadcasting after shutdown must neither block nor panic.
+	hub.Disconnect(newTestClient(uuid.New(), 1))
+	if err := hub.Broadcast(WSMessage{Type: "noop"}); err != nil {
+		t.Fatalf("Broadcast after Stop failed: %v", err)
+	}
+}
+
+func TestHubResumeReplaysMissedEvents(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	userID := uuid.New()
+	realmID := uuid.New()
+	channelID := uuid.New()
+
+	session := newTestClient(userID, SendBufferSize)
+	first := session.Send
+	hub.Connect(session)
+	hub.AddClientToChannel(session.ID, realmID, channelID)
+
+	for i := 0; i < 3; i++ {
+		hub.BroadcastToChannel(channelID, WSMessage{Type: "message_create"})
+	}
+	for i := 0; i < 3; i++ {
+		<-first
+	}
+
+	hub.Detach(session, first)
+	if _, ok := <-first; ok {
+		t.Fatal("expected the detached connection queue to be closed")
+	}
+
+	for i := 0; i < 2; i++ {
+		hub.BroadcastToChannel(channelID, WSMessage{Type: "message_create"})
+	}
+
+	reconnect := newTestClient(userID, SendBufferSize)
+	second := reconnect.Send
+	hub.Connect(reconnect)
+
+	resumed, err := hub.Resume(reconnect, session.ID, 3)
+	if err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	if resumed != session {
+		t.Fatal("Resume returned a different session")
+	}
+
+	for _, want := range []string{`{"seq":4,`, `{"seq":5,`} {
+		frame := string(<-second)
+		if len(frame) < len(want) || frame[:len(want)] != want {
+			t.Fatalf("expected frame starting with %s, got %s", want, frame)
+		}
+	}
+
+	// The session keeps its subscriptions across the reconnect.
+	hub.BroadcastToChannel(channelID, WSMessage{Type: "message_create"})
+	if frame := string(<-second); frame[:len(`{"seq":6,`)] != `{"seq":6,` {
+		t.Fatalf("unexpected live frame %s", frame)
+	}
+
+	if n := clientCount(hub); n != 1 {
+		t.Fatalf("expected the temporary session to be discarded, got %d sessions", n)
+	}
+}
+
+func TestHubResumeRejectsGapsAndStrangers(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	userID := uuid.New()
+	session := newTestClient(userID, SendBufferSize)
+	hub.Connect(session)
+	hub.Detach(session, session.Send)
+
+	for i := 0; i < ReplayBufferSize+10; i++ {
+		hub.BroadcastToUser(userID, WSMessage{Type: "user_event"})
+	}
+
+	reconnect := newTestClient(userID, SendBufferSize)
+	hub.Connect(reconnect)
+	if _, err := hub.Resume(reconnect, session.ID, 0); err != ErrSessionExpired {
+		t.Fatalf("expected ErrSessionExpired, got %v", err)
+	}
+	if !reconnect.Attached() {
+		t.Fatal("failed resume must leave the new connection attached")
+	}
+
+	stranger := newTestClient(uuid.New(), SendBufferSize)
+	hub.Connect(stranger)
+	if _, err := hub.Resume(stranger, session.ID, session.Seq()); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+}
+
+func TestHubReapsExpiredSessions(t *testing.T) {
+	hub := NewHub()
+
+	attached := newTestClient(uuid.New(), 1)
+	detached := newTestClient(uuid.New(), 1)
+	hub.Connect(attached)
+	hub.Connect(detached)
+	hub.Detach(detached, detached.Send)
+
+	hub.reapSessions(time.Now())
+	if n := clientCount(hub); n != 2 {
+		t.Fatalf("sessions were reaped inside the resume window, %d left", n)
+	}
+
+	hub.reapSessions(time.Now().Add(ResumeWindow + time.Second))
+	if n := clientCount(hub); n != 1 {
+		t.Fatalf("expected only the attached session to remain, got %d", n)
+	}
+}
+
+func TestWithSeq(t *testing.T) {
+	cases := map[string]string{
+		`{"type":"x"}`: `{"seq":7,"type":"x"}`,
+		`{}`:           `{"seq":7}`,
+		`[]`:           `[]`,
+	}
+	for in, want := range cases {
+		if got := string(withSeq([]byte(in), 7)); got != want {
+			t.Errorf("withSeq(%s) = %s, want %s", in, got, want)
+		}
+	}
+}
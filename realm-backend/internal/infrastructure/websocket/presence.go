@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PresenceGracePeriod is how long a user stays online after their last
+// connection closed, so page reloads and resumes do not flap presence.
+const PresenceGracePeriod = 15 * time.Second
+
+const (
+	PresenceOnline  = "online"
+	PresenceIdle    = "idle"
+	PresenceOffline = "offline"
+)
+
+// PresenceListener is notified when a user's connection-derived presence on
+// this node changes. Combining it with other nodes is up to the listener,
+// see PresenceStore. It is called without any hub lock held.
+type PresenceListener interface {
+	PresenceChanged(userID uuid.UUID, status string)
+}
+
+// presenceTracker derives presence from the sessions attached on this node.
+type presenceTracker struct {
+	mu       sync.Mutex
+	listener PresenceListener
+	grace    time.Duration
+	status   map[uuid.UUID]string
+	timers   map[uuid.UUID]*time.Timer
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		grace:  PresenceGracePeriod,
+		status: make(map[uuid.UUID]string),
+		timers: make(map[uuid.UUID]*time.Timer),
+	}
+}
+
+// SetPresenceListener registers the listener notified of presence changes.
+// It must be called before the hub starts serving clients.
+func (h *Hub) SetPresenceListener(listener PresenceListener) {
+	h.presence.listener = listener
+}
+
+// Presence returns the connection-derived presence of a user on this node.
+func (h *Hub) Presence(userID uuid.UUID) string {
+	h.presence.mu.Lock()
+	defer h.presence.mu.Unlock()
+
+	if status, ok := h.presence.status[userID]; ok {
+		return status
+	}
+	return PresenceOffline
+}
+
+// PresentUsers returns the users with connection-derived presence on this
+// node, including those still within their grace period.
+func (h *Hub) PresentUsers() []uuid.UUID {
+	h.presence.mu.Lock()
+	defer h.presence.mu.Unlock()
+
+	users := make([]uuid.UUID, 0, len(h.presence.status))
+	for userID := range h.presence.status {
+		users = append(users, userID)
+	}
+	return users
+}
+
+// SetIdle records client activity; a user is idle once every attached
+// session reported being idle.
+func (h *Hub) SetIdle(client *Client, idle bool) {
+	client.mu.Lock()
+	client.idle = idle
+	client.mu.Unlock()
+
+	h.refreshPresence(client.UserID)
+}
+
+// refreshPresence recomputes a user's presence from their sessions. It must
+// be called without the hub mutex held.
+func (h *Hub) refreshPresence(userID uuid.UUID) {
+	h.mutex.RLock()
+	attached, idle := 0, 0
+	for _, client := range h.userClients[userID] {
+		client.mu.Lock()
+		if client.Send != nil {
+			attached++
+			if client.idle {
+				idle++
+			}
+		}
+		client.mu.Unlock()
+	}
+	h.mutex.RUnlock()
+
+	p := h.presence
+	p.mu.Lock()
+
+	if attached == 0 {
+		// Go offline only once the grace period passes without a reconnect.
+		if _, online := p.status[userID]; online && p.timers[userID] == nil {
+			p.timers[userID] = time.AfterFunc(p.grace, func() {
+				h.expirePresence(userID)
+			})
+		}
+		p.mu.Unlock()
+		return
+	}
+
+	if timer := p.timers[userID]; timer != nil {
+		timer.Stop()
+		delete(p.timers, userID)
+	}
+
+	status := PresenceOnline
+	if idle == attached {
+		status = PresenceIdle
+	}
+
+	changed := p.status[userID] != status
+	p.status[userID] = status
+	p.mu.Unlock()
+
+	if changed {
+		h.notifyPresence(userID, status)
+	}
+}
+
+func (h *Hub) expirePresence(userID uuid.UUID) {
+	p := h.presence
+	p.mu.Lock()
+	if p.timers[userID] == nil {
+		// A reconnect cancelled the timer after it fired.
+		p.mu.Unlock()
+		return
+	}
+	delete(p.timers, userID)
+	delete(p.status, userID)
+	p.mu.Unlock()
+
+	h.notifyPresence(userID, PresenceOffline)
+}
+
+func (h *Hub) notifyPresence(userID uuid.UUID, status string) {
+	if h.presence.listener != nil {
+		h.presence.listener.PresenceChanged(userID, status)
+	}
+}
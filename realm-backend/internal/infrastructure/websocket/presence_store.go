@@ -0,0 +1,160 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PresenceLeaseTTL is how long a node's report of a user's presence holds
+// without being renewed, so users of a node that died go offline.
+const PresenceLeaseTTL = 45 * time.Second
+
+// PresenceStore combines the presence each node derives from its own
+// connections. A user is online if any node reports them online, idle if
+// every reporting node reports them idle and offline once no node reports
+// them at all. Reports are leases that lapse after PresenceLeaseTTL unless
+// renewed.
+type PresenceStore interface {
+	// Report records a user's presence on a node, offline withdrawing the
+	// node's report, and returns the user's combined presence and whether
+	// it changed.
+	Report(ctx context.Context, userID uuid.UUID, nodeID, status string) (string, bool, error)
+	// Renew extends the leases of a node's reports for userIDs.
+	Renew(ctx context.Context, nodeID string, userIDs []uuid.UUID) error
+	// Expire withdraws lapsed reports and returns the users whose combined
+	// presence changed as a result.
+	Expire(ctx context.Context) (map[uuid.UUID]string, error)
+	// Presence returns a user's combined presence.
+	Presence(ctx context.Context, userID uuid.UUID) (string, error)
+}
+
+type presenceLease struct {
+	status  string
+	expires time.Time
+}
+
+// MemoryPresenceStore is an in-process PresenceStore for single node
+// deployments and tests.
+type MemoryPresenceStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	reports map[uuid.UUID]map[string]presenceLease
+	status  map[uuid.UUID]string
+}
+
+func NewMemoryPresenceStore() *MemoryPresenceStore {
+	return &MemoryPresenceStore{
+		ttl:     PresenceLeaseTTL,
+		reports: make(map[uuid.UUID]map[string]presenceLease),
+		status:  make(map[uuid.UUID]string),
+	}
+}
+
+func (s *MemoryPresenceStore) Report(ctx context.Context, userID uuid.UUID, nodeID, status string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status == PresenceOffline {
+		s.withdraw(userID, nodeID)
+	} else {
+		if s.reports[userID] == nil {
+			s.reports[userID] = make(map[string]presenceLease)
+		}
+		s.reports[userID][nodeID] = presenceLease{status: status, expires: time.Now().Add(s.ttl)}
+	}
+
+	combined, changed := s.combine(userID, time.Now())
+	return combined, changed, nil
+}
+
+func (s *MemoryPresenceStore) Renew(ctx context.Context, nodeID string, userIDs []uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expires := time.Now().Add(s.ttl)
+	for _, userID := range userIDs {
+		if lease, ok := s.reports[userID][nodeID]; ok {
+			lease.expires = expires
+			s.reports[userID][nodeID] = lease
+		}
+	}
+	return nil
+}
+
+func (s *MemoryPresenceStore) Expire(ctx context.Context) (map[uuid.UUID]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	changes := make(map[uuid.UUID]string)
+	for userID, nodes := range s.reports {
+		lapsed := false
+		for nodeID, lease := range nodes {
+			if !lease.expires.After(now) {
+				s.withdraw(userID, nodeID)
+				lapsed = true
+			}
+		}
+		if !lapsed {
+			continue
+		}
+		if combined, changed := s.combine(userID, now); changed {
+			changes[userID] = combined
+		}
+	}
+	return changes, nil
+}
+
+func (s *MemoryPresenceStore) Presence(ctx context.Context, userID uuid.UUID) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if status, ok := s.status[userID]; ok {
+		return status, nil
+	}
+	return PresenceOffline, nil
+}
+
+// withdraw must be called with s.mu held.
+func (s *MemoryPresenceStore) withdraw(userID uuid.UUID, nodeID string) {
+	delete(s.reports[userID], nodeID)
+	if len(s.reports[userID]) == 0 {
+		delete(s.reports, userID)
+	}
+}
+
+// combine recomputes a user's combined presence from the live leases. It
+// must be called with s.mu held.
+func (s *MemoryPresenceStore) combine(userID uuid.UUID, now time.Time) (string, bool) {
+	combined := PresenceOffline
+	for _, lease := range s.reports[userID] {
+		if lease.expires.After(now) {
+			combined = combinePresence(combined, lease.status)
+		}
+	}
+
+	previous, ok := s.status[userID]
+	if !ok {
+		previous = PresenceOffline
+	}
+	if combined == PresenceOffline {
+		delete(s.status, userID)
+	} else {
+		s.status[userID] = combined
+	}
+	return combined, combined != previous
+}
+
+// combinePresence merges a node's report into the presence combined so far.
+func combinePresence(combined, reported string) string {
+	switch {
+	case combined == PresenceOnline || reported == PresenceOnline:
+		return PresenceOnline
+	case combined == PresenceIdle || reported == PresenceIdle:
+		return PresenceIdle
+	}
+	return PresenceOffline
+}
@@ -0,0 +1,63 @@
+package websocket
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestMemoryPresenceStoreCombinesNodes(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryPresenceStore()
+	userID := uuid.New()
+
+	steps := []struct {
+		node, status string
+		want         string
+		changed      bool
+	}{
+		{"a", PresenceIdle, PresenceIdle, true},
+		{"b", PresenceOnline, PresenceOnline, true},
+		{"a", PresenceOnline, PresenceOnline, false},
+		// Node a losing its connections leaves the user online on b.
+		{"a", PresenceOffline, PresenceOnline, false},
+		{"b", PresenceIdle, PresenceIdle, true},
+		{"b", PresenceOffline, PresenceOffline, true},
+	}
+	for i, step := range steps {
+		got, changed, err := store.Report(ctx, userID, step.node, step.status)
+		if err != nil {
+			t.Fatalf("step %d: Report failed: %v", i, err)
+		}
+		if got != step.want || changed != step.changed {
+			t.Fatalf("step %d: expected %s (changed %v), got %s (changed %v)", i, step.want, step.changed, got, changed)
+		}
+	}
+}
+
+func TestMemoryPresenceStoreExpiresLapsedNodes(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryPresenceStore()
+	store.ttl = 50 * time.Millisecond
+	renewed, lapsed := uuid.New(), uuid.New()
+
+	store.Report(ctx, renewed, "live", PresenceOnline)
+	store.Report(ctx, lapsed, "dead", PresenceOnline)
+
+	time.Sleep(30 * time.Millisecond)
+	store.Renew(ctx, "live", []uuid.UUID{renewed})
+	time.Sleep(30 * time.Millisecond)
+
+	changes, err := store.Expire(ctx)
+	if err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+	if len(changes) != 1 || changes[lapsed] != PresenceOffline {
+		t.Fatalf("expected only the lapsed user to go offline, got %v", changes)
+	}
+	if got, _ := store.Presence(ctx, renewed); got != PresenceOnline {
+		t.Fatalf("expected the renewed user to stay online, got %s", got)
+	}
+}
@@ -0,0 +1,81 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type recordingListener struct {
+	mu      sync.Mutex
+	changes []string
+}
+
+func (l *recordingListener) PresenceChanged(userID uuid.UUID, status string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.changes = append(l.changes, status)
+}
+
+func (l *recordingListener) seen() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.changes...)
+}
+
+func TestHubPresenceFollowsConnections(t *testing.T) {
+	hub := NewHub()
+	hub.presence.grace = 50 * time.Millisecond
+	listener := &recordingListener{}
+	hub.SetPresenceListener(listener)
+	go hub.Run()
+	defer hub.Stop()
+
+	userID := uuid.New()
+	first := newTestClient(userID, SendBufferSize)
+	second := newTestClient(userID, SendBufferSize)
+
+	hub.Connect(first)
+	hub.Connect(second)
+	if got := hub.Presence(userID); got != PresenceOnline {
+		t.Fatalf("expected online after connecting, got %s", got)
+	}
+
+	// Idle only once every attached session is idle.
+	hub.SetIdle(first, true)
+	if got := hub.Presence(userID); got != PresenceOnline {
+		t.Fatalf("expected online with one active session, got %s", got)
+	}
+	hub.SetIdle(second, true)
+	if got := hub.Presence(userID); got != PresenceIdle {
+		t.Fatalf("expected idle, got %s", got)
+	}
+
+	// A reconnect within the grace period keeps the user online.
+	hub.Detach(first, first.Send)
+	hub.Detach(second, second.Send)
+	third := newTestClient(userID, SendBufferSize)
+	hub.Connect(third)
+	time.Sleep(100 * time.Millisecond)
+	if got := hub.Presence(userID); got != PresenceOnline {
+		t.Fatalf("expected online after reconnecting, got %s", got)
+	}
+
+	hub.Disconnect(third)
+	waitFor(t, "offline presence", func() bool {
+		return hub.Presence(userID) == PresenceOffline
+	})
+
+	want := []string{PresenceOnline, PresenceIdle, PresenceOnline, PresenceOffline}
+	got := listener.seen()
+	if len(got) != len(want) {
+		t.Fatalf("expected changes %v, got %v", want, got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("expected changes %v, got %v", want, got)
+		}
+	}
+}
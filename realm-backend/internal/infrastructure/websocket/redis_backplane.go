@@ -0,0 +1,64 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisChannel is the Pub/Sub channel hub nodes exchange events on.
+const DefaultRedisChannel = "realm:hub:events"
+
+// RedisBackplane relays hub events through Redis Pub/Sub.
+type RedisBackplane struct {
+	client  *redis.Client
+	channel string
+	pubsub  *redis.PubSub
+}
+
+func NewRedisBackplane(client *redis.Client, channel string) *RedisBackplane {
+	if channel == "" {
+		channel = DefaultRedisChannel
+	}
+	return &RedisBackplane{client: client, channel: channel}
+}
+
+func (b *RedisBackplane) Publish(ctx context.Context, env Envelope) error {
+	data, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return b.client.Publish(ctx, b.channel, data).Err()
+}
+
+func (b *RedisBackplane) Subscribe(ctx context.Context, handler func(Envelope)) error {
+	b.pubsub = b.client.Subscribe(ctx, b.channel)
+
+	// Wait for the subscription to be confirmed so no events are missed.
+	if _, err := b.pubsub.Receive(ctx); err != nil {
+		b.pubsub.Close()
+		return err
+	}
+
+	go func() {
+		for msg := range b.pubsub.Channel() {
+			var env Envelope
+			if err := json.Unmarshal([]byte(msg.Payload), &env); err != nil {
+				log.Printf("Dropping malformed backplane message: %v", err)
+				continue
+			}
+			handler(env)
+		}
+	}()
+
+	return nil
+}
+
+func (b *RedisBackplane) Close() error {
+	if b.pubsub != nil {
+		return b.pubsub.Close()
+	}
+	return nil
+}
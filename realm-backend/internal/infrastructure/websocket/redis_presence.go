@@ -0,0 +1,159 @@
+package websocket
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+)
+
+// DefaultRedisPresencePrefix prefixes the keys of RedisPresenceStore. The
+// braces keep every key in one hash slot so the scripts work on a cluster.
+const DefaultRedisPresencePrefix = "{realm:presence}"
+
+// presenceScript records or withdraws one node's report of a user and
+// recomputes the user's combined presence from the reports whose lease has
+// not lapsed. In expire mode the report is only withdrawn if its lease
+// lapsed, so a node renewing concurrently keeps it.
+//
+// KEYS: reports of the user (node -> status), leases (user|node -> expiry),
+// combined presence (user -> status).
+// ARGV: user, node, status, now, expiry (unix ms), mode.
+var presenceScript = redis.NewScript(`
+local member = ARGV[1] .. '|' .. ARGV[2]
+local now = tonumber(ARGV[4])
+if ARGV[6] == 'expire' then
+	local lease = redis.call('ZSCORE', KEYS[2], member)
+	if lease and tonumber(lease) > now then
+		return {redis.call('HGET', KEYS[3], ARGV[1]) or 'offline', 0}
+	end
+	redis.call('HDEL', KEYS[1], ARGV[2])
+	redis.call('ZREM', KEYS[2], member)
+elseif ARGV[3] == 'offline' then
+	redis.call('HDEL', KEYS[1], ARGV[2])
+	redis.call('ZREM', KEYS[2], member)
+else
+	redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+	redis.call('ZADD', KEYS[2], ARGV[5], member)
+end
+
+local status = 'offline'
+local reports = redis.call('HGETALL', KEYS[1])
+for i = 1, #reports, 2 do
+	local lease = redis.call('ZSCORE', KEYS[2], ARGV[1] .. '|' .. reports[i])
+	if lease and tonumber(lease) > now then
+		if reports[i + 1] == 'online' then
+			status = 'online'
+		elseif reports[i + 1] == 'idle' and status == 'offline' then
+			status = 'idle'
+		end
+	end
+end
+
+local previous = redis.call('HGET', KEYS[3], ARGV[1]) or 'offline'
+if status == 'offline' then
+	redis.call('HDEL', KEYS[3], ARGV[1])
+else
+	redis.call('HSET', KEYS[3], ARGV[1], status)
+end
+if previous == status then
+	return {status, 0}
+end
+return {status, 1}
+`)
+
+// RedisPresenceStore shares presence between hub nodes through Redis.
+type RedisPresenceStore struct {
+	client *redis.Client
+	prefix string
+	ttl    time.Duration
+}
+
+func NewRedisPresenceStore(client *redis.Client, prefix string) *RedisPresenceStore {
+	if prefix == "" {
+		prefix = DefaultRedisPresencePrefix
+	}
+	return &RedisPresenceStore{client: client, prefix: prefix, ttl: PresenceLeaseTTL}
+}
+
+func (s *RedisPresenceStore) Report(ctx context.Context, userID uuid.UUID, nodeID, status string) (string, bool, error) {
+	return s.run(ctx, userID, nodeID, status, "report")
+}
+
+func (s *RedisPresenceStore) Renew(ctx context.Context, nodeID string, userIDs []uuid.UUID) error {
+	if len(userIDs) == 0 {
+		return nil
+	}
+
+	expires := float64(time.Now().Add(s.ttl).UnixMilli())
+	pipe := s.client.Pipeline()
+	for _, userID := range userIDs {
+		// XX only extends leases that exist, so withdrawn reports stay gone.
+		pipe.ZAddXX(ctx, s.leasesKey(), redis.Z{Score: expires, Member: userID.String() + "|" + nodeID})
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+func (s *RedisPresenceStore) Expire(ctx context.Context) (map[uuid.UUID]string, error) {
+	lapsed, err := s.client.ZRangeByScore(ctx, s.leasesKey(), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(time.Now().UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make(map[uuid.UUID]string)
+	for _, member := range lapsed {
+		user, nodeID, ok := strings.Cut(member, "|")
+		userID, err := uuid.Parse(user)
+		if !ok || err != nil {
+			s.client.ZRem(ctx, s.leasesKey(), member)
+			continue
+		}
+
+		status, changed, err := s.run(ctx, userID, nodeID, PresenceOffline, "expire")
+		if err != nil {
+			return changes, err
+		}
+		if changed {
+			changes[userID] = status
+		}
+	}
+	return changes, nil
+}
+
+func (s *RedisPresenceStore) Presence(ctx context.Context, userID uuid.UUID) (string, error) {
+	status, err := s.client.HGet(ctx, s.statusKey(), userID.String()).Result()
+	if err == redis.Nil {
+		return PresenceOffline, nil
+	}
+	return status, err
+}
+
+func (s *RedisPresenceStore) run(ctx context.Context, userID uuid.UUID, nodeID, status, mode string) (string, bool, error) {
+	now := time.Now()
+	keys := []string{s.prefix + ":reports:" + userID.String(), s.leasesKey(), s.statusKey()}
+	result, err := presenceScript.Run(ctx, s.client, keys,
+		userID.String(), nodeID, status, now.UnixMilli(), now.Add(s.ttl).UnixMilli(), mode,
+	).Slice()
+	if err != nil {
+		return "", false, err
+	}
+
+	combined, _ := result[0].(string)
+	changed, _ := result[1].(int64)
+	return combined, changed == 1, nil
+}
+
+func (s *RedisPresenceStore) leasesKey() string {
+	return s.prefix + ":leases"
+}
+
+func (s *RedisPresenceStore) statusKey() string {
+	return s.prefix + ":status"
+}
@@ -0,0 +1,195 @@
+package websocket
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+const (
+	// HeartbeatInterval is how often clients are expected to send a heartbeat.
+	HeartbeatInterval = 30 * time.Second
+	// ResumeWindow is how long a detached session stays resumable.
+	ResumeWindow = 2 * time.Minute
+	// ReplayBufferSize bounds the number of events kept for resuming.
+	ReplayBufferSize = 256
+	// SendBufferSize leaves room for a full replay plus live traffic.
+	SendBufferSize = ReplayBufferSize + 64
+)
+
+var (
+	ErrSessionNotFound = errors.New("session not found")
+	ErrSessionExpired  = errors.New("session can no longer be resumed")
+)
+
+type replayEntry struct {
+	seq   uint64
+	frame []byte
+}
+
+// replayRing keeps the most recent ReplayBufferSize frames of a session.
+type replayRing struct {
+	entries []replayEntry
+	next    int
+}
+
+func (r *replayRing) add(entry replayEntry) {
+	if len(r.entries) < ReplayBufferSize {
+		r.entries = append(r.entries, entry)
+		return
+	}
+	r.entries[r.next] = entry
+	r.next = (r.next + 1) % ReplayBufferSize
+}
+
+// oldest returns the sequence number of the oldest buffered frame, or 0.
+func (r *replayRing) oldest() uint64 {
+	if len(r.entries) == 0 {
+		return 0
+	}
+	return r.entries[r.next%len(r.entries)].seq
+}
+
+// each calls fn for the buffered frames in sequence order until fn returns false.
+func (r *replayRing) each(fn func(replayEntry) bool) {
+	for i := range r.entries {
+		if !fn(r.entries[(r.next+i)%len(r.entries)]) {
+			return
+		}
+	}
+}
+
+// enqueue stamps data with the session's next sequence number, records it for
+// replay and queues it on the attached connection, if any. It returns the
+// send channel that could not keep up, or nil.
+func (c *Client) enqueue(data []byte) chan []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.seq++
+	frame := withSeq(data, c.seq)
+	c.replay.add(replayEntry{seq: c.seq, frame: frame})
+
+	return c.push(frame)
+}
+
+// sendDirect queues an unsequenced frame, such as a heartbeat ack, that is
+// not replayed on resume.
+func (c *Client) sendDirect(data []byte) chan []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.push(data)
+}
+
+// push must be called with c.mu held.
+func (c *Client) push(frame []byte) chan []byte {
+	if c.Send == nil {
+		return nil
+	}
+
+	select {
+	case c.Send <- frame:
+		return nil
+	default:
+		return c.Send
+	}
+}
+
+// attach binds a connection's send channel to the session and returns the
+// frames the connection missed after lastSeq. Any previous connection is
+// detached first.
+func (c *Client) attach(send chan []byte, lastSeq uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if lastSeq > c.seq {
+		return ErrSessionExpired
+	}
+	// The oldest buffered event must directly follow what the client has seen.
+	if lastSeq < c.seq && c.replay.oldest() > lastSeq+1 {
+		return ErrSessionExpired
+	}
+
+	c.detachLocked(c.Send)
+
+	overflow := false
+	c.replay.each(func(entry replayEntry) bool {
+		if entry.seq <= lastSeq {
+			return true
+		}
+		select {
+		case send <- entry.frame:
+			return true
+		default:
+			overflow = true
+			return false
+		}
+	})
+	if overflow {
+		return ErrSessionExpired
+	}
+
+	c.Send = send
+	c.detachedAt = time.Time{}
+	c.evicting.Store(false)
+	return nil
+}
+
+// detach closes send if it is still the session's active connection.
+func (c *Client) detach(send chan []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.detachLocked(send)
+}
+
+func (c *Client) detachLocked(send chan []byte) bool {
+	if send == nil || c.Send != send {
+		return false
+	}
+
+	close(c.Send)
+	c.Send = nil
+	c.detachedAt = time.Now()
+	return true
+}
+
+// expired reports whether the session has been detached past the resume window.
+func (c *Client) expired(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Send == nil && !c.detachedAt.IsZero() && now.Sub(c.detachedAt) > ResumeWindow
+}
+
+// Attached reports whether a live connection is bound to the session.
+func (c *Client) Attached() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.Send != nil
+}
+
+// Seq returns the sequence number of the last event sent to the session.
+func (c *Client) Seq() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.seq
+}
+
+// withSeq inserts a "seq" field into a JSON object.
+func withSeq(data []byte, seq uint64) []byte {
+	if len(data) < 2 || data[0] != '{' {
+		return data
+	}
+
+	frame := make([]byte, 0, len(data)+24)
+	frame = append(frame, `{"seq":`...)
+	frame = strconv.AppendUint(frame, seq, 10)
+	if len(data) > 2 {
+		frame = append(frame, ',')
+	}
+	return append(frame, data[1:]...)
+}
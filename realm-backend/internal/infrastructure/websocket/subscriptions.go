@@ -0,0 +1,154 @@
+package websocket
+
+import (
+	"context"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// Control scopes ask every node to re-check or drop subscriptions; their
+// envelopes carry no payload for clients.
+const (
+	ScopeRevalidateChannel Scope = "revalidate_channel"
+	ScopeRevalidateRealm   Scope = "revalidate_realm"
+	// ScopeEvictMember removes the users in Targets from the realm in Target.
+	ScopeEvictMember Scope = "evict_member"
+)
+
+// ChannelAuthorizer decides who may stay subscribed to a channel. Channel
+// subscriptions are only authorized when they are made, so the hub asks it
+// again whenever permissions change.
+type ChannelAuthorizer interface {
+	// ChannelViewers returns which of userIDs may view the channel.
+	ChannelViewers(channelID uuid.UUID, userIDs []uuid.UUID) ([]uuid.UUID, error)
+}
+
+// SetChannelAuthorizer registers the authorizer used by RevalidateChannel
+// and RevalidateRealm. It must be called before the hub starts serving
+// clients.
+func (h *Hub) SetChannelAuthorizer(authorizer ChannelAuthorizer) {
+	h.authorizer = authorizer
+}
+
+// RevalidateChannel unsubscribes the sessions, attached or detached, of
+// users who can no longer view a channel, on this node and every node on
+// the backplane. Call it after the channel's permissions changed.
+func (h *Hub) RevalidateChannel(channelID uuid.UUID) {
+	h.revalidateChannel(channelID)
+	h.relay(Envelope{Scope: ScopeRevalidateChannel, Target: channelID})
+}
+
+// RevalidateRealm is RevalidateChannel for every channel of a realm, e.g.
+// after a role changed.
+func (h *Hub) RevalidateRealm(realmID uuid.UUID) {
+	h.revalidateRealm(realmID)
+	h.relay(Envelope{Scope: ScopeRevalidateRealm, Target: realmID})
+}
+
+// EvictMembers unsubscribes every client of the given users from a realm, on
+// this node and every node on the backplane. Call it once users left or were
+// removed from the realm.
+func (h *Hub) EvictMembers(realmID uuid.UUID, userIDs ...uuid.UUID) {
+	if len(userIDs) == 0 {
+		return
+	}
+	h.evictMembers(realmID, userIDs)
+	h.relay(Envelope{Scope: ScopeEvictMember, Target: realmID, Targets: userIDs})
+}
+
+// relay publishes a control envelope to the other nodes.
+func (h *Hub) relay(env Envelope) {
+	if h.backplane == nil {
+		return
+	}
+	env.NodeID = h.nodeID
+	if err := h.backplane.Publish(context.Background(), env); err != nil {
+		log.Printf("Backplane publish failed: %v", err)
+	}
+}
+
+func (h *Hub) evictMembers(realmID uuid.UUID, userIDs []uuid.UUID) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, userID := range userIDs {
+		for _, client := range h.userClients[userID] {
+			h.removeFromRealm(client, realmID)
+		}
+	}
+}
+
+func (h *Hub) revalidateChannel(channelID uuid.UUID) {
+	h.mutex.RLock()
+	users := subscribedUsers(h.channelClients[channelID])
+	h.mutex.RUnlock()
+
+	h.revoke(channelID, users)
+}
+
+func (h *Hub) revalidateRealm(realmID uuid.UUID) {
+	h.mutex.RLock()
+	byChannel := make(map[uuid.UUID]map[uuid.UUID]bool)
+	// Clients may join channels without subscribing to the realm, so every
+	// client is considered rather than only those in realmClients.
+	for _, client := range h.clients {
+		for channelID, channelRealm := range client.channels {
+			if channelRealm != realmID {
+				continue
+			}
+			if byChannel[channelID] == nil {
+				byChannel[channelID] = make(map[uuid.UUID]bool)
+			}
+			byChannel[channelID][client.UserID] = true
+		}
+	}
+	h.mutex.RUnlock()
+
+	for channelID, users := range byChannel {
+		h.revoke(channelID, users)
+	}
+}
+
+// revoke asks the authorizer which of the subscribed users may still view a
+// channel and unsubscribes the others. It must be called without the hub
+// mutex held.
+func (h *Hub) revoke(channelID uuid.UUID, users map[uuid.UUID]bool) {
+	if h.authorizer == nil || len(users) == 0 {
+		return
+	}
+
+	userIDs := make([]uuid.UUID, 0, len(users))
+	for userID := range users {
+		userIDs = append(userIDs, userID)
+	}
+	viewers, err := h.authorizer.ChannelViewers(channelID, userIDs)
+	if err != nil {
+		log.Printf("Failed to revalidate subscribers of channel %s: %v", channelID, err)
+		return
+	}
+	for _, userID := range viewers {
+		delete(users, userID)
+	}
+	if len(users) == 0 {
+		return
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, client := range h.channelClients[channelID] {
+		if users[client.UserID] {
+			h.removeFromChannel(client, channelID)
+		}
+	}
+}
+
+// subscribedUsers must be called with the hub mutex held.
+func subscribedUsers(clients map[uuid.UUID]*Client) map[uuid.UUID]bool {
+	users := make(map[uuid.UUID]bool, len(clients))
+	for _, client := range clients {
+		users[client.UserID] = true
+	}
+	return users
+}
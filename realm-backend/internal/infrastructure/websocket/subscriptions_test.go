@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// staticAuthorizer lets only the listed users view any channel.
+type staticAuthorizer struct {
+	mu      sync.Mutex
+	viewers map[uuid.UUID]bool
+}
+
+func (a *staticAuthorizer) ChannelViewers(channelID uuid.UUID, userIDs []uuid.UUID) ([]uuid.UUID, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var viewers []uuid.UUID
+	for _, userID := range userIDs {
+		if a.viewers[userID] {
+			viewers = append(viewers, userID)
+		}
+	}
+	return viewers, nil
+}
+
+func (a *staticAuthorizer) deny(userID uuid.UUID) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.viewers, userID)
+}
+
+func TestHubRevalidateChannelRevokesSubscriptions(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	realmID := uuid.New()
+	channelID := uuid.New()
+	kept := newTestClient(uuid.New(), SendBufferSize)
+	revoked := newTestClient(uuid.New(), SendBufferSize)
+	authorizer := &staticAuthorizer{viewers: map[uuid.UUID]bool{kept.UserID: true, revoked.UserID: true}}
+	hub.SetChannelAuthorizer(authorizer)
+
+	for _, client := range []*Client{kept, revoked} {
+		hub.Connect(client)
+		hub.AddClientToRealm(client.ID, realmID)
+		hub.AddClientToChannel(client.ID, realmID, channelID)
+	}
+
+	// The revoked user's session is detached, so the revocation must also
+	// hold once it resumes.
+	send := revoked.Send
+	hub.Detach(revoked, send)
+
+	authorizer.deny(revoked.UserID)
+	hub.RevalidateChannel(channelID)
+
+	if !hub.InChannel(kept.ID, channelID) {
+		t.Fatal("expected the viewer to stay subscribed")
+	}
+	if hub.InChannel(revoked.ID, channelID) {
+		t.Fatal("expected the subscription to be revoked")
+	}
+
+	reconnect := newTestClient(revoked.UserID, SendBufferSize)
+	hub.Connect(reconnect)
+	if _, err := hub.Resume(reconnect, revoked.ID, 0); err != nil {
+		t.Fatalf("Resume failed: %v", err)
+	}
+	hub.BroadcastToChannel(channelID, WSMessage{Type: "message_create"})
+
+	if frames := received(reconnect.Send); len(frames) != 0 {
+		t.Fatalf("expected no frames for the revoked session, got %v", frames)
+	}
+	if frames := received(kept.Send); len(frames) != 1 {
+		t.Fatalf("expected the viewer to receive 1 frame, got %d", len(frames))
+	}
+}
+
+func TestHubRevalidateRealmAcrossNodes(t *testing.T) {
+	bp := NewMemoryBackplane()
+	nodeA := newTestNode(t, bp)
+	nodeB := newTestNode(t, bp)
+
+	realmID := uuid.New()
+	otherRealmID := uuid.New()
+	channelID := uuid.New()
+	otherChannelID := uuid.New()
+	userID := uuid.New()
+
+	authorizer := &staticAuthorizer{viewers: map[uuid.UUID]bool{}}
+	nodeA.SetChannelAuthorizer(authorizer)
+	nodeB.SetChannelAuthorizer(authorizer)
+
+	client := newTestClient(userID, SendBufferSize)
+	nodeB.Connect(client)
+	nodeB.AddClientToRealm(client.ID, realmID)
+	nodeB.AddClientToChannel(client.ID, realmID, channelID)
+	nodeB.AddClientToRealm(client.ID, otherRealmID)
+	nodeB.AddClientToChannel(client.ID, otherRealmID, otherChannelID)
+
+	// Node A has no subscribers of its own; the revalidation is relayed.
+	nodeA.RevalidateRealm(realmID)
+
+	waitFor(t, "revoked subscription on node B", func() bool {
+		return !nodeB.InChannel(client.ID, channelID)
+	})
+	if !nodeB.InChannel(client.ID, otherChannelID) {
+		t.Fatal("expected channels of other realms to be left alone")
+	}
+}
+
+func TestHubRevalidateRealmCoversChannelOnlyClients(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	defer hub.Stop()
+
+	realmID := uuid.New()
+	channelID := uuid.New()
+	client := newTestClient(uuid.New(), SendBufferSize)
+	hub.SetChannelAuthorizer(&staticAuthorizer{viewers: map[uuid.UUID]bool{}})
+
+	// The client joined the channel without joining the realm.
+	hub.Connect(client)
+	hub.AddClientToChannel(client.ID, realmID, channelID)
+
+	hub.RevalidateRealm(realmID)
+
+	if hub.InChannel(client.ID, channelID) {
+		t.Fatal("expected the subscription to be revoked")
+	}
+}
@@ -0,0 +1,15 @@
+-- Per-channel permission overwrites for roles and members
+
+CREATE TABLE IF NOT EXISTS channel_overwrites (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    channel_id UUID REFERENCES channels(id) ON DELETE CASCADE,
+    target_id UUID NOT NULL,
+    target_type VARCHAR(10) NOT NULL CHECK (target_type IN ('role', 'member')),
+    allow BIGINT DEFAULT 0,
+    deny BIGINT DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE(channel_id, target_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_channel_overwrites_channel ON channel_overwrites(channel_id);
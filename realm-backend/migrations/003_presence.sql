@@ -0,0 +1,6 @@
+-- Presence is derived from WebSocket connections; the status a user picks is
+-- kept separately and only overrides what others see while they are connected.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS preferred_status VARCHAR(20) DEFAULT 'online';
+
+UPDATE users SET preferred_status = status WHERE status IN ('idle', 'dnd', 'invisible');
+UPDATE users SET status = 'offline';
@@ -0,0 +1,11 @@
+-- Full-text search over message content
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', coalesce(content, ''))) STORED;
+
+ALTER TABLE direct_messages ADD COLUMN IF NOT EXISTS search_vector tsvector
+    GENERATED ALWAYS AS (to_tsvector('english', coalesce(content, ''))) STORED;
+
+CREATE INDEX IF NOT EXISTS idx_messages_search ON messages USING GIN(search_vector);
+CREATE INDEX IF NOT EXISTS idx_direct_messages_search ON direct_messages USING GIN(search_vector);
+CREATE INDEX IF NOT EXISTS idx_messages_mentions ON messages USING GIN(mentions jsonb_path_ops);
@@ -0,0 +1,29 @@
+-- Uploaded files live in the blob store; rows keep the storage key and
+-- download URLs are signed on read.
+
+CREATE TABLE IF NOT EXISTS attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id UUID REFERENCES messages(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    storage_key TEXT NOT NULL,
+    size BIGINT,
+    mime_type VARCHAR(100),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS dm_attachments (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id UUID REFERENCES direct_messages(id) ON DELETE CASCADE,
+    filename TEXT NOT NULL,
+    storage_key TEXT NOT NULL,
+    size BIGINT,
+    mime_type VARCHAR(100),
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS storage_key TEXT;
+ALTER TABLE dm_attachments ADD COLUMN IF NOT EXISTS storage_key TEXT;
+ALTER TABLE realms ADD COLUMN IF NOT EXISTS icon_url TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message ON attachments(message_id);
+CREATE INDEX IF NOT EXISTS idx_dm_attachments_message ON dm_attachments(message_id);
@@ -0,0 +1,14 @@
+-- Image attachments are processed after upload; these columns stay empty
+-- until the thumbnail and placeholder have been generated.
+
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS width INTEGER;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS height INTEGER;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS blurhash TEXT;
+ALTER TABLE attachments ADD COLUMN IF NOT EXISTS thumbnail_key TEXT;
+
+ALTER TABLE dm_attachments ADD COLUMN IF NOT EXISTS width INTEGER;
+ALTER TABLE dm_attachments ADD COLUMN IF NOT EXISTS height INTEGER;
+ALTER TABLE dm_attachments ADD COLUMN IF NOT EXISTS blurhash TEXT;
+ALTER TABLE dm_attachments ADD COLUMN IF NOT EXISTS thumbnail_key TEXT;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS banner TEXT;
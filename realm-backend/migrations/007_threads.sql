@@ -0,0 +1,30 @@
+-- Threads branch off a channel message; replies are messages in the parent
+-- channel that carry the thread's ID.
+
+CREATE TABLE IF NOT EXISTS threads (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    channel_id UUID NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    message_id UUID UNIQUE REFERENCES messages(id) ON DELETE SET NULL,
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    reply_count INTEGER DEFAULT 0,
+    last_reply_at TIMESTAMP,
+    archived BOOLEAN DEFAULT FALSE,
+    archived_at TIMESTAMP,
+    auto_archive_minutes INTEGER DEFAULT 1440,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS thread_members (
+    thread_id UUID REFERENCES threads(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    joined_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (thread_id, user_id)
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS thread_id UUID REFERENCES threads(id) ON DELETE CASCADE;
+
+CREATE INDEX IF NOT EXISTS idx_threads_channel ON threads(channel_id, archived);
+CREATE INDEX IF NOT EXISTS idx_threads_active ON threads(COALESCE(last_reply_at, created_at)) WHERE NOT archived;
+CREATE INDEX IF NOT EXISTS idx_messages_thread ON messages(thread_id, created_at, id) WHERE thread_id IS NOT NULL;
@@ -0,0 +1,7 @@
+-- Pins record when and by whom a message was pinned.
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS pinned BOOLEAN DEFAULT FALSE;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS pinned_at TIMESTAMP;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS pinned_by UUID REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_messages_pins ON messages(channel_id, pinned_at DESC) WHERE pinned;
@@ -0,0 +1,19 @@
+-- Resolved mentions: messages.mentions holds the mentioned user IDs,
+-- mention_roles the mentioned role IDs.
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS mentions JSONB;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS mention_roles JSONB;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS mention_everyone BOOLEAN DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    type VARCHAR(50) NOT NULL,
+    title TEXT NOT NULL,
+    message TEXT,
+    data TEXT,
+    read BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_type ON notifications(user_id, type, created_at DESC, id DESC);
@@ -0,0 +1,14 @@
+-- Read states record the last message a user has read in each channel or DM
+-- conversation; later messages count as unread.
+
+CREATE TABLE IF NOT EXISTS read_states (
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    channel_id UUID NOT NULL,
+    last_message_id UUID NOT NULL,
+    last_read_at TIMESTAMP NOT NULL,
+    updated_at TIMESTAMP DEFAULT NOW(),
+    PRIMARY KEY (user_id, channel_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_messages_channel_created ON messages(channel_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_direct_messages_pair_created ON direct_messages(recipient_id, sender_id, created_at);
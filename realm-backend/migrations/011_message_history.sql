@@ -0,0 +1,32 @@
+-- Edits keep the previous content as revisions and deletions leave
+-- tombstones behind.
+
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id UUID NOT NULL,
+    content TEXT,
+    replaced_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message ON message_revisions(message_id, replaced_at);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_deleted_at ON messages(deleted_at);
+
+ALTER TABLE direct_messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP;
+ALTER TABLE direct_messages ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
+CREATE INDEX IF NOT EXISTS idx_direct_messages_deleted_at ON direct_messages(deleted_at);
+
+CREATE TABLE IF NOT EXISTS moderation_actions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    realm_id UUID NOT NULL REFERENCES realms(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    moderator_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    action VARCHAR(32) NOT NULL,
+    reason TEXT,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+ALTER TABLE moderation_actions ADD COLUMN IF NOT EXISTS message_id UUID;
@@ -0,0 +1,6 @@
+-- Purges are logged as one moderation action covering many messages, which
+-- may have several authors.
+
+ALTER TABLE moderation_actions ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE moderation_actions ADD COLUMN IF NOT EXISTS channel_id UUID;
+ALTER TABLE moderation_actions ADD COLUMN IF NOT EXISTS count INTEGER DEFAULT 0;
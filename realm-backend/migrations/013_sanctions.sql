@@ -0,0 +1,7 @@
+-- Bans and timeouts stay in force until they expire or are lifted.
+
+ALTER TABLE moderation_actions ADD COLUMN IF NOT EXISTS lifted_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_moderation_actions_active
+    ON moderation_actions(realm_id, user_id, action)
+    WHERE lifted_at IS NULL;
@@ -0,0 +1,31 @@
+-- Realms can have many invites, each optionally expiring, limited in uses
+-- or granting temporary membership, plus one vanity code set by the owner.
+
+CREATE TABLE IF NOT EXISTS invites (
+    code VARCHAR(32) PRIMARY KEY,
+    realm_id UUID NOT NULL REFERENCES realms(id) ON DELETE CASCADE,
+    channel_id UUID REFERENCES channels(id) ON DELETE SET NULL,
+    creator_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    max_uses INTEGER DEFAULT 0,
+    uses INTEGER DEFAULT 0,
+    expires_at TIMESTAMP,
+    temporary BOOLEAN DEFAULT FALSE,
+    vanity BOOLEAN DEFAULT FALSE,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_invites_realm ON invites(realm_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_invites_vanity ON invites(realm_id) WHERE vanity;
+
+ALTER TABLE realm_members ADD COLUMN IF NOT EXISTS temporary BOOLEAN DEFAULT FALSE;
+
+-- The single permanent code each realm had becomes an ordinary invite.
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'realms' AND column_name = 'invite_code') THEN
+        INSERT INTO invites (code, realm_id, creator_id, created_at)
+        SELECT invite_code, id, owner_id, created_at FROM realms
+        ON CONFLICT DO NOTHING;
+        ALTER TABLE realms DROP COLUMN invite_code;
+    END IF;
+END $$;
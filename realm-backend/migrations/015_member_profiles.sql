@@ -0,0 +1,4 @@
+-- Per-realm nicknames and avatars.
+
+ALTER TABLE realm_members ADD COLUMN IF NOT EXISTS nickname VARCHAR(32);
+ALTER TABLE realm_members ADD COLUMN IF NOT EXISTS avatar TEXT;
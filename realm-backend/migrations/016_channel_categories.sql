@@ -0,0 +1,23 @@
+-- Category permission overwrites, copied to the channels synced with their
+-- category. Deleting a category moves its channels to the top level.
+
+CREATE TABLE IF NOT EXISTS category_overwrites (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    category_id UUID NOT NULL REFERENCES channel_categories(id) ON DELETE CASCADE,
+    target_id UUID NOT NULL,
+    target_type VARCHAR(10) NOT NULL CHECK (target_type IN ('role', 'member')),
+    allow BIGINT DEFAULT 0,
+    deny BIGINT DEFAULT 0,
+    created_at TIMESTAMP DEFAULT NOW(),
+    updated_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE(category_id, target_id)
+);
+
+ALTER TABLE channels ADD COLUMN IF NOT EXISTS permissions_synced BOOLEAN DEFAULT FALSE;
+
+ALTER TABLE channels DROP CONSTRAINT IF EXISTS channels_category_id_fkey;
+ALTER TABLE channels ADD CONSTRAINT channels_category_id_fkey
+    FOREIGN KEY (category_id) REFERENCES channel_categories(id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_channel_categories_realm ON channel_categories(realm_id, position);
+CREATE INDEX IF NOT EXISTS idx_channels_category ON channels(category_id);
@@ -0,0 +1,6 @@
+-- Age acknowledgement for NSFW channels. Slow mode, NSFW, user limit and
+-- bitrate columns on channels come from 001_enhance_schema.sql.
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS age_acknowledged_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS idx_messages_channel_user ON messages(channel_id, user_id, created_at DESC);
@@ -0,0 +1,31 @@
+-- Announcement channel follows and the queue of crossposts still to be
+-- delivered to following channels.
+
+CREATE TABLE IF NOT EXISTS channel_follows (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    source_channel_id UUID NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    target_channel_id UUID NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    creator_id UUID NOT NULL REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT NOW(),
+    UNIQUE(source_channel_id, target_channel_id)
+);
+
+CREATE TABLE IF NOT EXISTS crosspost_deliveries (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    message_id UUID NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    target_channel_id UUID NOT NULL REFERENCES channels(id) ON DELETE CASCADE,
+    attempts INTEGER DEFAULT 0,
+    next_attempt_at TIMESTAMP DEFAULT NOW(),
+    last_error TEXT,
+    created_at TIMESTAMP DEFAULT NOW()
+);
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS published_at TIMESTAMP;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS source_message_id UUID REFERENCES messages(id) ON DELETE SET NULL;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS crosspost JSONB;
+
+CREATE INDEX IF NOT EXISTS idx_channel_follows_target ON channel_follows(target_channel_id);
+CREATE INDEX IF NOT EXISTS idx_crosspost_deliveries_due ON crosspost_deliveries(next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_messages_published ON messages(channel_id, published_at) WHERE published_at IS NOT NULL;
+-- A published message is crossposted at most once into each channel.
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_crosspost ON messages(channel_id, source_message_id) WHERE source_message_id IS NOT NULL;